@@ -17,11 +17,18 @@ limitations under the License.
 package v1alpha1
 
 import (
+	"context"
 	"fmt"
+	autoscalingv2beta2 "k8s.io/api/autoscaling/v2beta2"
 	v1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
 	extv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sort"
 )
 
 // EDIT THIS FILE!  THIS IS SCAFFOLDING FOR YOU TO OWN!
@@ -36,6 +43,54 @@ var (
 	PhaseActive       StatusPhase = "active"
 )
 
+// StatusReason is a machine-readable explanation of the last reconciliation failure.
+type StatusReason string
+
+var (
+	NoReason StatusReason
+	// ReasonTransientError marks failures that are expected to resolve on their own (e.g. the Dex gRPC API being unavailable).
+	// They are retried with an exponential backoff.
+	ReasonTransientError StatusReason = "TransientError"
+	// ReasonPermanentError marks failures that cannot be resolved without changing the object spec.
+	// They are not retried until the spec is updated.
+	ReasonPermanentError StatusReason = "PermanentError"
+	// ReasonConflict marks failures caused by concurrent updates to the managed objects.
+	// They are retried immediately.
+	ReasonConflict StatusReason = "Conflict"
+	// ReasonInstanceMissing marks DexClients whose Dex instance does not exist (anymore).
+	// They are retried with an exponential backoff until the instance shows up.
+	ReasonInstanceMissing StatusReason = "InstanceMissing"
+	// ReasonInstanceNotWatched marks DexClients referencing a Dex instance outside of the namespaces watched by the operator.
+	// They are retried with an exponential backoff, as the operator may be reconfigured to watch the namespace.
+	ReasonInstanceNotWatched StatusReason = "InstanceNotWatched"
+	// ReasonNotAllowed marks DexClients rejected by the client policy of their Dex instance.
+	// They are retried with an exponential backoff until the policy allows them.
+	ReasonNotAllowed StatusReason = "NotAllowed"
+)
+
+// DeletionPolicy defines what happens to the DexClients referencing a Dex instance when it is deleted
+// +kubebuilder:validation:Enum=Block;Cascade;Orphan
+type DeletionPolicy string
+
+var (
+	// DeletionPolicyBlock rejects the deletion of the instance while any DexClient references it
+	DeletionPolicyBlock DeletionPolicy = "Block"
+	// DeletionPolicyCascade deletes the DexClients referencing the instance together with it.
+	// Clients targeting other instances as well are only removed from this one
+	DeletionPolicyCascade DeletionPolicy = "Cascade"
+	// DeletionPolicyOrphan leaves the DexClients referencing the instance in place, marking them as InstanceMissing
+	DeletionPolicyOrphan DeletionPolicy = "Orphan"
+)
+
+const (
+	// ContainerName is the name of the Dex container in the instance pods
+	ContainerName = "dex"
+	// ConfigVolumeName is the name of the pod volume holding the Dex configuration
+	ConfigVolumeName = "config"
+	// ConfigMountPath is where the Dex configuration is mounted in the Dex container
+	ConfigMountPath = "/etc/dex/cfg"
+)
+
 type Connector struct {
 	Type    string     `json:"type"`
 	Name    string     `json:"name"`
@@ -50,18 +105,66 @@ type DexSpec struct {
 	// Example: https://auth.example.com/dex
 	PublicURL string `json:"publicURL"`
 
+	// DeletionPolicy defines what happens to the DexClients referencing the instance when it is deleted.
+	// Block rejects the deletion while any client exists, Cascade deletes them, or only removes them from
+	// the instance if they target other instances as well, and Orphan leaves them in place marked as InstanceMissing
+	// +kubebuilder:default:=Orphan
+	// +optional
+	DeletionPolicy DeletionPolicy `json:"deletionPolicy,omitempty"`
+
+	// ClientPolicy restricts which DexClients can be registered on the instance
+	// +optional
+	ClientPolicy ClientPolicy `json:"clientPolicy,omitempty"`
+
 	// Connectors is the list of base connectors
 	// +kubebuilder:validation:MinItems=1
 	Connectors []Connector `json:"connectors"`
 
-	// Replicas is the number of Pods to deploy
+	// Replicas is the number of Pods to deploy.
+	// It is ignored when autoscaling is enabled
 	// +kubebuilder:default:=1
 	Replicas int32 `json:"replicas,omitempty"`
 
+	// PodDisruptionBudget allows to configure the PodDisruptionBudget object for the Dex pods
+	// +optional
+	PodDisruptionBudget PodDisruptionBudget `json:"podDisruptionBudget,omitempty"`
+
+	// Autoscaling allows to configure the HorizontalPodAutoscaler object for the Dex pods
+	// +optional
+	Autoscaling Autoscaling `json:"autoscaling,omitempty"`
+
 	// EnvFrom is a reference to an environment variables source for the Dex pods
 	// +optional
 	EnvFrom []v1.EnvFromSource `json:"envFrom,omitempty"`
 
+	// ExtraEnv is a list of additional environment variables for the Dex container
+	// +optional
+	ExtraEnv []v1.EnvVar `json:"extraEnv,omitempty"`
+
+	// ExtraVolumes is a list of additional volumes for the Dex pods
+	// +optional
+	ExtraVolumes []v1.Volume `json:"extraVolumes,omitempty"`
+
+	// ExtraVolumeMounts is a list of additional volume mounts for the Dex container
+	// +optional
+	ExtraVolumeMounts []v1.VolumeMount `json:"extraVolumeMounts,omitempty"`
+
+	// InitContainers is a list of init containers added to the Dex pods
+	// +optional
+	InitContainers []v1.Container `json:"initContainers,omitempty"`
+
+	// Sidecars is a list of containers running alongside Dex in its pods
+	// +optional
+	Sidecars []v1.Container `json:"sidecars,omitempty"`
+
+	// PodAnnotations is a set of annotations that will be applied to the Dex pods
+	// +optional
+	PodAnnotations map[string]string `json:"podAnnotations,omitempty"`
+
+	// PodLabels is a set of labels that will be applied to the Dex pods, on top of the instance labels
+	// +optional
+	PodLabels map[string]string `json:"podLabels,omitempty"`
+
 	// Labels is a set of labels that will be applied to the instance resources
 	// +optional
 	InstanceLabels map[string]string `json:"instanceLabels,omitempty"`
@@ -71,6 +174,12 @@ type DexSpec struct {
 	// +optional
 	Image string `json:"image,omitempty"`
 
+	// ImagePullPolicy is the pull policy for the Dex image.
+	// Defaults to Always if the image tag is latest, IfNotPresent otherwise
+	// +kubebuilder:validation:Enum=Always;Never;IfNotPresent
+	// +optional
+	ImagePullPolicy v1.PullPolicy `json:"imagePullPolicy,omitempty"`
+
 	// ImagePullSecrets is an optional list of references to secrets in the same namespace
 	// to use for pulling Dex images from registries
 	// see http://kubernetes.io/docs/user-guide/images#specifying-imagepullsecrets-on-a-pod
@@ -107,8 +216,66 @@ type DexSpec struct {
 	// +optional
 	SecurityContext *v1.PodSecurityContext `json:"securityContext,omitempty"`
 
+	// ContainerSecurityContext holds the security configuration of the Dex container.
+	// Fields set here take precedence over the pod-level SecurityContext
+	// +optional
+	ContainerSecurityContext *v1.SecurityContext `json:"containerSecurityContext,omitempty"`
+
+	// PriorityClassName is the name of the PriorityClass assigned to the Dex pods
+	// +optional
+	PriorityClassName string `json:"priorityClassName,omitempty"`
+
+	// TerminationGracePeriodSeconds is the duration in seconds the Dex pods need to terminate gracefully
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	TerminationGracePeriodSeconds *int64 `json:"terminationGracePeriodSeconds,omitempty"`
+
+	// Probes allows to tune the timings of the health probes of the Dex container
+	// +optional
+	Probes Probes `json:"probes,omitempty"`
+
+	// Service allows to configure how the Dex Service object is exposed
+	// +optional
+	Service Service `json:"service,omitempty"`
+
 	// Ingress allows to configure the Ingress object to route traffic into Dex
 	Ingress Ingress `json:"ingress,omitempty"`
+
+	// Gateway allows to configure the Gateway API HTTPRoute object to route traffic into Dex.
+	// It can be used instead of, or alongside, the Ingress object
+	// +optional
+	Gateway Gateway `json:"gateway,omitempty"`
+
+	// NetworkPolicy allows to configure the NetworkPolicy object restricting traffic to the Dex pods
+	// +optional
+	NetworkPolicy NetworkPolicy `json:"networkPolicy,omitempty"`
+
+	// Monitoring allows to configure the Prometheus Operator objects used to scrape and alert on Dex metrics
+	// +optional
+	Monitoring Monitoring `json:"monitoring,omitempty"`
+}
+
+type Service struct {
+	// Type determines how the Service is exposed
+	// +kubebuilder:validation:Enum=ClusterIP;NodePort;LoadBalancer
+	// +kubebuilder:default:=ClusterIP
+	// +optional
+	Type v1.ServiceType `json:"type,omitempty"`
+	// Annotations to be added to the Service object
+	// +optional
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// LoadBalancerSourceRanges restricts the client IPs allowed to reach a LoadBalancer Service
+	// +optional
+	LoadBalancerSourceRanges []string `json:"loadBalancerSourceRanges,omitempty"`
+	// ExternalTrafficPolicy denotes if the Service routes external traffic to node-local or cluster-wide endpoints.
+	// Only valid for NodePort and LoadBalancer Services
+	// +kubebuilder:validation:Enum=Cluster;Local
+	// +optional
+	ExternalTrafficPolicy v1.ServiceExternalTrafficPolicyType `json:"externalTrafficPolicy,omitempty"`
+	// SeparateWeb exposes only the web port through a dedicated Service configured by this object.
+	// The gRPC API stays on the internal ClusterIP Service
+	// +optional
+	SeparateWeb bool `json:"separateWeb,omitempty"`
 }
 
 type Ingress struct {
@@ -125,6 +292,272 @@ type Ingress struct {
 	// TLSSecretName overrides the generated name for the TLS certificate Secret object
 	// +optional
 	TLSSecretName string `json:"tlsSecretName,omitempty"`
+	// TLSHosts overrides the list of hosts included in the TLS configuration. Defaults to Hosts
+	// +optional
+	TLSHosts []string `json:"tlsHosts,omitempty"`
+	// ClassName is the name of the IngressClass used to serve the Ingress object
+	// +optional
+	ClassName *string `json:"className,omitempty"`
+	// Hosts is the list of hostnames routed to Dex, including aliases.
+	// Defaults to the publicURL host, and must include it if set
+	// +optional
+	Hosts []string `json:"hosts,omitempty"`
+	// PathType is the type of the publicURL path rule
+	// +kubebuilder:validation:Enum=Exact;Prefix;ImplementationSpecific
+	// +kubebuilder:default:=Prefix
+	// +optional
+	PathType *networkingv1.PathType `json:"pathType,omitempty"`
+	// Paths is a list of additional paths routed to Dex.
+	// Paths with annotations are served by a dedicated Ingress object
+	// +optional
+	Paths []IngressPath `json:"paths,omitempty"`
+}
+
+type IngressPath struct {
+	// Path is matched against the request path. Must be within the publicURL path
+	Path string `json:"path"`
+	// PathType is the type of the path rule. Defaults to the Ingress path type
+	// +kubebuilder:validation:Enum=Exact;Prefix;ImplementationSpecific
+	// +optional
+	PathType *networkingv1.PathType `json:"pathType,omitempty"`
+	// Annotations to be added to the Ingress object serving this path, on top of the Ingress annotations
+	// +optional
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type Gateway struct {
+	// Enabled toggles the creation of the HTTPRoute object.
+	// It is only created if the Gateway API CRDs are installed in the cluster
+	// +optional
+	Enabled bool `json:"enabled,omitempty"`
+	// Annotations to be added to the HTTPRoute object
+	// +optional
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// Labels to be added to the HTTPRoute object
+	// +optional
+	Labels map[string]string `json:"labels,omitempty"`
+	// ParentRefs references the Gateways the HTTPRoute is attached to
+	// +kubebuilder:validation:MinItems=1
+	// +optional
+	ParentRefs []ParentReference `json:"parentRefs,omitempty"`
+	// Hostnames is the list of hostnames routed to Dex. Defaults to the publicURL host
+	// +optional
+	Hostnames []string `json:"hostnames,omitempty"`
+	// BackendTLS configures a BackendTLSPolicy for the connection between the Gateway and Dex.
+	// Only useful if the Dex web server is serving TLS
+	// +optional
+	BackendTLS *BackendTLS `json:"backendTLS,omitempty"`
+}
+
+// ParentReference mirrors the Gateway API ParentReference type.
+// More info: https://gateway-api.sigs.k8s.io/reference/spec/#parentreference
+type ParentReference struct {
+	// Group is the group of the referent. Defaults to gateway.networking.k8s.io
+	// +optional
+	Group string `json:"group,omitempty"`
+	// Kind is the kind of the referent. Defaults to Gateway
+	// +optional
+	Kind string `json:"kind,omitempty"`
+	// Namespace is the namespace of the referent. Defaults to the namespace of the Dex instance
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+	// Name is the name of the referent
+	Name string `json:"name"`
+	// SectionName is the name of a section within the target resource, e.g. a Gateway listener
+	// +optional
+	SectionName string `json:"sectionName,omitempty"`
+	// Port is the network port this Route targets
+	// +optional
+	Port *int32 `json:"port,omitempty"`
+}
+
+type BackendTLS struct {
+	// Hostname is used by the Gateway as SNI and to validate the Dex certificate
+	Hostname string `json:"hostname"`
+	// CACertificateRefs is a list of ConfigMaps containing the CA certificates used to validate the Dex certificate.
+	// If empty, the system trust store is used
+	// +optional
+	CACertificateRefs []v1.LocalObjectReference `json:"caCertificateRefs,omitempty"`
+}
+
+type ClientPolicy struct {
+	// AllowedNamespaces restricts the namespaces DexClients can be registered from.
+	// DexClients in the instance namespace are always allowed.
+	// If unset, DexClients from all namespaces are allowed
+	// +optional
+	AllowedNamespaces *AllowedNamespaces `json:"allowedNamespaces,omitempty"`
+}
+
+// AllowedNamespaces matches namespaces either by name or by labels.
+// A namespace is allowed if it matches any of the two
+type AllowedNamespaces struct {
+	// Names is a list of allowed namespace names
+	// +optional
+	Names []string `json:"names,omitempty"`
+	// Selector matches the labels of allowed namespaces
+	// +optional
+	Selector *metav1.LabelSelector `json:"selector,omitempty"`
+}
+
+type Probes struct {
+	// Liveness overrides the timings of the liveness probe hitting /healthz/live
+	// +optional
+	Liveness *ProbeTimings `json:"liveness,omitempty"`
+	// Readiness overrides the timings of the readiness probe hitting /healthz/ready
+	// +optional
+	Readiness *ProbeTimings `json:"readiness,omitempty"`
+	// Startup overrides the timings of the startup probe hitting /healthz/live.
+	// Raise its failureThreshold if connectors take long to initialize
+	// +optional
+	Startup *ProbeTimings `json:"startup,omitempty"`
+}
+
+type ProbeTimings struct {
+	// InitialDelaySeconds is the number of seconds after the container has started before the probe is initiated
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	InitialDelaySeconds *int32 `json:"initialDelaySeconds,omitempty"`
+	// PeriodSeconds is how often (in seconds) to perform the probe
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	PeriodSeconds *int32 `json:"periodSeconds,omitempty"`
+	// TimeoutSeconds is the number of seconds after which the probe times out
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	TimeoutSeconds *int32 `json:"timeoutSeconds,omitempty"`
+	// SuccessThreshold is the minimum consecutive successes for the probe to be considered successful after having failed.
+	// Must be 1 for liveness and startup probes
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	SuccessThreshold *int32 `json:"successThreshold,omitempty"`
+	// FailureThreshold is the minimum consecutive failures for the probe to be considered failed after having succeeded
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	FailureThreshold *int32 `json:"failureThreshold,omitempty"`
+}
+
+type PodDisruptionBudget struct {
+	// Enabled toggles the creation of the PodDisruptionBudget object
+	// +optional
+	Enabled bool `json:"enabled,omitempty"`
+	// MinAvailable is the number or percentage of pods that must be available after an eviction.
+	// Cannot be set together with MaxUnavailable
+	// +optional
+	MinAvailable *intstr.IntOrString `json:"minAvailable,omitempty"`
+	// MaxUnavailable is the number or percentage of pods that can be unavailable after an eviction.
+	// Cannot be set together with MinAvailable. Defaults to 1 if neither is set
+	// +optional
+	MaxUnavailable *intstr.IntOrString `json:"maxUnavailable,omitempty"`
+}
+
+type Autoscaling struct {
+	// Enabled toggles the creation of the HorizontalPodAutoscaler object.
+	// When enabled, the operator stops managing the number of replicas of the Dex Deployment
+	// +optional
+	Enabled bool `json:"enabled,omitempty"`
+	// MinReplicas is the lower limit for the number of replicas
+	// +kubebuilder:default:=1
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	MinReplicas *int32 `json:"minReplicas,omitempty"`
+	// MaxReplicas is the upper limit for the number of replicas
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	MaxReplicas int32 `json:"maxReplicas,omitempty"`
+	// TargetCPUUtilizationPercentage is the target average CPU utilization over all the pods,
+	// as a percentage of the requested CPU
+	// +optional
+	TargetCPUUtilizationPercentage *int32 `json:"targetCPUUtilizationPercentage,omitempty"`
+	// TargetMemoryUtilizationPercentage is the target average memory utilization over all the pods,
+	// as a percentage of the requested memory
+	// +optional
+	TargetMemoryUtilizationPercentage *int32 `json:"targetMemoryUtilizationPercentage,omitempty"`
+	// Metrics is a list of additional metrics used to calculate the desired replica count.
+	// If no metric is configured the CPU utilization target defaults to 80%
+	// +optional
+	Metrics []autoscalingv2beta2.MetricSpec `json:"metrics,omitempty"`
+}
+
+type NetworkPolicy struct {
+	// Enabled toggles the creation of the NetworkPolicy object.
+	// When enabled, the gRPC API port is only reachable by the operator pods
+	// +optional
+	Enabled bool `json:"enabled,omitempty"`
+	// IngressNamespaces is the list of namespaces allowed to reach the Dex web port, usually the ones
+	// running the ingress controllers. If empty, the web port is reachable from anywhere
+	// +optional
+	IngressNamespaces []string `json:"ingressNamespaces,omitempty"`
+	// MonitoringNamespaces is the list of namespaces allowed to reach the Dex metrics port
+	// +optional
+	MonitoringNamespaces []string `json:"monitoringNamespaces,omitempty"`
+}
+
+type Monitoring struct {
+	// ServiceMonitor configures the Prometheus Operator ServiceMonitor object for the Dex metrics endpoint
+	// +optional
+	ServiceMonitor ServiceMonitor `json:"serviceMonitor,omitempty"`
+	// PrometheusRule configures the Prometheus Operator PrometheusRule object with the default Dex alerts
+	// +optional
+	PrometheusRule PrometheusRule `json:"prometheusRule,omitempty"`
+}
+
+type ServiceMonitor struct {
+	// Enabled toggles the creation of the ServiceMonitor object.
+	// It is only created if the ServiceMonitor CRD is installed in the cluster
+	// +optional
+	Enabled bool `json:"enabled,omitempty"`
+	// Interval at which metrics should be scraped. Defaults to the Prometheus global interval
+	// +optional
+	Interval string `json:"interval,omitempty"`
+	// ScrapeTimeout after which the scrape is ended. Defaults to the Prometheus global timeout
+	// +optional
+	ScrapeTimeout string `json:"scrapeTimeout,omitempty"`
+	// Labels to be added to the ServiceMonitor object, usually to match the Prometheus serviceMonitorSelector
+	// +optional
+	Labels map[string]string `json:"labels,omitempty"`
+	// Relabelings to apply to samples before scraping
+	// +optional
+	Relabelings []RelabelConfig `json:"relabelings,omitempty"`
+	// MetricRelabelings to apply to samples before ingestion
+	// +optional
+	MetricRelabelings []RelabelConfig `json:"metricRelabelings,omitempty"`
+}
+
+// RelabelConfig mirrors the Prometheus Operator RelabelConfig type.
+// More info: https://prometheus.io/docs/prometheus/latest/configuration/configuration/#relabel_config
+type RelabelConfig struct {
+	// SourceLabels select values from existing labels
+	// +optional
+	SourceLabels []string `json:"sourceLabels,omitempty"`
+	// Separator placed between concatenated source label values. Defaults to ';'
+	// +optional
+	Separator string `json:"separator,omitempty"`
+	// TargetLabel to which the resulting value is written in a replace action
+	// +optional
+	TargetLabel string `json:"targetLabel,omitempty"`
+	// Regex against which the extracted value is matched. Defaults to '(.*)'
+	// +optional
+	Regex string `json:"regex,omitempty"`
+	// Modulus to take of the hash of the source label values
+	// +optional
+	Modulus uint64 `json:"modulus,omitempty"`
+	// Replacement value against which a regex replace is performed. Defaults to '$1'
+	// +optional
+	Replacement string `json:"replacement,omitempty"`
+	// Action to perform based on regex matching. Defaults to 'replace'
+	// +kubebuilder:validation:Enum=replace;keep;drop;hashmod;labelmap;labeldrop;labelkeep
+	// +optional
+	Action string `json:"action,omitempty"`
+}
+
+type PrometheusRule struct {
+	// Enabled toggles the creation of the PrometheusRule object.
+	// It is only created if the PrometheusRule CRD is installed in the cluster
+	// +optional
+	Enabled bool `json:"enabled,omitempty"`
+	// Labels to be added to the PrometheusRule object, usually to match the Prometheus ruleSelector
+	// +optional
+	Labels map[string]string `json:"labels,omitempty"`
 }
 
 // DexStatus defines the observed state of Dex
@@ -141,10 +574,26 @@ type DexStatus struct {
 	Selector string `json:"selector"`
 	// EndpointURL contains the API endpoint for the Dex instance
 	EndpointURL string `json:"endpointURL"`
+	// Reason is the class of the last reconciliation failure, if any.
+	// +optional
+	Reason StatusReason `json:"reason,omitempty"`
+	// ObservedGeneration is the most recent generation observed by the operator.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// Conditions represent the latest available observations of the instance state
+	// +listType=map
+	// +listMapKey=type
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
 }
 
 type DexConditionType string
 
+var (
+	// DexConditionRouteAccepted reports whether the HTTPRoute has been accepted by all its parent Gateways
+	DexConditionRouteAccepted DexConditionType = "RouteAccepted"
+)
+
 // +kubebuilder:object:root=true
 // +kubebuilder:resource:path=dexes
 // +kubebuilder:subresource:status
@@ -154,6 +603,7 @@ type DexConditionType string
 // +kubebuilder:printcolumn:name="URL",type=string,JSONPath=`.spec.publicURL`
 // +kubebuilder:printcolumn:name="Ready",type=boolean,JSONPath=`.status.ready`
 // +kubebuilder:printcolumn:name="Message",type=string,JSONPath=`.status.message`,priority=1
+// +kubebuilder:printcolumn:name="Reason",type=string,JSONPath=`.status.reason`,priority=1
 // +kubebuilder:printcolumn:name="Image",type=string,JSONPath=`.spec.image`,priority=1
 // +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 
@@ -191,6 +641,97 @@ func (in *Dex) NamespacedName() types.NamespacedName {
 	}
 }
 
+// InstanceKey returns the key identifying the instance in the status of the DexClients registered on it
+func (in *Dex) InstanceKey() InstanceKey {
+	return InstanceKey{
+		Kind:           KindDex,
+		NamespacedName: in.NamespacedName(),
+	}
+}
+
+// SelectsNamespaceLabels reports whether the policy needs the namespace labels to be evaluated
+func (in *ClientPolicy) SelectsNamespaceLabels() bool {
+	return in.AllowedNamespaces != nil && in.AllowedNamespaces.Selector != nil
+}
+
+// AllowsNamespace reports whether DexClients in ns are allowed to register on the instance.
+// The namespace labels are only needed when the policy selects namespaces by labels
+func (in *Dex) AllowsNamespace(ns *v1.Namespace) (bool, error) {
+	an := in.Spec.ClientPolicy.AllowedNamespaces
+	if an == nil || ns.Name == in.Namespace {
+		return true, nil
+	}
+
+	return an.Matches(ns)
+}
+
+// Matches reports whether ns is listed by name or matches the selector
+func (in *AllowedNamespaces) Matches(ns *v1.Namespace) (bool, error) {
+	for _, n := range in.Names {
+		if n == ns.Name {
+			return true, nil
+		}
+	}
+
+	if in.Selector == nil {
+		return false, nil
+	}
+	sel, err := metav1.LabelSelectorAsSelector(in.Selector)
+	if err != nil {
+		return false, err
+	}
+	return sel.Matches(labels.Set(ns.Labels)), nil
+}
+
+// DefaultInstanceAnnotation marks a Dex instance as the one DexClients are registered on when they don't target any.
+// Its value is the scope of the default, either DefaultScopeNamespace or DefaultScopeCluster
+const DefaultInstanceAnnotation = "dex.karavel.io/is-default-instance"
+
+const (
+	// DefaultScopeNamespace makes the instance the default for the clients in its own namespace
+	DefaultScopeNamespace = "namespace"
+	// DefaultScopeCluster makes the instance the default for the clients in namespaces without a default of their own
+	DefaultScopeCluster = "cluster"
+)
+
+// DefaultScope returns the scope the instance is the default for, or an empty string
+func (in *Dex) DefaultScope() string {
+	return in.Annotations[DefaultInstanceAnnotation]
+}
+
+// DefaultInstances returns the default Dex instances for the DexClients in namespace: the ones marked as default
+// for the namespace itself or, if there are none, the ones marked as default for the cluster.
+// More than one instance means that the default is ambiguous
+func DefaultInstances(ctx context.Context, r client.Reader, namespace string) ([]types.NamespacedName, error) {
+	var list DexList
+	if err := r.List(ctx, &list); err != nil {
+		return nil, err
+	}
+
+	local := make([]types.NamespacedName, 0)
+	cluster := make([]types.NamespacedName, 0)
+	for i := range list.Items {
+		d := &list.Items[i]
+		switch d.DefaultScope() {
+		case DefaultScopeNamespace:
+			if d.Namespace == namespace {
+				local = append(local, d.NamespacedName())
+			}
+		case DefaultScopeCluster:
+			cluster = append(cluster, d.NamespacedName())
+		}
+	}
+
+	res := cluster
+	if len(local) > 0 {
+		res = local
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].String() < res[j].String()
+	})
+	return res, nil
+}
+
 func (in *Dex) ServiceName() string {
 	return fmt.Sprintf("%s-operated", in.Name)
 }
@@ -17,26 +17,73 @@ limitations under the License.
 package v1alpha1
 
 import (
+	"context"
+	"fmt"
+	admissionv1 "k8s.io/api/admission/v1"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/util/validation/field"
+	"net"
 	"net/url"
+	"path"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+	"strings"
 )
 
 // log is for logging in this package.
 var dexlog = logf.Log.WithName("dex-resource")
 
+// webhookReader is used by the validating webhooks to look up related objects.
+// It bypasses the cache, which may be restricted to a set of namespaces.
+var webhookReader client.Reader
+
+const dexValidatePath = "/validate-dex-karavel-io-v1alpha1-dex"
+
 func (in *Dex) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	webhookReader = mgr.GetAPIReader()
+	// registered before the builder, which skips paths that are already handled
+	mgr.GetWebhookServer().Register(dexValidatePath, &webhook.Admission{
+		Handler: &dexValidator{Handler: admission.ValidatingWebhookFor(in).Handler},
+	})
 	return ctrl.NewWebhookManagedBy(mgr).
 		For(in).
 		Complete()
 }
 
+// dexValidator wraps the handler generated from webhook.Validator, which cannot
+// return admission warnings, and attaches the results of the soft checks to allowed requests
+type dexValidator struct {
+	admission.Handler
+	decoder *admission.Decoder
+}
+
+func (v *dexValidator) InjectDecoder(d *admission.Decoder) error {
+	v.decoder = d
+	_, err := admission.InjectDecoderInto(d, v.Handler)
+	return err
+}
+
+func (v *dexValidator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	res := v.Handler.Handle(ctx, req)
+	if !res.Allowed || req.Operation == admissionv1.Delete {
+		return res
+	}
+
+	var d Dex
+	if err := v.decoder.Decode(req, &d); err != nil {
+		return res
+	}
+	return res.WithWarnings(d.warnings()...)
+}
+
 // EDIT THIS FILE!  THIS IS SCAFFOLDING FOR YOU TO OWN!
 
 // +kubebuilder:webhook:path=/mutate-dex-karavel-io-v1alpha1-dex,mutating=true,failurePolicy=fail,sideEffects=None,groups=dex.karavel.io,resources=dexes,verbs=create;update,versions=v1alpha1,name=mdex.kb.io,admissionReviewVersions={v1,v1beta1}
@@ -66,8 +113,7 @@ func (in *Dex) Default() {
 	}
 }
 
-// Change verbs to "verbs=create;update;delete" if you want to enable deletion validation.
-// +kubebuilder:webhook:verbs=create;update,path=/validate-dex-karavel-io-v1alpha1-dex,mutating=false,failurePolicy=fail,sideEffects=None,groups=dex.karavel.io,resources=dexes,versions=v1alpha1,name=vdex.kb.io,admissionReviewVersions={v1,v1beta1}
+// +kubebuilder:webhook:verbs=create;update;delete,path=/validate-dex-karavel-io-v1alpha1-dex,mutating=false,failurePolicy=fail,sideEffects=None,groups=dex.karavel.io,resources=dexes,versions=v1alpha1,name=vdex.kb.io,admissionReviewVersions={v1,v1beta1}
 
 var _ webhook.Validator = &Dex{}
 
@@ -81,6 +127,24 @@ func (in *Dex) ValidateCreate() error {
 		errs = append(errs, err)
 	}
 
+	errs = append(errs, in.validateService()...)
+	errs = append(errs, in.validateIngress()...)
+	errs = append(errs, in.validateGateway()...)
+	errs = append(errs, in.validateProbes()...)
+	errs = append(errs, in.validatePodTemplate()...)
+
+	if err := in.validatePodDisruptionBudget(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := in.validateDefault(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := in.validateAutoscaling(); err != nil {
+		errs = append(errs, err)
+	}
+
 	if len(errs) == 0 {
 		return nil
 	}
@@ -90,7 +154,12 @@ func (in *Dex) ValidateCreate() error {
 
 // ValidateUpdate implements webhook.Validator so a webhook will be registered for the type
 func (in *Dex) ValidateUpdate(old runtime.Object) error {
-	dexlog.Info("validate create", "name", in.Name)
+	dexlog.Info("validate update", "name", in.Name)
+	// finalizers and metadata must always be updatable, or the operator could not release deleted instances
+	if in.specUnchanged(old) {
+		return nil
+	}
+
 	gk := in.GroupVersionKind().GroupKind()
 	errs := make([]*field.Error, 0)
 
@@ -98,6 +167,24 @@ func (in *Dex) ValidateUpdate(old runtime.Object) error {
 		errs = append(errs, err)
 	}
 
+	errs = append(errs, in.validateService()...)
+	errs = append(errs, in.validateIngress()...)
+	errs = append(errs, in.validateGateway()...)
+	errs = append(errs, in.validateProbes()...)
+	errs = append(errs, in.validatePodTemplate()...)
+
+	if err := in.validatePodDisruptionBudget(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := in.validateDefault(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := in.validateAutoscaling(); err != nil {
+		errs = append(errs, err)
+	}
+
 	if len(errs) == 0 {
 		return nil
 	}
@@ -105,10 +192,129 @@ func (in *Dex) ValidateUpdate(old runtime.Object) error {
 	return apierrors.NewInvalid(gk, in.Name, errs)
 }
 
+// specUnchanged reports whether the update leaves the spec and the default instance annotation as in old,
+// or the instance is being deleted
+func (in *Dex) specUnchanged(old runtime.Object) bool {
+	if !in.DeletionTimestamp.IsZero() {
+		return true
+	}
+	prev, ok := old.(*Dex)
+	return ok && in.DefaultScope() == prev.DefaultScope() && equality.Semantic.DeepEqual(in.Spec, prev.Spec)
+}
+
 // ValidateDelete implements webhook.Validator so a webhook will be registered for the type
 func (in *Dex) ValidateDelete() error {
 	dexlog.Info("validate delete", "name", in.Name)
-	return nil
+	if in.Spec.DeletionPolicy != DeletionPolicyBlock || webhookReader == nil {
+		return nil
+	}
+
+	var list DexClientList
+	if err := webhookReader.List(context.Background(), &list); err != nil {
+		return apierrors.NewInternalError(err)
+	}
+
+	names := make([]string, 0)
+	for i := range list.Items {
+		if dc := &list.Items[i]; dc.References(in) {
+			names = append(names, dc.NamespacedName().String())
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+
+	gr := schema.GroupResource{
+		Group:    in.GroupVersionKind().Group,
+		Resource: "dexes",
+	}
+	return apierrors.NewForbidden(gr, in.Name, fmt.Errorf("deletion policy is %s and the instance is referenced by DexClients %s", in.Spec.DeletionPolicy, strings.Join(names, ", ")))
+}
+
+// warnings reports valid configurations that are likely to be mistakes
+func (in *Dex) warnings() []string {
+	w := make([]string, 0)
+	if t := in.Spec.Service.Type; (t == v1.ServiceTypeLoadBalancer || t == v1.ServiceTypeNodePort) && !in.Spec.Service.SeparateWeb {
+		w = append(w, fmt.Sprintf("spec.service.type is %s, which also exposes the gRPC API outside of the cluster; set spec.service.separateWeb to expose only the web port", t))
+	}
+	return w
+}
+
+// validatePodTemplate checks that the pod customizations don't clash with the container,
+// volume and mount the operator adds for Dex itself
+func (in *Dex) validatePodTemplate() []*field.Error {
+	errs := make([]*field.Error, 0)
+	p := field.NewPath("spec")
+
+	for i, vol := range in.Spec.ExtraVolumes {
+		if vol.Name == ConfigVolumeName {
+			errs = append(errs, field.Invalid(p.Child("extraVolumes").Index(i).Child("name"), vol.Name, "is reserved for the Dex configuration"))
+		}
+	}
+
+	for i, m := range in.Spec.ExtraVolumeMounts {
+		mp := path.Clean(m.MountPath)
+		if mp == ConfigMountPath || strings.HasPrefix(mp, ConfigMountPath+"/") {
+			errs = append(errs, field.Invalid(p.Child("extraVolumeMounts").Index(i).Child("mountPath"), m.MountPath, fmt.Sprintf("overlaps the Dex configuration mounted at %s", ConfigMountPath)))
+		}
+	}
+
+	for i, c := range in.Spec.InitContainers {
+		if c.Name == ContainerName {
+			errs = append(errs, field.Invalid(p.Child("initContainers").Index(i).Child("name"), c.Name, "is reserved for the Dex container"))
+		}
+	}
+
+	for i, c := range in.Spec.Sidecars {
+		if c.Name == ContainerName {
+			errs = append(errs, field.Invalid(p.Child("sidecars").Index(i).Child("name"), c.Name, "is reserved for the Dex container"))
+		}
+	}
+
+	return errs
+}
+
+// validateDefault checks the scope of the default instance annotation, and that no other
+// instance is already the default for the same namespace or for the cluster
+func (in *Dex) validateDefault() *field.Error {
+	p := field.NewPath("metadata", "annotations").Key(DefaultInstanceAnnotation)
+	scope := in.DefaultScope()
+	switch scope {
+	case "":
+		return nil
+	case DefaultScopeNamespace, DefaultScopeCluster:
+	default:
+		return field.NotSupported(p, scope, []string{DefaultScopeNamespace, DefaultScopeCluster})
+	}
+	if webhookReader == nil {
+		return nil
+	}
+
+	var list DexList
+	if err := webhookReader.List(context.Background(), &list); err != nil {
+		return field.InternalError(p, err)
+	}
+
+	others := make([]string, 0)
+	for i := range list.Items {
+		d := &list.Items[i]
+		if d.NamespacedName() == in.NamespacedName() || d.DefaultScope() != scope {
+			continue
+		}
+		if scope == DefaultScopeNamespace && d.Namespace != in.Namespace {
+			continue
+		}
+		others = append(others, d.NamespacedName().String())
+	}
+	if len(others) == 0 {
+		return nil
+	}
+
+	target := "the cluster"
+	if scope == DefaultScopeNamespace {
+		target = "namespace " + in.Namespace
+	}
+	return field.Forbidden(p, fmt.Sprintf("%s is already the default Dex instance for %s", strings.Join(others, ", "), target))
 }
 
 func (in *Dex) validatePublicURL() *field.Error {
@@ -133,3 +339,136 @@ func (in *Dex) validatePublicURL() *field.Error {
 
 	return nil
 }
+
+func (in *Dex) validateService() []*field.Error {
+	svc := in.Spec.Service
+	errs := make([]*field.Error, 0)
+	p := field.NewPath("spec", "service")
+
+	if svc.ExternalTrafficPolicy != "" && svc.Type != v1.ServiceTypeNodePort && svc.Type != v1.ServiceTypeLoadBalancer {
+		errs = append(errs, field.Invalid(p.Child("externalTrafficPolicy"), svc.ExternalTrafficPolicy, "may only be set for NodePort and LoadBalancer services"))
+	}
+
+	if len(svc.LoadBalancerSourceRanges) > 0 && svc.Type != v1.ServiceTypeLoadBalancer {
+		errs = append(errs, field.Invalid(p.Child("loadBalancerSourceRanges"), svc.LoadBalancerSourceRanges, "may only be set for LoadBalancer services"))
+	}
+
+	for i, r := range svc.LoadBalancerSourceRanges {
+		if _, _, err := net.ParseCIDR(strings.TrimSpace(r)); err != nil {
+			errs = append(errs, field.Invalid(p.Child("loadBalancerSourceRanges").Index(i), r, "must be a valid CIDR, e.g. 10.0.0.0/8"))
+		}
+	}
+
+	return errs
+}
+
+func (in *Dex) validateIngress() []*field.Error {
+	ing := in.Spec.Ingress
+	if ing.Enabled != nil && !*ing.Enabled {
+		return nil
+	}
+
+	u, err := url.Parse(in.Spec.PublicURL)
+	if err != nil {
+		// already reported by validatePublicURL
+		return nil
+	}
+
+	errs := make([]*field.Error, 0)
+	p := field.NewPath("spec", "ingress")
+	if len(ing.Hosts) > 0 && !contains(ing.Hosts, u.Hostname()) {
+		errs = append(errs, field.Invalid(p.Child("hosts"), ing.Hosts, fmt.Sprintf("must include the publicURL host %s", u.Hostname())))
+	}
+
+	if ing.TLSEnabled && len(ing.TLSHosts) > 0 && !contains(ing.TLSHosts, u.Hostname()) {
+		errs = append(errs, field.Invalid(p.Child("tlsHosts"), ing.TLSHosts, fmt.Sprintf("must include the publicURL host %s", u.Hostname())))
+	}
+
+	// dedicated Ingress objects are named after their path, so paths must be unique
+	base := "/" + strings.Trim(u.Path, "/")
+	seen := make(map[string]bool, len(ing.Paths))
+	for i, ip := range ing.Paths {
+		if ip.Path != base && !strings.HasPrefix(ip.Path, strings.TrimSuffix(base, "/")+"/") {
+			errs = append(errs, field.Invalid(p.Child("paths").Index(i).Child("path"), ip.Path, fmt.Sprintf("must be within the publicURL path %s", base)))
+		}
+		if seen[ip.Path] {
+			errs = append(errs, field.Duplicate(p.Child("paths").Index(i).Child("path"), ip.Path))
+		}
+		seen[ip.Path] = true
+	}
+
+	return errs
+}
+
+func (in *Dex) validateGateway() []*field.Error {
+	gw := in.Spec.Gateway
+	if !gw.Enabled {
+		return nil
+	}
+
+	errs := make([]*field.Error, 0)
+	p := field.NewPath("spec", "gateway")
+	if len(gw.ParentRefs) == 0 {
+		errs = append(errs, field.Required(p.Child("parentRefs"), "at least one parent Gateway is required"))
+	}
+
+	u, err := url.Parse(in.Spec.PublicURL)
+	if err == nil && len(gw.Hostnames) > 0 && !contains(gw.Hostnames, u.Hostname()) {
+		errs = append(errs, field.Invalid(p.Child("hostnames"), gw.Hostnames, fmt.Sprintf("must include the publicURL host %s", u.Hostname())))
+	}
+
+	return errs
+}
+
+func (in *Dex) validatePodDisruptionBudget() *field.Error {
+	pdb := in.Spec.PodDisruptionBudget
+	if pdb.MinAvailable != nil && pdb.MaxUnavailable != nil {
+		return field.Invalid(
+			field.NewPath("spec", "podDisruptionBudget"),
+			pdb,
+			"minAvailable and maxUnavailable cannot be both set",
+		)
+	}
+
+	return nil
+}
+
+func (in *Dex) validateAutoscaling() *field.Error {
+	as := in.Spec.Autoscaling
+	if !as.Enabled {
+		return nil
+	}
+
+	p := field.NewPath("spec", "autoscaling", "maxReplicas")
+	if as.MaxReplicas < 1 {
+		return field.Required(p, "must be set when autoscaling is enabled")
+	}
+
+	if as.MinReplicas != nil && as.MaxReplicas < *as.MinReplicas {
+		return field.Invalid(p, as.MaxReplicas, "must be greater than or equal to minReplicas")
+	}
+
+	return nil
+}
+
+func (in *Dex) validateProbes() []*field.Error {
+	errs := make([]*field.Error, 0)
+	p := field.NewPath("spec", "probes")
+	check := func(name string, t *ProbeTimings) {
+		if t != nil && t.SuccessThreshold != nil && *t.SuccessThreshold != 1 {
+			errs = append(errs, field.Invalid(p.Child(name, "successThreshold"), *t.SuccessThreshold, "must be 1"))
+		}
+	}
+	check("liveness", in.Spec.Probes.Liveness)
+	check("startup", in.Spec.Probes.Startup)
+	return errs
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
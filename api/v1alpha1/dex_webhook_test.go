@@ -0,0 +1,395 @@
+/*
+Copyright 2021 © MIKAMAI s.r.l
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// defaultDex is a Dex instance marked as the default for scope
+func defaultDex(name, namespace, scope string) *Dex {
+	return &Dex{ObjectMeta: metav1.ObjectMeta{
+		Name:        name,
+		Namespace:   namespace,
+		Annotations: map[string]string{DefaultInstanceAnnotation: scope},
+	}}
+}
+
+func TestDexValidatePodTemplate(t *testing.T) {
+	tests := []struct {
+		name   string
+		update func(d *Dex)
+		want   int
+	}{
+		{name: "no customizations", update: func(d *Dex) {}},
+		{
+			name: "extra volume and mount",
+			update: func(d *Dex) {
+				d.Spec.ExtraVolumes = []v1.Volume{{Name: "theme"}}
+				d.Spec.ExtraVolumeMounts = []v1.VolumeMount{{Name: "theme", MountPath: "/srv/dex/web/themes/custom"}}
+			},
+		},
+		{
+			name: "mount next to the configuration",
+			update: func(d *Dex) {
+				d.Spec.ExtraVolumeMounts = []v1.VolumeMount{{Name: "extra", MountPath: ConfigMountPath + "-extra"}}
+			},
+		},
+		{
+			name: "configuration volume name",
+			update: func(d *Dex) {
+				d.Spec.ExtraVolumes = []v1.Volume{{Name: ConfigVolumeName}}
+			},
+			want: 1,
+		},
+		{
+			name: "mount on the configuration",
+			update: func(d *Dex) {
+				d.Spec.ExtraVolumeMounts = []v1.VolumeMount{{Name: "extra", MountPath: ConfigMountPath + "/"}}
+			},
+			want: 1,
+		},
+		{
+			name: "mount within the configuration",
+			update: func(d *Dex) {
+				d.Spec.ExtraVolumeMounts = []v1.VolumeMount{{Name: "extra", MountPath: ConfigMountPath + "/extra"}}
+			},
+			want: 1,
+		},
+		{
+			name: "Dex container name",
+			update: func(d *Dex) {
+				d.Spec.InitContainers = []v1.Container{{Name: ContainerName}}
+				d.Spec.Sidecars = []v1.Container{{Name: "proxy"}, {Name: ContainerName}}
+			},
+			want: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := testDex()
+			tt.update(d)
+			if errs := d.validatePodTemplate(); len(errs) != tt.want {
+				t.Errorf("validatePodTemplate() = %v, want %d errors", errs, tt.want)
+			}
+		})
+	}
+}
+
+func TestDexServiceExposure(t *testing.T) {
+	tests := []struct {
+		name     string
+		service  Service
+		errs     int
+		warnings int
+	}{
+		{name: "default"},
+		{name: "cluster IP", service: Service{Type: v1.ServiceTypeClusterIP}},
+		{name: "load balancer", service: Service{Type: v1.ServiceTypeLoadBalancer}, warnings: 1},
+		{name: "node port", service: Service{Type: v1.ServiceTypeNodePort}, warnings: 1},
+		{name: "load balancer with a separate web Service", service: Service{Type: v1.ServiceTypeLoadBalancer, SeparateWeb: true}},
+		{
+			name:    "load balancer source ranges",
+			service: Service{Type: v1.ServiceTypeLoadBalancer, SeparateWeb: true, LoadBalancerSourceRanges: []string{"10.0.0.0/8", " 192.168.0.0/16"}},
+		},
+		{
+			name:    "invalid source range",
+			service: Service{Type: v1.ServiceTypeLoadBalancer, SeparateWeb: true, LoadBalancerSourceRanges: []string{"10.0.0.0"}},
+			errs:    1,
+		},
+		{
+			name:    "source ranges without a load balancer",
+			service: Service{Type: v1.ServiceTypeNodePort, SeparateWeb: true, LoadBalancerSourceRanges: []string{"10.0.0.0/8"}},
+			errs:    1,
+		},
+		{
+			name:    "external traffic policy on a cluster IP",
+			service: Service{ExternalTrafficPolicy: v1.ServiceExternalTrafficPolicyTypeLocal},
+			errs:    1,
+		},
+		{
+			name:    "external traffic policy on a node port",
+			service: Service{Type: v1.ServiceTypeNodePort, SeparateWeb: true, ExternalTrafficPolicy: v1.ServiceExternalTrafficPolicyTypeLocal},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := testDex()
+			d.Spec.Service = tt.service
+			if errs := d.validateService(); len(errs) != tt.errs {
+				t.Errorf("validateService() = %v, want %d errors", errs, tt.errs)
+			}
+			if w := d.warnings(); len(w) != tt.warnings {
+				t.Errorf("warnings() = %v, want %d warnings", w, tt.warnings)
+			}
+		})
+	}
+}
+
+func TestDexValidateDefault(t *testing.T) {
+	tests := []struct {
+		name    string
+		scope   string
+		objs    []client.Object
+		wantErr bool
+	}{
+		{name: "not a default", objs: []client.Object{defaultDex("other", "dex", DefaultScopeNamespace)}},
+		{name: "unknown scope", scope: "global", wantErr: true},
+		{name: "first namespace default", scope: DefaultScopeNamespace},
+		{name: "already the default", scope: DefaultScopeNamespace, objs: []client.Object{defaultDex("dex", "dex", DefaultScopeNamespace)}},
+		{
+			name:  "namespace default elsewhere",
+			scope: DefaultScopeNamespace,
+			objs:  []client.Object{defaultDex("dex", "other", DefaultScopeNamespace)},
+		},
+		{
+			name:  "cluster default in the namespace",
+			scope: DefaultScopeNamespace,
+			objs:  []client.Object{defaultDex("other", "dex", DefaultScopeCluster)},
+		},
+		{
+			name:    "second namespace default",
+			scope:   DefaultScopeNamespace,
+			objs:    []client.Object{defaultDex("other", "dex", DefaultScopeNamespace)},
+			wantErr: true,
+		},
+		{
+			name:    "second cluster default",
+			scope:   DefaultScopeCluster,
+			objs:    []client.Object{defaultDex("dex", "other", DefaultScopeCluster)},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useReader(t, tt.objs...)
+			d := testDex()
+			if tt.scope != "" {
+				d.Annotations = map[string]string{DefaultInstanceAnnotation: tt.scope}
+			}
+			if err := d.validateDefault(); (err != nil) != tt.wantErr {
+				t.Errorf("validateDefault() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDexClientDefault(t *testing.T) {
+	ref := func(name, namespace string) InstanceRef {
+		return InstanceRef{Name: name, Namespace: namespace}
+	}
+
+	tests := []struct {
+		name string
+		ref  InstanceRef
+		objs []client.Object
+		want InstanceRef
+	}{
+		{name: "no default"},
+		{
+			name: "explicit target",
+			ref:  ref("dex", "dex"),
+			objs: []client.Object{defaultDex("other", "apps", DefaultScopeNamespace)},
+			want: ref("dex", "dex"),
+		},
+		{
+			name: "cluster default",
+			objs: []client.Object{defaultDex("dex", "dex", DefaultScopeCluster)},
+			want: ref("dex", "dex"),
+		},
+		{
+			name: "namespace default over the cluster one",
+			objs: []client.Object{defaultDex("dex", "dex", DefaultScopeCluster), defaultDex("local", "apps", DefaultScopeNamespace)},
+			want: ref("local", "apps"),
+		},
+		{
+			name: "namespace default of another namespace",
+			objs: []client.Object{defaultDex("local", "other", DefaultScopeNamespace)},
+		},
+		{
+			name: "ambiguous defaults",
+			objs: []client.Object{defaultDex("dex", "dex", DefaultScopeCluster), defaultDex("other", "dex", DefaultScopeCluster)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useReader(t, tt.objs...)
+			dc := testClient()
+			dc.Spec.InstanceRef = tt.ref
+			dc.Default()
+			if dc.Spec.InstanceRef != tt.want {
+				t.Errorf("Default() instanceRef = %v, want %v", dc.Spec.InstanceRef, tt.want)
+			}
+		})
+	}
+}
+
+func TestDexValidateUpdate(t *testing.T) {
+	now := metav1.Now()
+	tests := []struct {
+		name    string
+		update  func(d *Dex)
+		wantErr bool
+	}{
+		{
+			name:   "finalizer added to an instance failing the checks",
+			update: func(d *Dex) { d.Finalizers = []string{"dex.karavel.io/finalizer"} },
+		},
+		{
+			name: "finalizer removed while terminating",
+			update: func(d *Dex) {
+				d.DeletionTimestamp = &now
+				d.Spec.PublicURL = "ftp://dex.example.com"
+			},
+		},
+		{
+			name:    "spec changed",
+			update:  func(d *Dex) { d.Spec.Replicas = 2 },
+			wantErr: true,
+		},
+		{
+			name:    "default annotation changed",
+			update:  func(d *Dex) { d.Annotations = map[string]string{DefaultInstanceAnnotation: DefaultScopeCluster} },
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// a second cluster default and an unsupported scheme make any validation fail
+			useReader(t, defaultDex("other", "dex", DefaultScopeCluster))
+			old := testDex()
+			old.Spec.PublicURL = "ftp://dex.example.com"
+			d := old.DeepCopy()
+			tt.update(d)
+			if err := d.ValidateUpdate(old); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateUpdate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDexValidateIngress(t *testing.T) {
+	disabled := false
+	tests := []struct {
+		name    string
+		ingress Ingress
+		want    int
+	}{
+		{name: "defaults"},
+		{name: "hosts including the publicURL host", ingress: Ingress{Hosts: []string{"dex.example.com", "login.example.com"}}},
+		{name: "hosts missing the publicURL host", ingress: Ingress{Hosts: []string{"login.example.com"}}, want: 1},
+		{name: "TLS hosts missing the publicURL host", ingress: Ingress{TLSEnabled: true, TLSHosts: []string{"login.example.com"}}, want: 1},
+		{
+			name:    "additional paths",
+			ingress: Ingress{Paths: []IngressPath{{Path: "/dex/token", Annotations: map[string]string{"limit": "5"}}, {Path: "/dex/keys"}}},
+		},
+		{name: "path outside of the publicURL path", ingress: Ingress{Paths: []IngressPath{{Path: "/dexter"}}}, want: 1},
+		{
+			name:    "duplicate paths",
+			ingress: Ingress{Paths: []IngressPath{{Path: "/dex/token", Annotations: map[string]string{"limit": "5"}}, {Path: "/dex/keys"}, {Path: "/dex/token"}}},
+			want:    1,
+		},
+		{name: "disabled", ingress: Ingress{Enabled: &disabled, Hosts: []string{"login.example.com"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := testDex()
+			d.Spec.PublicURL = "https://dex.example.com/dex"
+			d.Spec.Ingress = tt.ingress
+			if errs := d.validateIngress(); len(errs) != tt.want {
+				t.Errorf("validateIngress() = %v, want %d errors", errs, tt.want)
+			}
+		})
+	}
+}
+
+func TestDexValidateProbes(t *testing.T) {
+	one, two := int32(1), int32(2)
+	tests := []struct {
+		name   string
+		probes Probes
+		want   int
+	}{
+		{name: "defaults"},
+		{name: "readiness success threshold", probes: Probes{Readiness: &ProbeTimings{SuccessThreshold: &two}}},
+		{name: "liveness success threshold of one", probes: Probes{Liveness: &ProbeTimings{SuccessThreshold: &one}}},
+		{name: "liveness success threshold", probes: Probes{Liveness: &ProbeTimings{SuccessThreshold: &two}}, want: 1},
+		{
+			name:   "startup and liveness success thresholds",
+			probes: Probes{Liveness: &ProbeTimings{SuccessThreshold: &two}, Startup: &ProbeTimings{SuccessThreshold: &two}},
+			want:   2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := testDex()
+			d.Spec.Probes = tt.probes
+			if errs := d.validateProbes(); len(errs) != tt.want {
+				t.Errorf("validateProbes() = %v, want %d errors", errs, tt.want)
+			}
+		})
+	}
+}
+
+func TestDexValidateDelete(t *testing.T) {
+	referencing := func(name string) *DexClient {
+		dc := &DexClient{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "app"}}
+		dc.Spec.InstanceRef = InstanceRef{Name: "dex", Namespace: "dex"}
+		return dc
+	}
+	other := &DexClient{ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "app"}}
+	other.Spec.InstanceRef = InstanceRef{Name: "other", Namespace: "dex"}
+
+	tests := []struct {
+		name    string
+		policy  DeletionPolicy
+		objs    []client.Object
+		wantErr bool
+	}{
+		{name: "block without clients", policy: DeletionPolicyBlock, objs: []client.Object{other}},
+		{name: "block with referencing clients", policy: DeletionPolicyBlock, objs: []client.Object{referencing("app"), other}, wantErr: true},
+		{name: "orphan with referencing clients", policy: DeletionPolicyOrphan, objs: []client.Object{referencing("app")}},
+		{name: "cascade with referencing clients", policy: DeletionPolicyCascade, objs: []client.Object{referencing("app")}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useReader(t, tt.objs...)
+			d := &Dex{ObjectMeta: metav1.ObjectMeta{Name: "dex", Namespace: "dex"}}
+			d.Spec.DeletionPolicy = tt.policy
+			err := d.ValidateDelete()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ValidateDelete() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !apierrors.IsForbidden(err) {
+				t.Errorf("ValidateDelete() error = %v, want Forbidden", err)
+			}
+		})
+	}
+}
@@ -17,9 +17,14 @@ limitations under the License.
 package v1alpha1
 
 import (
+	"context"
 	"fmt"
+	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sort"
 )
 
 // EDIT THIS FILE!  THIS IS SCAFFOLDING FOR YOU TO OWN!
@@ -30,7 +35,8 @@ type DexClientSpec struct {
 	// Name is the Dex client name
 	Name string `json:"name"`
 
-	// RedirectUris is the list of callback URIs for the client
+	// RedirectUris is the list of callback URIs for the client.
+	// Loopback hosts and custom schemes are only allowed for public clients
 	// +kubebuilder:validation:MinItems=1
 	// +kubebuilder:validation:Format=uri
 	RedirectUris []string `json:"redirectUris"`
@@ -39,9 +45,20 @@ type DexClientSpec struct {
 	// +kubebuilder:default:=false
 	Public bool `json:"public,omitempty"`
 
-	// InstanceRef is used to select the target Dex instance
-	// Cannot be updated
-	InstanceRef InstanceRef `json:"instanceRef"`
+	// InstanceRef is used to select the target Dex instance.
+	// Exactly one of instanceRef, instanceRefs and instanceSelector must be set.
+	// Changing the targets, or the public flag, migrates the client preserving its credentials
+	// +optional
+	InstanceRef InstanceRef `json:"instanceRef,omitempty"`
+
+	// InstanceRefs registers the client on several Dex instances with the same credentials
+	// +optional
+	InstanceRefs []InstanceRef `json:"instanceRefs,omitempty"`
+
+	// InstanceSelector registers the client with the same credentials on all the Dex instances
+	// matching the selector, in any namespace watched by the operator. ExternalDex objects are not selected
+	// +optional
+	InstanceSelector *metav1.LabelSelector `json:"instanceSelector,omitempty"`
 
 	// ClientIDKey allows to override the key used in the generated Secret for the clientID
 	// +kubebuilder:default:=clientID
@@ -58,16 +75,86 @@ type DexClientSpec struct {
 	// +optional
 	IssuerURLKey string `json:"issuerURLKey"`
 
-	// Template will be merged with the generated Secret object
+	// Template will be merged with the generated Secret object. Public clients get no Secret
 	Template SecretTemplate `json:"template,omitempty"`
+
+	// ConfigMap writes the client metadata that is not secret to a ConfigMap in the same namespace
+	// +optional
+	ConfigMap *ConfigMapOutput `json:"configMap,omitempty"`
+
+	// SecretTargets copies the Secret holding the client credentials to other namespaces.
+	// Namespaces not allowed by the client policy of the Dex instances are skipped
+	// +optional
+	SecretTargets *SecretTargets `json:"secretTargets,omitempty"`
+}
+
+// SecretTargets matches the namespaces receiving a copy of the credentials Secret either by name or by labels.
+// A namespace receives a copy if it matches any of the two
+type SecretTargets struct {
+	// Names is a list of namespace names
+	// +optional
+	Names []string `json:"names,omitempty"`
+	// Selector matches the labels of namespaces
+	// +optional
+	Selector *metav1.LabelSelector `json:"selector,omitempty"`
+}
+
+// ConfigMapOutput configures the ConfigMap holding the client metadata
+type ConfigMapOutput struct {
+	// Name of the ConfigMap, defaults to dex-<name>-client
+	// +optional
+	Name string `json:"name,omitempty"`
+
+	// ClientIDKey is the key used for the client ID
+	// +kubebuilder:default:=clientID
+	// +optional
+	ClientIDKey string `json:"clientIDKey,omitempty"`
+
+	// IssuerURLKey is the key used for the issuer URL
+	// +kubebuilder:default:=issuerURL
+	// +optional
+	IssuerURLKey string `json:"issuerURLKey,omitempty"`
+
+	// DiscoveryURLKey is the key used for the URL of the OpenID Connect discovery document
+	// +kubebuilder:default:=discoveryURL
+	// +optional
+	DiscoveryURLKey string `json:"discoveryURLKey,omitempty"`
+
+	// RedirectURIsKey is the key used for the redirect URIs, one per line
+	// +kubebuilder:default:=redirectURIs
+	// +optional
+	RedirectURIsKey string `json:"redirectURIsKey,omitempty"`
+
+	// Labels to be added to the ConfigMap
+	// +optional
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Annotations to be added to the ConfigMap
+	// +optional
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// Kinds of the instances DexClients can be registered on
+const (
+	KindDex         = "Dex"
+	KindExternalDex = "ExternalDex"
+)
+
+// InstanceKey identifies a Dex instance or an external Dex server, which may share the same name and namespace
+type InstanceKey struct {
+	Kind string
+	types.NamespacedName
 }
 
 type InstanceRef struct {
+	// Kind is the kind of the instance, either Dex for instances managed by the operator or
+	// ExternalDex for servers running elsewhere. Defaults to Dex
+	// +kubebuilder:validation:Enum=Dex;ExternalDex
+	// +optional
+	Kind string `json:"kind,omitempty"`
 	// Name is the object name for the Dex instance
-	// Cannot be updated
 	Name string `json:"name"`
 	// Namespace is the object name for the Dex instance
-	// Cannot be updated
 	// If empty will default to the same namespace as the DexClient
 	// +optional
 	Namespace string `json:"namespace,omitempty"`
@@ -76,6 +163,91 @@ type InstanceRef struct {
 // SecretTemplate is used to customize parts of the generated secret
 type SecretTemplate struct {
 	ObjectMeta SecretMeta `json:"metadata,omitempty"`
+
+	// Preset adds the entries expected by a common application to the Secret
+	// +kubebuilder:validation:Enum=oauth2-proxy;grafana;argocd;spring-boot
+	// +optional
+	Preset SecretPreset `json:"preset,omitempty"`
+
+	// Data holds additional entries of the Secret as Go templates, rendered with the fields
+	// ClientID, ClientSecret, IssuerURL, DiscoveryURL, RedirectURIs and Name, and the Sprig functions.
+	// Entries override the ones of the preset with the same key
+	// +optional
+	Data map[string]string `json:"data,omitempty"`
+
+	// Type of the Secret, defaults to Opaque
+	// +optional
+	Type v1.SecretType `json:"type,omitempty"`
+
+	// Immutable marks the Secret as immutable, in which case it is replaced instead of updated
+	// +optional
+	Immutable *bool `json:"immutable,omitempty"`
+}
+
+// SecretPreset is a set of Secret entries expected by a common application
+type SecretPreset string
+
+const (
+	// SecretPresetOAuth2Proxy provides the environment variables of oauth2-proxy
+	SecretPresetOAuth2Proxy SecretPreset = "oauth2-proxy"
+	// SecretPresetGrafana provides the environment variables of the Grafana auth.generic_oauth section
+	SecretPresetGrafana SecretPreset = "grafana"
+	// SecretPresetArgoCD provides the oidc.config entry of Argo CD
+	SecretPresetArgoCD SecretPreset = "argocd"
+	// SecretPresetSpringBoot provides an application.properties file configuring Spring Security
+	SecretPresetSpringBoot SecretPreset = "spring-boot"
+)
+
+// secretPresets holds the templates of the Secret entries added by each preset, rendered like the template data
+var secretPresets = map[SecretPreset]map[string]string{
+	SecretPresetOAuth2Proxy: {
+		"OAUTH2_PROXY_PROVIDER":              "oidc",
+		"OAUTH2_PROXY_PROVIDER_DISPLAY_NAME": "{{ .Name }}",
+		"OAUTH2_PROXY_CLIENT_ID":             "{{ .ClientID }}",
+		"OAUTH2_PROXY_CLIENT_SECRET":         "{{ .ClientSecret }}",
+		"OAUTH2_PROXY_OIDC_ISSUER_URL":       "{{ .IssuerURL }}",
+		"OAUTH2_PROXY_REDIRECT_URL":          `{{ first .RedirectURIs | default "" }}`,
+	},
+	SecretPresetGrafana: {
+		"GF_AUTH_GENERIC_OAUTH_ENABLED":       "true",
+		"GF_AUTH_GENERIC_OAUTH_NAME":          "{{ .Name }}",
+		"GF_AUTH_GENERIC_OAUTH_CLIENT_ID":     "{{ .ClientID }}",
+		"GF_AUTH_GENERIC_OAUTH_CLIENT_SECRET": "{{ .ClientSecret }}",
+		"GF_AUTH_GENERIC_OAUTH_SCOPES":        "openid profile email groups",
+		"GF_AUTH_GENERIC_OAUTH_AUTH_URL":      `{{ trimSuffix "/" .IssuerURL }}/auth`,
+		"GF_AUTH_GENERIC_OAUTH_TOKEN_URL":     `{{ trimSuffix "/" .IssuerURL }}/token`,
+		"GF_AUTH_GENERIC_OAUTH_API_URL":       `{{ trimSuffix "/" .IssuerURL }}/userinfo`,
+	},
+	SecretPresetArgoCD: {
+		"oidc.config": `name: {{ .Name | quote }}
+issuer: {{ .IssuerURL | quote }}
+clientID: {{ .ClientID | quote }}
+clientSecret: {{ .ClientSecret | quote }}
+requestedScopes:
+  - openid
+  - profile
+  - email
+  - groups
+`,
+	},
+	SecretPresetSpringBoot: {
+		"application.properties": `spring.security.oauth2.client.registration.dex.client-id={{ .ClientID }}
+spring.security.oauth2.client.registration.dex.client-secret={{ .ClientSecret }}
+spring.security.oauth2.client.registration.dex.client-name={{ .Name }}
+spring.security.oauth2.client.registration.dex.scope=openid,profile,email
+spring.security.oauth2.client.registration.dex.redirect-uri={{ first .RedirectURIs | default "" }}
+spring.security.oauth2.client.provider.dex.issuer-uri={{ .IssuerURL }}
+`,
+	},
+}
+
+// Entries returns the templates of the Secret entries added by the preset
+func (p SecretPreset) Entries() map[string]string {
+	res := make(map[string]string, len(secretPresets[p]))
+	for k, v := range secretPresets[p] {
+		res[k] = v
+	}
+	return res
 }
 
 type SecretMeta struct {
@@ -112,8 +284,89 @@ type DexClientStatus struct {
 	Ready bool `json:"ready"`
 	// ClientID is the generated OAuth client_id for this client
 	ClientID string `json:"clientID,omitempty"`
+	// SecretName is the name of the Secret holding the client credentials. Public clients have none
+	// +optional
+	SecretName string `json:"secretName,omitempty"`
+	// ConfigMapName is the name of the ConfigMap holding the client metadata, if enabled
+	// +optional
+	ConfigMapName string `json:"configMapName,omitempty"`
+	// SecretCopies lists the namespaces holding a copy of the Secret
+	// +optional
+	SecretCopies []string `json:"secretCopies,omitempty"`
+	// Reason is the class of the last reconciliation failure, if any.
+	// +optional
+	Reason StatusReason `json:"reason,omitempty"`
+	// ObservedGeneration is the most recent generation observed by the operator.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// Instances reports the registration of the client on each Dex instance, including the ones
+	// it is still registered on after they stopped being targeted
+	// +listType=map
+	// +listMapKey=kind
+	// +listMapKey=namespace
+	// +listMapKey=name
+	// +optional
+	Instances []InstanceStatus `json:"instances,omitempty"`
+	// Conditions represent the latest available observations of the client state
+	// +listType=map
+	// +listMapKey=type
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// InstanceStatus reports the registration of a client on a Dex instance
+type InstanceStatus struct {
+	// Name is the object name of the Dex instance
+	Name string `json:"name"`
+	// Namespace is the namespace of the Dex instance
+	Namespace string `json:"namespace"`
+	// Kind is the kind of the instance, either Dex or ExternalDex
+	// +kubebuilder:validation:Enum=Dex;ExternalDex
+	// +kubebuilder:default:=Dex
+	Kind string `json:"kind"`
+	// Registered will be true if the client has been registered on the instance
+	Registered bool `json:"registered"`
+	// Public reports whether the client is registered as a public client
+	// +optional
+	Public bool `json:"public,omitempty"`
+	// Ready will be true if the client is registered on the instance as described by its spec
+	Ready bool `json:"ready"`
+	// Reason is the class of the last failure on the instance, if any.
+	// +optional
+	Reason StatusReason `json:"reason,omitempty"`
+	// Message is a human-readable message about the registration on the instance
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+func (in *InstanceStatus) NamespacedName() types.NamespacedName {
+	return types.NamespacedName{
+		Name:      in.Name,
+		Namespace: in.Namespace,
+	}
+}
+
+// Key returns the key of the instance, defaulting the kind to Dex for statuses written before it was recorded
+func (in *InstanceStatus) Key() InstanceKey {
+	return InstanceKey{
+		Kind:           kindOrDefault(in.Kind),
+		NamespacedName: in.NamespacedName(),
+	}
 }
 
+type DexClientConditionType string
+
+var (
+	// DexClientConditionNotAllowed reports that the client is rejected by the client policy of its Dex instance
+	DexClientConditionNotAllowed DexClientConditionType = "NotAllowed"
+	// DexClientConditionMigrating reports that the client is leaving instances it does not target anymore
+	// or changing its public flag
+	DexClientConditionMigrating DexClientConditionType = "Migrating"
+	// DexClientConditionPolicyViolation reports that the client violates DexClientPolicies created or changed after it was
+	// registered. DexClientPolicies only reject new clients and spec changes, so existing registrations are kept
+	DexClientConditionPolicyViolation DexClientConditionType = "PolicyViolation"
+)
+
 // +kubebuilder:object:root=true
 // +kubebuilder:resource:path=dexclients
 // +kubebuilder:subresource:status
@@ -121,6 +374,7 @@ type DexClientStatus struct {
 // +kubebuilder:printcolumn:name="Public",type=boolean,JSONPath=`.spec.public`
 // +kubebuilder:printcolumn:name="Ready",type=boolean,JSONPath=`.status.ready`
 // +kubebuilder:printcolumn:name="Message",type=string,JSONPath=`.status.message`
+// +kubebuilder:printcolumn:name="Reason",type=string,JSONPath=`.status.reason`,priority=1
 // +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 
 // DexClient is the Schema for the dexclients API
@@ -136,6 +390,40 @@ func (in *DexClient) ClientID() string {
 	return fmt.Sprintf("%s-%s", in.Namespace, in.Name)
 }
 
+// SecretName returns the name of the generated Secret, defaulting to dex-<name>-credentials
+func (in *DexClient) SecretName() string {
+	if n := in.Spec.Template.ObjectMeta.Name; n != "" {
+		return n
+	}
+	return fmt.Sprintf("dex-%s-credentials", in.Name)
+}
+
+// Labels set on the copies of the credentials Secret, identifying the DexClient managing them
+const (
+	ClientNameLabel      = "dex.karavel.io/client-name"
+	ClientNamespaceLabel = "dex.karavel.io/client-namespace"
+)
+
+// CopyLabels returns the labels identifying the copies of the credentials Secret managed by the client
+func (in *DexClient) CopyLabels() map[string]string {
+	return map[string]string{
+		ClientNameLabel:      in.Name,
+		ClientNamespaceLabel: in.Namespace,
+	}
+}
+
+// ConfigMapName returns the name of the ConfigMap holding the client metadata, defaulting to dex-<name>-client.
+// It is empty if the ConfigMap is not enabled
+func (in *DexClient) ConfigMapName() string {
+	if in.Spec.ConfigMap == nil {
+		return ""
+	}
+	if n := in.Spec.ConfigMap.Name; n != "" {
+		return n
+	}
+	return fmt.Sprintf("dex-%s-client", in.Name)
+}
+
 // +kubebuilder:object:root=true
 
 // DexClientList contains a list of DexClient
@@ -152,6 +440,136 @@ func (in *DexClient) NamespacedName() types.NamespacedName {
 	}
 }
 
+// InstanceNamespacedName returns the key of the Dex instance referenced by instanceRef,
+// defaulting the namespace to the one of the DexClient
+func (in *DexClient) InstanceNamespacedName() types.NamespacedName {
+	return in.instanceKey(in.Spec.InstanceRef)
+}
+
+// InstanceRefs returns the keys of the Dex instances referenced by instanceRef and instanceRefs
+func (in *DexClient) InstanceRefs() []types.NamespacedName {
+	res := make([]types.NamespacedName, 0, len(in.Spec.InstanceRefs)+1)
+	if in.Spec.InstanceRef.Name != "" {
+		res = append(res, in.InstanceNamespacedName())
+	}
+	for _, ref := range in.Spec.InstanceRefs {
+		res = append(res, in.instanceKey(ref))
+	}
+	return res
+}
+
+func (in *DexClient) instanceKey(ref InstanceRef) types.NamespacedName {
+	k := types.NamespacedName{
+		Name:      ref.Name,
+		Namespace: ref.Namespace,
+	}
+	if k.Namespace == "" {
+		k.Namespace = in.Namespace
+	}
+	return k
+}
+
+// InstanceKind returns the kind the instance k is referenced as. Instances matched by the selector are Dex instances
+func (in *DexClient) InstanceKind(k types.NamespacedName) string {
+	refs := append([]InstanceRef{in.Spec.InstanceRef}, in.Spec.InstanceRefs...)
+	for _, ref := range refs {
+		if ref.Name != "" && in.instanceKey(ref) == k {
+			return kindOrDefault(ref.Kind)
+		}
+	}
+	return KindDex
+}
+
+// TargetKey returns the key of the targeted instance k, with the kind it is referenced as
+func (in *DexClient) TargetKey(k types.NamespacedName) InstanceKey {
+	return InstanceKey{
+		Kind:           in.InstanceKind(k),
+		NamespacedName: k,
+	}
+}
+
+func kindOrDefault(kind string) string {
+	if kind == "" {
+		return KindDex
+	}
+	return kind
+}
+
+// References reports whether the DexClient targets the given Dex instance
+func (in *DexClient) References(dex *Dex) bool {
+	for _, k := range in.InstanceRefs() {
+		if k == dex.NamespacedName() && in.InstanceKind(k) == KindDex {
+			return true
+		}
+	}
+	if in.Spec.InstanceSelector == nil {
+		return false
+	}
+	sel, err := metav1.LabelSelectorAsSelector(in.Spec.InstanceSelector)
+	return err == nil && sel.Matches(labels.Set(dex.Labels))
+}
+
+// Instances returns the keys of all the Dex instances targeted by the DexClient, sorted by namespace and name.
+// Instances matched by the selector are listed with r, while explicit references are returned even if missing
+func (in *DexClient) Instances(ctx context.Context, r client.Reader) ([]types.NamespacedName, error) {
+	res := in.InstanceRefs()
+	if in.Spec.InstanceSelector != nil {
+		sel, err := metav1.LabelSelectorAsSelector(in.Spec.InstanceSelector)
+		if err != nil {
+			return nil, err
+		}
+		var list DexList
+		if err := r.List(ctx, &list, client.MatchingLabelsSelector{Selector: sel}); err != nil {
+			return nil, err
+		}
+		for i := range list.Items {
+			res = append(res, list.Items[i].NamespacedName())
+		}
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].String() < res[j].String()
+	})
+	return res, nil
+}
+
+// Instance returns the status of the registration on the Dex instance k, or nil if there is none
+func (in *DexClientStatus) Instance(k InstanceKey) *InstanceStatus {
+	for i := range in.Instances {
+		if in.Instances[i].Key() == k {
+			return &in.Instances[i]
+		}
+	}
+	return nil
+}
+
+// SetInstance adds or replaces the status of the registration on a Dex instance
+func (in *DexClientStatus) SetInstance(st InstanceStatus) {
+	if cur := in.Instance(st.Key()); cur != nil {
+		*cur = st
+		return
+	}
+	in.Instances = append(in.Instances, st)
+	sort.Slice(in.Instances, func(i, j int) bool {
+		a, b := in.Instances[i].Key(), in.Instances[j].Key()
+		if a.NamespacedName == b.NamespacedName {
+			return a.Kind < b.Kind
+		}
+		return a.String() < b.String()
+	})
+}
+
+// RemoveInstance drops the status of the registration on the Dex instance k
+func (in *DexClientStatus) RemoveInstance(k InstanceKey) {
+	res := in.Instances[:0]
+	for _, st := range in.Instances {
+		if st.Key() != k {
+			res = append(res, st)
+		}
+	}
+	in.Instances = res
+}
+
 func init() {
 	SchemeBuilder.Register(&DexClient{}, &DexClientList{})
 }
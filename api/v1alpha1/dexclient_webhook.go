@@ -17,13 +17,29 @@ limitations under the License.
 package v1alpha1
 
 import (
-	"github.com/pkg/errors"
+	"context"
+	"fmt"
+	admissionv1 "k8s.io/api/admission/v1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
-	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"net"
+	"net/url"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/karavel-io/dex-operator/utils"
 )
 
 // EDIT THIS FILE!  THIS IS SCAFFOLDING FOR YOU TO OWN!
@@ -31,12 +47,79 @@ import (
 // log is for logging in this package.
 var dexclientlog = logf.Log.WithName("dexclient-resource")
 
+const dexClientValidatePath = "/validate-dex-karavel-io-v1alpha1-dexclient"
+
 func (in *DexClient) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	webhookReader = mgr.GetAPIReader()
+	// registered before the builder, which skips paths that are already handled
+	mgr.GetWebhookServer().Register(dexClientValidatePath, &webhook.Admission{
+		Handler: &dexClientValidator{Handler: admission.ValidatingWebhookFor(in).Handler},
+	})
 	return ctrl.NewWebhookManagedBy(mgr).
 		For(in).
 		Complete()
 }
 
+// dexClientValidator wraps the handler generated from webhook.Validator, which cannot
+// return admission warnings, and attaches the results of the soft checks to allowed requests
+type dexClientValidator struct {
+	admission.Handler
+	decoder *admission.Decoder
+}
+
+func (v *dexClientValidator) InjectDecoder(d *admission.Decoder) error {
+	v.decoder = d
+	_, err := admission.InjectDecoderInto(d, v.Handler)
+	return err
+}
+
+func (v *dexClientValidator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	res := v.Handler.Handle(ctx, req)
+	if !res.Allowed || req.Operation == admissionv1.Delete {
+		return res
+	}
+
+	var dc DexClient
+	if err := v.decoder.Decode(req, &dc); err != nil {
+		return res
+	}
+	warnings := dc.warnings(ctx)
+
+	var old DexClient
+	if req.Operation == admissionv1.Update && dc.DeletionTimestamp.IsZero() {
+		if err := v.decoder.DecodeRaw(req.OldObject, &old); err == nil && dc.specUnchanged(&old) {
+			warnings = append(warnings, dc.policyWarnings(ctx)...)
+		}
+	}
+	return res.WithWarnings(warnings...)
+}
+
+// +kubebuilder:webhook:path=/mutate-dex-karavel-io-v1alpha1-dexclient,mutating=true,failurePolicy=fail,sideEffects=None,groups=dex.karavel.io,resources=dexclients,verbs=create;update,versions=v1alpha1,name=mdexclient.kb.io,admissionReviewVersions={v1,v1beta1}
+
+var _ webhook.Defaulter = &DexClient{}
+
+// Default implements webhook.Defaulter so a webhook will be registered for the type.
+// Clients that don't target any instance are pointed to the default Dex instance of their namespace,
+// unless the default is ambiguous, which is then reported by the validating webhook
+func (in *DexClient) Default() {
+	dexclientlog.Info("default", "name", in.Name)
+	if in.targetFields() > 0 || webhookReader == nil {
+		return
+	}
+
+	keys, err := DefaultInstances(context.Background(), webhookReader, in.Namespace)
+	if err != nil {
+		dexclientlog.Error(err, "failed to look up the default Dex instance", "name", in.Name)
+		return
+	}
+	if len(keys) == 1 {
+		in.Spec.InstanceRef = InstanceRef{
+			Name:      keys[0].Name,
+			Namespace: keys[0].Namespace,
+		}
+	}
+}
+
 // Change verbs to "verbs=create;update;delete" if you want to enable deletion validation.
 // +kubebuilder:webhook:verbs=create;update,path=/validate-dex-karavel-io-v1alpha1-dexclient,mutating=false,failurePolicy=fail,sideEffects=None,groups=dex.karavel.io,resources=dexclients,versions=v1alpha1,name=vdexclient.kb.io,admissionReviewVersions={v1,v1beta1}
 
@@ -45,26 +128,28 @@ var _ webhook.Validator = &DexClient{}
 // ValidateCreate implements webhook.Validator so a webhook will be registered for the type
 func (in *DexClient) ValidateCreate() error {
 	dexclientlog.Info("validate create", "name", in.Name)
+	errs := in.validateSpec()
+	errs = append(errs, in.validatePolicies()...)
+	if len(errs) > 0 {
+		return apierrors.NewInvalid(in.GroupVersionKind().GroupKind(), in.Name, errs)
+	}
 	return nil
 }
 
 // ValidateUpdate implements webhook.Validator so a webhook will be registered for the type
 func (in *DexClient) ValidateUpdate(old runtime.Object) error {
 	dexclientlog.Info("validate update", "name", in.Name, "new", in, "old", old)
-	gr := schema.GroupResource{
-		Group:    in.GroupVersionKind().Group,
-		Resource: "dexclients",
+	// the checks depend on other objects, which may have changed since the client was admitted:
+	// they only run on spec changes, so that finalizers and metadata can always be updated
+	if in.specUnchanged(old) {
+		return nil
 	}
 
-	dco := old.(*DexClient)
-	diff := in.Spec.InstanceRef.Name != dco.Spec.InstanceRef.Name
-	diff = diff || in.Spec.InstanceRef.Namespace != dco.Spec.InstanceRef.Namespace
-	if diff {
-		return apierrors.NewConflict(gr, in.Name, errors.New("field spec.instanceSelector is immutable"))
-	}
-
-	if in.Spec.Public != dco.Spec.Public {
-		return apierrors.NewConflict(gr, in.Name, errors.New("field spec.public is immutable"))
+	// changes to the targeted instances and spec.public are allowed, the operator migrates the client
+	errs := in.validateSpec()
+	errs = append(errs, in.validatePolicies()...)
+	if len(errs) > 0 {
+		return apierrors.NewInvalid(in.GroupVersionKind().GroupKind(), in.Name, errs)
 	}
 
 	return nil
@@ -75,3 +160,504 @@ func (in *DexClient) ValidateDelete() error {
 	dexclientlog.Info("validate delete", "name", in.Name)
 	return nil
 }
+
+// specUnchanged reports whether the update leaves the spec as in old, or the client is being deleted
+func (in *DexClient) specUnchanged(old runtime.Object) bool {
+	if !in.DeletionTimestamp.IsZero() {
+		return true
+	}
+	prev, ok := old.(*DexClient)
+	return ok && equality.Semantic.DeepEqual(in.Spec, prev.Spec)
+}
+
+// validateSpec runs the hard checks on instance targets, redirect URIs and the generated Secret and ConfigMap
+func (in *DexClient) validateSpec() field.ErrorList {
+	errs := in.validateTargets()
+	errs = append(errs, in.validateRedirectURIs()...)
+	errs = append(errs, in.validateSecretKeys()...)
+	errs = append(errs, in.validateSecretData()...)
+	if err := in.validateSecretName(); err != nil {
+		errs = append(errs, err)
+	}
+	errs = append(errs, in.validateConfigMap()...)
+	errs = append(errs, in.validateSecretTargets()...)
+	return errs
+}
+
+// validateSecretTargets checks the namespace names and the selector the Secret is copied to
+func (in *DexClient) validateSecretTargets() field.ErrorList {
+	t := in.Spec.SecretTargets
+	if t == nil {
+		return nil
+	}
+
+	errs := field.ErrorList{}
+	p := field.NewPath("spec", "secretTargets")
+	for i, n := range t.Names {
+		for _, msg := range validation.IsDNS1123Label(n) {
+			errs = append(errs, field.Invalid(p.Child("names").Index(i), n, msg))
+		}
+	}
+	if t.Selector != nil {
+		if _, err := metav1.LabelSelectorAsSelector(t.Selector); err != nil {
+			errs = append(errs, field.Invalid(p.Child("selector"), t.Selector, err.Error()))
+		}
+	}
+	return errs
+}
+
+// validateRedirectURIs checks that redirect URIs are absolute and have no fragment.
+// Loopback hosts and custom schemes are only allowed for public clients, which run on the user device
+func (in *DexClient) validateRedirectURIs() field.ErrorList {
+	errs := field.ErrorList{}
+	for i, uri := range in.Spec.RedirectUris {
+		p := field.NewPath("spec", "redirectUris").Index(i)
+		u, err := url.Parse(uri)
+		if err != nil {
+			errs = append(errs, field.Invalid(p, uri, err.Error()))
+			continue
+		}
+		if !u.IsAbs() {
+			errs = append(errs, field.Invalid(p, uri, "must be an absolute URI"))
+			continue
+		}
+		if u.Fragment != "" || strings.Contains(uri, "#") {
+			errs = append(errs, field.Invalid(p, uri, "must not contain a fragment"))
+		}
+
+		web := u.Scheme == "http" || u.Scheme == "https"
+		if web && u.Hostname() == "" {
+			errs = append(errs, field.Invalid(p, uri, "must have a host"))
+			continue
+		}
+		if in.Spec.Public {
+			continue
+		}
+		if !web {
+			errs = append(errs, field.Invalid(p, uri, fmt.Sprintf("scheme %s is only allowed for public clients", u.Scheme)))
+		} else if isLoopback(u.Hostname()) {
+			errs = append(errs, field.Invalid(p, uri, "loopback redirect URIs are only allowed for public clients"))
+		}
+	}
+	return errs
+}
+
+// outputKey is a field setting a key of the generated Secret or ConfigMap
+type outputKey struct {
+	name  string
+	value string
+}
+
+// validateSecretKeys checks that the keys of the generated Secret are valid and distinct
+func (in *DexClient) validateSecretKeys() field.ErrorList {
+	return validateOutputKeys(field.NewPath("spec"), []outputKey{
+		{"clientIDKey", in.Spec.ClientIDKey},
+		{"clientSecretKey", in.Spec.ClientSecretKey},
+		{"issuerURLKey", in.Spec.IssuerURLKey},
+	})
+}
+
+// validateSecretData checks that the data templates parse, and that their keys are valid
+// and don't clash with the keys holding the credentials
+func (in *DexClient) validateSecretData() field.ErrorList {
+	errs := field.ErrorList{}
+	reserved := map[string]bool{
+		in.Spec.ClientIDKey:     true,
+		in.Spec.ClientSecretKey: true,
+		in.Spec.IssuerURLKey:    true,
+	}
+	p := field.NewPath("spec", "template", "data")
+	keys := make([]string, 0, len(in.Spec.Template.Data))
+	for k := range in.Spec.Template.Data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := in.Spec.Template.Data[k]
+		for _, msg := range validation.IsConfigMapKey(k) {
+			errs = append(errs, field.Invalid(p.Key(k), k, msg))
+		}
+		if reserved[k] {
+			errs = append(errs, field.Duplicate(p.Key(k), k))
+		}
+		if _, err := template.New(k).Funcs(utils.TxtFuncMap()).Parse(v); err != nil {
+			errs = append(errs, field.Invalid(p.Key(k), v, err.Error()))
+		}
+	}
+
+	preset := in.Spec.Template.Preset.Entries()
+	for _, ck := range []outputKey{
+		{"clientIDKey", in.Spec.ClientIDKey},
+		{"clientSecretKey", in.Spec.ClientSecretKey},
+		{"issuerURLKey", in.Spec.IssuerURLKey},
+	} {
+		if _, ok := preset[ck.value]; ok {
+			msg := fmt.Sprintf("clashes with an entry of the %s preset", in.Spec.Template.Preset)
+			errs = append(errs, field.Invalid(field.NewPath("spec", ck.name), ck.value, msg))
+		}
+	}
+	return errs
+}
+
+// validateConfigMap checks that the keys of the generated ConfigMap are valid and distinct,
+// and that it would not overwrite a ConfigMap owned by someone else
+func (in *DexClient) validateConfigMap() field.ErrorList {
+	out := in.Spec.ConfigMap
+	if out == nil {
+		return nil
+	}
+
+	p := field.NewPath("spec", "configMap")
+	errs := validateOutputKeys(p, []outputKey{
+		{"clientIDKey", out.ClientIDKey},
+		{"issuerURLKey", out.IssuerURLKey},
+		{"discoveryURLKey", out.DiscoveryURLKey},
+		{"redirectURIsKey", out.RedirectURIsKey},
+	})
+	if err := in.validateOwned(p.Child("name"), "ConfigMap", in.ConfigMapName(), &v1.ConfigMap{}); err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+func validateOutputKeys(parent *field.Path, keys []outputKey) field.ErrorList {
+	errs := field.ErrorList{}
+	seen := make(map[string]bool)
+	for _, k := range keys {
+		p := parent.Child(k.name)
+		if k.value == "" {
+			continue
+		}
+		for _, msg := range validation.IsConfigMapKey(k.value) {
+			errs = append(errs, field.Invalid(p, k.value, msg))
+		}
+		if seen[k.value] {
+			errs = append(errs, field.Duplicate(p, k.value))
+		}
+		seen[k.value] = true
+	}
+	return errs
+}
+
+// validateSecretName checks that the generated Secret would not overwrite a Secret owned by someone else.
+// Public clients get no Secret
+func (in *DexClient) validateSecretName() *field.Error {
+	if in.Spec.Public {
+		return nil
+	}
+	return in.validateOwned(field.NewPath("spec", "template", "metadata", "name"), "Secret", in.SecretName(), &v1.Secret{})
+}
+
+// validateOwned checks that name is valid, and that the object of the given kind called name,
+// read into obj, is owned by the client if it exists. Clients being created may have no UID yet, in which
+// case any existing object is rejected, including the ones left behind by a deleted client with the same name
+func (in *DexClient) validateOwned(p *field.Path, kind string, name string, obj client.Object) *field.Error {
+	if msgs := validation.IsDNS1123Subdomain(name); len(msgs) > 0 {
+		return field.Invalid(p, name, strings.Join(msgs, ", "))
+	}
+	if webhookReader == nil {
+		return nil
+	}
+
+	if err := webhookReader.Get(context.Background(), client.ObjectKey{Namespace: in.Namespace, Name: name}, obj); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return field.InternalError(p, err)
+	}
+
+	owner := metav1.GetControllerOf(obj)
+	owned := owner != nil && owner.Kind == "DexClient" && owner.Name == in.Name && in.UID != "" && owner.UID == in.UID
+	if !owned {
+		return field.Forbidden(p, fmt.Sprintf("%s %s already exists and is not owned by this client", kind, name))
+	}
+	return nil
+}
+
+// warnings runs the soft checks, which are reported to the user without rejecting the request
+func (in *DexClient) warnings(ctx context.Context) []string {
+	res := make([]string, 0)
+	for _, uri := range in.Spec.RedirectUris {
+		u, err := url.Parse(uri)
+		if err == nil && u.Scheme == "http" && !isLoopback(u.Hostname()) {
+			res = append(res, fmt.Sprintf("redirect URI %s uses plain http, authorization codes will be sent unencrypted", uri))
+		}
+	}
+
+	if webhookReader == nil {
+		return res
+	}
+	for _, k := range in.InstanceRefs() {
+		var obj client.Object = &Dex{}
+		if in.InstanceKind(k) == KindExternalDex {
+			obj = &ExternalDex{}
+		}
+		if err := webhookReader.Get(ctx, k, obj); apierrors.IsNotFound(err) {
+			res = append(res, fmt.Sprintf("%s %s does not exist, the client will be registered once it is created", in.InstanceKind(k), k))
+		}
+	}
+	if in.Spec.InstanceSelector != nil {
+		if keys, err := in.Instances(ctx, webhookReader); err == nil && len(keys) == 0 {
+			res = append(res, "instanceSelector does not match any Dex instance, the client will be registered once one is created")
+		}
+	}
+	return res
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// validatePolicies checks the client against the client policies of its Dex instances and the DexClientPolicies.
+// Missing instances are not an error here, as they are reported by the controller
+func (in *DexClient) validatePolicies() field.ErrorList {
+	if webhookReader == nil || len(in.validateTargets()) > 0 {
+		return nil
+	}
+
+	ctx := context.Background()
+	keys, err := in.Instances(ctx, webhookReader)
+	if err != nil {
+		return field.ErrorList{field.InternalError(field.NewPath("spec"), err)}
+	}
+
+	errs := field.ErrorList{}
+	seen := make(map[string]bool)
+	for _, k := range keys {
+		// external servers have no client policy, and DexClientPolicies bound to an instance
+		// apply to the client before the instance shows up
+		if in.InstanceKind(k) == KindDex {
+			var d Dex
+			if err := webhookReader.Get(ctx, k, &d); err == nil {
+				if err := in.validateClientPolicy(ctx, &d); err != nil {
+					errs = append(errs, err)
+				}
+			} else if !apierrors.IsNotFound(err) {
+				return append(errs, field.InternalError(in.targetPath(k), err))
+			}
+		}
+
+		violations, err := in.EvaluatePolicies(ctx, webhookReader, k)
+		if err != nil {
+			return append(errs, field.InternalError(in.targetPath(k), err))
+		}
+		// policies applying to several instances report the same violations for each of them
+		for _, v := range violations {
+			if !seen[v.Error()] {
+				seen[v.Error()] = true
+				errs = append(errs, v)
+			}
+		}
+	}
+	return errs
+}
+
+// policyWarnings reports the DexClientPolicy violations of a client whose spec is unchanged. Policies are only
+// enforced on new clients and spec changes, existing clients are flagged with the PolicyViolation condition instead
+func (in *DexClient) policyWarnings(ctx context.Context) []string {
+	if webhookReader == nil {
+		return nil
+	}
+	keys, err := in.Instances(ctx, webhookReader)
+	if err != nil {
+		return nil
+	}
+
+	res := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, k := range keys {
+		violations, err := in.EvaluatePolicies(ctx, webhookReader, k)
+		if err != nil {
+			continue
+		}
+		for _, v := range violations {
+			if !seen[v.Error()] {
+				seen[v.Error()] = true
+				res = append(res, fmt.Sprintf("%s; the client stays registered, but spec changes are rejected until it complies", v.Error()))
+			}
+		}
+	}
+	return res
+}
+
+// EvaluatePolicies checks the registration of the client on the instance k against all the DexClientPolicies applying to it
+func (in *DexClient) EvaluatePolicies(ctx context.Context, r client.Reader, k types.NamespacedName) (field.ErrorList, error) {
+	var policies DexClientPolicyList
+	if err := r.List(ctx, &policies); err != nil {
+		return nil, err
+	}
+	if len(policies.Items) == 0 {
+		return nil, nil
+	}
+
+	var ns v1.Namespace
+	if err := r.Get(ctx, client.ObjectKey{Name: in.Namespace}, &ns); err != nil {
+		return nil, err
+	}
+
+	var clients DexClientList
+	if err := r.List(ctx, &clients, client.InNamespace(in.Namespace)); err != nil {
+		return nil, err
+	}
+
+	errs := field.ErrorList{}
+	for i := range policies.Items {
+		p := &policies.Items[i]
+		ok, err := p.AppliesTo(k, &ns)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+
+		earlier := 0
+		for j := range clients.Items {
+			c := &clients.Items[j]
+			if c.Name == in.Name || !c.ObjectMeta.DeletionTimestamp.IsZero() {
+				continue
+			}
+			if in.createdAfter(c) && policyApplies(p, c, &ns) {
+				earlier++
+			}
+		}
+
+		violations, err := p.Validate(in, &ns, earlier)
+		if err != nil {
+			return nil, err
+		}
+		errs = append(errs, violations...)
+	}
+	return errs, nil
+}
+
+// policyApplies reports whether p applies to c on any of the instances it references by name or is registered on
+func policyApplies(p *DexClientPolicy, c *DexClient, ns *v1.Namespace) bool {
+	keys := c.InstanceRefs()
+	for _, st := range c.Status.Instances {
+		keys = append(keys, st.NamespacedName())
+	}
+	for _, k := range keys {
+		if ok, _ := p.AppliesTo(k, ns); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// createdAfter reports whether the client was created after c, using the name to break ties.
+// Clients not created yet come after all the existing ones
+func (in *DexClient) createdAfter(c *DexClient) bool {
+	if in.CreationTimestamp.IsZero() {
+		return true
+	}
+	if c.CreationTimestamp.Equal(&in.CreationTimestamp) {
+		return c.Name < in.Name
+	}
+	return c.CreationTimestamp.Before(&in.CreationTimestamp)
+}
+
+// validateClientPolicy checks that the client namespace is allowed by the client policy of the Dex instance d
+func (in *DexClient) validateClientPolicy(ctx context.Context, d *Dex) *field.Error {
+	p := in.targetPath(d.NamespacedName())
+	ns := v1.Namespace{}
+	ns.Name = in.Namespace
+	if d.Spec.ClientPolicy.SelectsNamespaceLabels() {
+		if err := webhookReader.Get(ctx, client.ObjectKey{Name: in.Namespace}, &ns); err != nil {
+			return field.InternalError(p, err)
+		}
+	}
+
+	ok, err := d.AllowsNamespace(&ns)
+	if err != nil {
+		return field.InternalError(p, err)
+	}
+	if !ok {
+		return field.Forbidden(p, fmt.Sprintf("namespace %s is not allowed to register clients on Dex instance %s", in.Namespace, d.NamespacedName()))
+	}
+	return nil
+}
+
+// validateTargets checks that the client targets its Dex instances in exactly one way
+func (in *DexClient) validateTargets() field.ErrorList {
+	p := field.NewPath("spec")
+	errs := field.ErrorList{}
+	set := in.targetFields()
+	if set == 0 {
+		errs = append(errs, field.Required(p.Child("instanceRef"), in.missingTargetDetail()))
+	} else if set > 1 {
+		errs = append(errs, field.Forbidden(p, "only one of instanceRef, instanceRefs and instanceSelector may be set"))
+	}
+
+	seen := make(map[types.NamespacedName]bool)
+	for i, ref := range in.Spec.InstanceRefs {
+		fp := p.Child("instanceRefs").Index(i)
+		if ref.Name == "" {
+			errs = append(errs, field.Required(fp.Child("name"), ""))
+			continue
+		}
+		k := in.instanceKey(ref)
+		if seen[k] {
+			errs = append(errs, field.Duplicate(fp, k.String()))
+		}
+		seen[k] = true
+	}
+
+	if sel := in.Spec.InstanceSelector; sel != nil {
+		if _, err := metav1.LabelSelectorAsSelector(sel); err != nil {
+			errs = append(errs, field.Invalid(p.Child("instanceSelector"), sel, err.Error()))
+		}
+	}
+	return errs
+}
+
+// targetFields returns how many of instanceRef, instanceRefs and instanceSelector are set
+func (in *DexClient) targetFields() int {
+	set := 0
+	if in.Spec.InstanceRef.Name != "" {
+		set++
+	}
+	if len(in.Spec.InstanceRefs) > 0 {
+		set++
+	}
+	if in.Spec.InstanceSelector != nil {
+		set++
+	}
+	return set
+}
+
+// missingTargetDetail explains why a client without targets could not be pointed to a default Dex instance
+func (in *DexClient) missingTargetDetail() string {
+	detail := "one of instanceRef, instanceRefs and instanceSelector must be set"
+	if webhookReader == nil {
+		return detail
+	}
+	keys, err := DefaultInstances(context.Background(), webhookReader, in.Namespace)
+	if err != nil || len(keys) < 2 {
+		return detail
+	}
+
+	names := make([]string, len(keys))
+	for i, k := range keys {
+		names[i] = k.String()
+	}
+	return fmt.Sprintf("%s, as several Dex instances are the default for namespace %s: %s", detail, in.Namespace, strings.Join(names, ", "))
+}
+
+// targetPath returns the path of the field targeting the Dex instance k
+func (in *DexClient) targetPath(k types.NamespacedName) *field.Path {
+	p := field.NewPath("spec")
+	if in.Spec.InstanceRef.Name != "" && in.InstanceNamespacedName() == k {
+		return p.Child("instanceRef")
+	}
+	for i, ref := range in.Spec.InstanceRefs {
+		if in.instanceKey(ref) == k {
+			return p.Child("instanceRefs").Index(i)
+		}
+	}
+	return p.Child("instanceSelector")
+}
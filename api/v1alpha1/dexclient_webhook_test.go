@@ -0,0 +1,615 @@
+/*
+Copyright 2021 © MIKAMAI s.r.l
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// useReader points the webhooks to a fake client holding objs for the duration of the test
+func useReader(t *testing.T, objs ...client.Object) {
+	t.Helper()
+	s := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+
+	prev := webhookReader
+	webhookReader = fake.NewClientBuilder().WithScheme(s).WithObjects(objs...).Build()
+	t.Cleanup(func() { webhookReader = prev })
+}
+
+func testDex(allowed ...string) *Dex {
+	d := &Dex{ObjectMeta: metav1.ObjectMeta{Name: "dex", Namespace: "dex"}}
+	d.Spec.ClientPolicy.AllowedNamespaces = &AllowedNamespaces{Names: allowed}
+	return d
+}
+
+func testClient() *DexClient {
+	return &DexClient{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              "app",
+			Namespace:         "apps",
+			UID:               "client-uid",
+			CreationTimestamp: metav1.Now(),
+			Finalizers:        []string{"clients.finalizers.dex.karavel.io"},
+		},
+		Spec: DexClientSpec{
+			Name:         "App",
+			InstanceRef:  InstanceRef{Name: "dex", Namespace: "dex"},
+			RedirectUris: []string{"https://app.example.com/callback"},
+		},
+	}
+}
+
+// foreignSecret is a Secret with the name of the client credentials, not owned by the client
+func foreignSecret() *v1.Secret {
+	return &v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "dex-app-credentials", Namespace: "apps"}}
+}
+
+// ownedSecret is a Secret with the name of the client credentials, controlled by a client with the given UID
+func ownedSecret(uid types.UID) *v1.Secret {
+	sec := foreignSecret()
+	controller := true
+	sec.OwnerReferences = []metav1.OwnerReference{{
+		APIVersion: GroupVersion.String(),
+		Kind:       "DexClient",
+		Name:       "app",
+		UID:        uid,
+		Controller: &controller,
+	}}
+	return sec
+}
+
+func TestDexClientValidateCreate(t *testing.T) {
+	tests := []struct {
+		name    string
+		objs    []client.Object
+		uid     types.UID
+		wantErr bool
+	}{
+		{"allowed namespace", []client.Object{testDex("apps")}, "", false},
+		{"missing instance", nil, "", false},
+		{"namespace not allowed", []client.Object{testDex("other")}, "", true},
+		{"secret owned by someone else", []client.Object{testDex("apps"), foreignSecret()}, "", true},
+		{"secret of a deleted client with the same name", []client.Object{testDex("apps"), ownedSecret("old-uid")}, "", true},
+		{"secret of a deleted client with a UID assigned", []client.Object{testDex("apps"), ownedSecret("old-uid")}, "client-uid", true},
+		{"secret of the client", []client.Object{testDex("apps"), ownedSecret("client-uid")}, "client-uid", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useReader(t, tt.objs...)
+			dc := testClient()
+			dc.UID = tt.uid
+			if err := dc.ValidateCreate(); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateCreate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDexClientValidateUpdate(t *testing.T) {
+	now := metav1.Now()
+	restricted := testDex("other")
+	restricted.Name = "other"
+	tests := []struct {
+		name    string
+		objs    []client.Object
+		update  func(dc *DexClient)
+		wantErr bool
+	}{
+		{
+			name: "finalizer removed while terminating after the policy changed",
+			objs: []client.Object{testDex("other")},
+			update: func(dc *DexClient) {
+				dc.DeletionTimestamp = &now
+				dc.Finalizers = nil
+			},
+		},
+		{
+			name: "spec changed while terminating",
+			objs: []client.Object{testDex("other"), foreignSecret()},
+			update: func(dc *DexClient) {
+				dc.DeletionTimestamp = &now
+				dc.Spec.RedirectUris = append(dc.Spec.RedirectUris, "https://app.example.com/other")
+			},
+		},
+		{
+			name: "labels changed after the policy changed",
+			objs: []client.Object{testDex("other")},
+			update: func(dc *DexClient) {
+				dc.Labels = map[string]string{"team": "identity"}
+			},
+		},
+		{
+			name: "finalizer removed with a foreign secret",
+			objs: []client.Object{testDex("apps"), foreignSecret()},
+			update: func(dc *DexClient) {
+				dc.Finalizers = nil
+			},
+		},
+		{
+			name: "spec changed on an allowed instance",
+			objs: []client.Object{testDex("apps")},
+			update: func(dc *DexClient) {
+				dc.Spec.RedirectUris = append(dc.Spec.RedirectUris, "https://app.example.com/other")
+			},
+		},
+		{
+			name: "spec changed after the policy changed",
+			objs: []client.Object{testDex("other")},
+			update: func(dc *DexClient) {
+				dc.Spec.RedirectUris = append(dc.Spec.RedirectUris, "https://app.example.com/other")
+			},
+			wantErr: true,
+		},
+		{
+			name: "spec changed with a foreign secret",
+			objs: []client.Object{testDex("apps"), foreignSecret()},
+			update: func(dc *DexClient) {
+				dc.Spec.Name = "Other app"
+			},
+			wantErr: true,
+		},
+		{
+			name: "preset added",
+			objs: []client.Object{testDex("apps")},
+			update: func(dc *DexClient) {
+				dc.Spec.ClientSecretKey = "clientSecret"
+				dc.Spec.Template.Preset = SecretPresetArgoCD
+			},
+		},
+		{
+			name: "preset entry used as credential key",
+			objs: []client.Object{testDex("apps")},
+			update: func(dc *DexClient) {
+				dc.Spec.ClientSecretKey = "oidc.config"
+				dc.Spec.Template.Preset = SecretPresetArgoCD
+			},
+			wantErr: true,
+		},
+		{
+			name: "template entry used as credential key",
+			objs: []client.Object{testDex("apps")},
+			update: func(dc *DexClient) {
+				dc.Spec.ClientIDKey = "clientID"
+				dc.Spec.Template.Data = map[string]string{"clientID": "{{ .ClientID }}"}
+			},
+			wantErr: true,
+		},
+		{
+			name: "public flag flipped",
+			objs: []client.Object{testDex("apps")},
+			update: func(dc *DexClient) {
+				dc.Spec.Public = true
+			},
+		},
+		{
+			name: "moved to another instance",
+			objs: []client.Object{testDex("apps")},
+			update: func(dc *DexClient) {
+				dc.Spec.InstanceRef = InstanceRef{Name: "other", Namespace: "dex"}
+			},
+		},
+		{
+			name: "moved to an instance that does not allow the namespace",
+			objs: []client.Object{testDex("apps"), restricted},
+			update: func(dc *DexClient) {
+				dc.Spec.InstanceRef = InstanceRef{Name: "other", Namespace: "dex"}
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid spec change",
+			objs: []client.Object{testDex("apps")},
+			update: func(dc *DexClient) {
+				dc.Spec.RedirectUris = []string{"/callback"}
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useReader(t, tt.objs...)
+			old := testClient()
+			dc := old.DeepCopy()
+			tt.update(dc)
+			if err := dc.ValidateUpdate(old); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateUpdate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestEvaluatePolicies(t *testing.T) {
+	ns := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "apps", Labels: map[string]string{"team": "a"}}}
+	policy := func(name string, spec DexClientPolicySpec) *DexClientPolicy {
+		return &DexClientPolicy{ObjectMeta: metav1.ObjectMeta{Name: name}, Spec: spec}
+	}
+	max := func(n int32) *int32 { return &n }
+	older := testClient()
+	older.Name = "older"
+	older.CreationTimestamp = metav1.NewTime(older.CreationTimestamp.Add(-time.Hour))
+	newer := testClient()
+	newer.Name = "newer"
+	newer.CreationTimestamp = metav1.NewTime(newer.CreationTimestamp.Add(time.Hour))
+
+	tests := []struct {
+		name   string
+		objs   []client.Object
+		update func(dc *DexClient)
+		want   int
+	}{
+		{name: "no policies"},
+		{
+			name: "allowed scheme and host",
+			objs: []client.Object{policy("uris", DexClientPolicySpec{
+				RedirectURIs: &RedirectURIRules{AllowedSchemes: []string{"https"}, AllowedHosts: []string{"*.example.com"}},
+			})},
+		},
+		{
+			name: "scheme and host not allowed",
+			objs: []client.Object{policy("uris", DexClientPolicySpec{
+				RedirectURIs: &RedirectURIRules{AllowedSchemes: []string{"https"}, AllowedHosts: []string{"*.team-a.example.com"}},
+			})},
+			update: func(dc *DexClient) {
+				dc.Spec.RedirectUris = []string{"http://app.example.com/callback"}
+			},
+			want: 2,
+		},
+		{
+			name: "policy bound to another instance",
+			objs: []client.Object{policy("other", DexClientPolicySpec{
+				InstanceRef:  &PolicyInstanceRef{Name: "other", Namespace: "dex"},
+				RedirectURIs: &RedirectURIRules{AllowedSchemes: []string{"http"}},
+			})},
+		},
+		{
+			name: "policy restricted to other namespaces",
+			objs: []client.Object{policy("other", DexClientPolicySpec{
+				Namespaces:   &AllowedNamespaces{Names: []string{"other"}},
+				RedirectURIs: &RedirectURIRules{AllowedSchemes: []string{"http"}},
+			})},
+		},
+		{
+			name: "policy selecting the namespace labels",
+			objs: []client.Object{policy("team-a", DexClientPolicySpec{
+				Namespaces:   &AllowedNamespaces{Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "a"}}},
+				RedirectURIs: &RedirectURIRules{AllowedSchemes: []string{"http"}},
+			})},
+			want: 1,
+		},
+		{
+			name: "public client not allowed",
+			objs: []client.Object{policy("public", DexClientPolicySpec{
+				PublicClients: &PublicClientRules{AllowedNamespaces: &AllowedNamespaces{Names: []string{"frontend"}}},
+			})},
+			update: func(dc *DexClient) {
+				dc.Spec.Public = true
+			},
+			want: 1,
+		},
+		{
+			name: "within the client limit",
+			objs: []client.Object{policy("max", DexClientPolicySpec{MaxClientsPerNamespace: max(1)}), newer},
+		},
+		{
+			name: "over the client limit",
+			objs: []client.Object{policy("max", DexClientPolicySpec{MaxClientsPerNamespace: max(1)}), older},
+			want: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useReader(t, append(tt.objs, ns)...)
+			dc := testClient()
+			if tt.update != nil {
+				tt.update(dc)
+			}
+			errs, err := dc.EvaluatePolicies(context.Background(), webhookReader, dc.InstanceNamespacedName())
+			if err != nil {
+				t.Fatalf("EvaluatePolicies() error = %v", err)
+			}
+			if len(errs) != tt.want {
+				t.Errorf("EvaluatePolicies() = %v, want %d violations", errs, tt.want)
+			}
+		})
+	}
+}
+
+func TestDexClientPolicyWarnings(t *testing.T) {
+	ns := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "apps"}}
+	p := &DexClientPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "uris"},
+		Spec: DexClientPolicySpec{
+			RedirectURIs: &RedirectURIRules{AllowedHosts: []string{"*.team-a.example.com"}},
+		},
+	}
+	useReader(t, ns, p, testDex("apps"))
+
+	old := testClient()
+	dc := old.DeepCopy()
+	dc.Labels = map[string]string{"team": "identity"}
+	if err := dc.ValidateUpdate(old); err != nil {
+		t.Errorf("ValidateUpdate() with an unchanged spec error = %v, want nil", err)
+	}
+	if w := dc.policyWarnings(context.Background()); len(w) != 1 {
+		t.Errorf("policyWarnings() = %v, want 1 warning", w)
+	}
+
+	dc.Spec.Name = "Other app"
+	if err := dc.ValidateUpdate(old); err == nil {
+		t.Error("ValidateUpdate() with a changed spec error = nil, want a policy violation")
+	}
+}
+
+func TestDexClientValidateRedirectURIs(t *testing.T) {
+	tests := []struct {
+		name   string
+		uri    string
+		public bool
+		want   int
+	}{
+		{name: "https", uri: "https://app.example.com/callback"},
+		{name: "relative", uri: "/callback", want: 1},
+		{name: "unparsable", uri: "https://app example.com/%zz", want: 1},
+		{name: "fragment", uri: "https://app.example.com/callback#token", want: 1},
+		{name: "empty fragment", uri: "https://app.example.com/callback#", want: 1},
+		{name: "missing host", uri: "https:///callback", want: 1},
+		{name: "loopback on a confidential client", uri: "http://localhost:8000/callback", want: 1},
+		{name: "loopback IP on a confidential client", uri: "http://127.0.0.1:8000/callback", want: 1},
+		{name: "loopback on a public client", uri: "http://localhost:8000/callback", public: true},
+		{name: "custom scheme on a confidential client", uri: "com.example.app:/callback", want: 1},
+		{name: "custom scheme on a public client", uri: "com.example.app:/callback", public: true},
+		{name: "fragment on a public client", uri: "com.example.app:/callback#x", public: true, want: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dc := testClient()
+			dc.Spec.Public = tt.public
+			dc.Spec.RedirectUris = []string{tt.uri}
+			if errs := dc.validateRedirectURIs(); len(errs) != tt.want {
+				t.Errorf("validateRedirectURIs() = %v, want %d errors", errs, tt.want)
+			}
+		})
+	}
+}
+
+func TestDexClientValidateSecretKeys(t *testing.T) {
+	tests := []struct {
+		name     string
+		clientID string
+		secret   string
+		issuer   string
+		want     int
+		wantType field.ErrorType
+	}{
+		{name: "defaults"},
+		{name: "distinct keys", clientID: "id", secret: "secret", issuer: "issuer"},
+		{name: "clashing keys", clientID: "id", secret: "id", want: 1, wantType: field.ErrorTypeDuplicate},
+		{name: "all the same", clientID: "id", secret: "id", issuer: "id", want: 2, wantType: field.ErrorTypeDuplicate},
+		{name: "invalid key", clientID: "client id", want: 1, wantType: field.ErrorTypeInvalid},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dc := testClient()
+			dc.Spec.ClientIDKey = tt.clientID
+			dc.Spec.ClientSecretKey = tt.secret
+			dc.Spec.IssuerURLKey = tt.issuer
+			errs := dc.validateSecretKeys()
+			if len(errs) != tt.want {
+				t.Fatalf("validateSecretKeys() = %v, want %d errors", errs, tt.want)
+			}
+			for _, err := range errs {
+				if err.Type != tt.wantType {
+					t.Errorf("validateSecretKeys() = %v, want type %s", err, tt.wantType)
+				}
+			}
+		})
+	}
+}
+
+func TestDexClientWarnings(t *testing.T) {
+	tests := []struct {
+		name string
+		objs []client.Object
+		uris []string
+		want int
+	}{
+		{name: "existing instance", objs: []client.Object{testDex("apps")}, uris: []string{"https://app.example.com/callback"}},
+		{name: "missing instance", uris: []string{"https://app.example.com/callback"}, want: 1},
+		{name: "plain http", objs: []client.Object{testDex("apps")}, uris: []string{"http://app.example.com/callback"}, want: 1},
+		{name: "plain http on loopback", objs: []client.Object{testDex("apps")}, uris: []string{"http://localhost/callback"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useReader(t, tt.objs...)
+			dc := testClient()
+			dc.Spec.RedirectUris = tt.uris
+			if w := dc.warnings(context.Background()); len(w) != tt.want {
+				t.Errorf("warnings() = %v, want %d warnings", w, tt.want)
+			}
+		})
+	}
+}
+
+func TestDexClientValidateTargets(t *testing.T) {
+	selector := &metav1.LabelSelector{MatchLabels: map[string]string{"region": "eu"}}
+	tests := []struct {
+		name string
+		spec DexClientSpec
+		want int
+	}{
+		{name: "instanceRef", spec: DexClientSpec{InstanceRef: InstanceRef{Name: "dex"}}},
+		{name: "instanceRefs", spec: DexClientSpec{InstanceRefs: []InstanceRef{{Name: "eu"}, {Name: "us"}}}},
+		{name: "instanceSelector", spec: DexClientSpec{InstanceSelector: selector}},
+		{name: "no target", want: 1},
+		{name: "several targets", spec: DexClientSpec{InstanceRef: InstanceRef{Name: "dex"}, InstanceSelector: selector}, want: 1},
+		{name: "unnamed ref", spec: DexClientSpec{InstanceRefs: []InstanceRef{{Name: "eu"}, {Namespace: "dex"}}}, want: 1},
+		{
+			name: "duplicate refs with the default namespace",
+			spec: DexClientSpec{InstanceRefs: []InstanceRef{{Name: "eu"}, {Name: "eu", Namespace: "apps"}}},
+			want: 1,
+		},
+		{
+			name: "same name in different namespaces",
+			spec: DexClientSpec{InstanceRefs: []InstanceRef{{Name: "dex", Namespace: "eu"}, {Name: "dex", Namespace: "us"}}},
+		},
+		{
+			name: "invalid selector",
+			spec: DexClientSpec{InstanceSelector: &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "region", Operator: "Near"}}}},
+			want: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useReader(t)
+			dc := &DexClient{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "apps"}, Spec: tt.spec}
+			if errs := dc.validateTargets(); len(errs) != tt.want {
+				t.Errorf("validateTargets() = %v, want %d errors", errs, tt.want)
+			}
+		})
+	}
+}
+
+func TestDexClientInstances(t *testing.T) {
+	regional := func(name, region string) *Dex {
+		return &Dex{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "dex", Labels: map[string]string{"region": region}}}
+	}
+	eu, us := regional("eu", "eu"), regional("us", "us")
+
+	tests := []struct {
+		name           string
+		spec           DexClientSpec
+		want           []string
+		wantReferences []string
+	}{
+		{
+			name:           "instanceRef in the client namespace",
+			spec:           DexClientSpec{InstanceRef: InstanceRef{Name: "local"}},
+			want:           []string{"apps/local"},
+			wantReferences: []string{},
+		},
+		{
+			name:           "instanceRefs, including missing instances",
+			spec:           DexClientSpec{InstanceRefs: []InstanceRef{{Name: "us", Namespace: "dex"}, {Name: "eu", Namespace: "dex"}, {Name: "gone", Namespace: "dex"}}},
+			want:           []string{"dex/eu", "dex/gone", "dex/us"},
+			wantReferences: []string{"eu", "us"},
+		},
+		{
+			name:           "external server with the name of an instance",
+			spec:           DexClientSpec{InstanceRef: InstanceRef{Kind: KindExternalDex, Name: "eu", Namespace: "dex"}},
+			want:           []string{"dex/eu"},
+			wantReferences: []string{},
+		},
+		{
+			name:           "instanceSelector",
+			spec:           DexClientSpec{InstanceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"region": "eu"}}},
+			want:           []string{"dex/eu"},
+			wantReferences: []string{"eu"},
+		},
+		{
+			name:           "empty selector",
+			spec:           DexClientSpec{InstanceSelector: &metav1.LabelSelector{}},
+			want:           []string{"dex/eu", "dex/us"},
+			wantReferences: []string{"eu", "us"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useReader(t, eu, us)
+			dc := &DexClient{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "apps"}, Spec: tt.spec}
+
+			keys, err := dc.Instances(context.Background(), webhookReader)
+			if err != nil {
+				t.Fatalf("Instances() error = %v", err)
+			}
+			got := make([]string, len(keys))
+			for i, k := range keys {
+				got[i] = k.String()
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Instances() = %v, want %v", got, tt.want)
+			}
+
+			refs := make([]string, 0)
+			for _, d := range []*Dex{eu, us} {
+				if dc.References(d) {
+					refs = append(refs, d.Name)
+				}
+			}
+			if !reflect.DeepEqual(refs, tt.wantReferences) {
+				t.Errorf("References() = %v, want %v", refs, tt.wantReferences)
+			}
+		})
+	}
+}
+
+func TestDexClientStatusInstances(t *testing.T) {
+	key := func(kind, name string) InstanceKey {
+		return InstanceKey{Kind: kind, NamespacedName: types.NamespacedName{Name: name, Namespace: "dex"}}
+	}
+	status := func(k InstanceKey, ready bool) InstanceStatus {
+		return InstanceStatus{Kind: k.Kind, Name: k.Name, Namespace: k.Namespace, Registered: true, Ready: ready}
+	}
+	us, eu, external := key(KindDex, "us"), key(KindDex, "eu"), key(KindExternalDex, "eu")
+
+	var st DexClientStatus
+	st.SetInstance(status(us, false))
+	st.SetInstance(status(external, false))
+	st.SetInstance(status(eu, false))
+	st.SetInstance(status(us, true))
+
+	got := make([]InstanceKey, len(st.Instances))
+	for i, s := range st.Instances {
+		got[i] = s.Key()
+	}
+	if want := []InstanceKey{eu, external, us}; !reflect.DeepEqual(got, want) {
+		t.Errorf("SetInstance() instances = %v, want %v", got, want)
+	}
+	if s := st.Instance(us); s == nil || !s.Ready {
+		t.Errorf("Instance(%s) = %v, want the updated status", us, s)
+	}
+
+	st.RemoveInstance(eu)
+	if st.Instance(eu) != nil || st.Instance(external) == nil || len(st.Instances) != 2 {
+		t.Errorf("RemoveInstance(%s) instances = %v", eu, st.Instances)
+	}
+}
@@ -0,0 +1,174 @@
+/*
+Copyright 2021 © MIKAMAI s.r.l
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"fmt"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"net/url"
+	"strings"
+)
+
+// DexClientPolicySpec defines the constraints enforced on DexClients
+type DexClientPolicySpec struct {
+	// InstanceRef restricts the policy to the clients of a single Dex instance.
+	// If unset, the policy applies to the clients of all the instances in the cluster
+	// +optional
+	InstanceRef *PolicyInstanceRef `json:"instanceRef,omitempty"`
+
+	// Namespaces restricts the policy to the clients in the matching namespaces.
+	// If unset, the policy applies to the clients in all namespaces
+	// +optional
+	Namespaces *AllowedNamespaces `json:"namespaces,omitempty"`
+
+	// RedirectURIs constrains the redirect URIs of the clients
+	// +optional
+	RedirectURIs *RedirectURIRules `json:"redirectURIs,omitempty"`
+
+	// PublicClients constrains where public clients can be registered from
+	// +optional
+	PublicClients *PublicClientRules `json:"publicClients,omitempty"`
+
+	// MaxClientsPerNamespace is the maximum number of clients each namespace can register.
+	// Only clients the policy applies to are counted, oldest first
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	MaxClientsPerNamespace *int32 `json:"maxClientsPerNamespace,omitempty"`
+}
+
+type PolicyInstanceRef struct {
+	// Name is the object name for the Dex instance
+	Name string `json:"name"`
+	// Namespace is the object namespace for the Dex instance
+	Namespace string `json:"namespace"`
+}
+
+type RedirectURIRules struct {
+	// AllowedSchemes is the list of schemes redirect URIs can use, e.g. https.
+	// If empty, any scheme is allowed
+	// +optional
+	AllowedSchemes []string `json:"allowedSchemes,omitempty"`
+	// AllowedHosts is the list of hosts redirect URIs can point to.
+	// A leading "*." matches any subdomain, e.g. *.team-a.example.com.
+	// If empty, any host is allowed
+	// +optional
+	AllowedHosts []string `json:"allowedHosts,omitempty"`
+}
+
+type PublicClientRules struct {
+	// AllowedNamespaces restricts the namespaces public clients can be registered from.
+	// If unset, public clients are allowed in all the namespaces the policy applies to
+	// +optional
+	AllowedNamespaces *AllowedNamespaces `json:"allowedNamespaces,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:path=dexclientpolicies,scope=Cluster
+// +kubebuilder:printcolumn:name="Instance",type=string,JSONPath=`.spec.instanceRef.name`
+// +kubebuilder:printcolumn:name="Instance Namespace",type=string,JSONPath=`.spec.instanceRef.namespace`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// DexClientPolicy is the Schema for the dexclientpolicies API
+type DexClientPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec DexClientPolicySpec `json:"spec,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// DexClientPolicyList contains a list of DexClientPolicy
+type DexClientPolicyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []DexClientPolicy `json:"items"`
+}
+
+// AppliesTo reports whether the policy constrains clients of the instance identified by instance in namespace ns
+func (in *DexClientPolicy) AppliesTo(instance types.NamespacedName, ns *v1.Namespace) (bool, error) {
+	if ref := in.Spec.InstanceRef; ref != nil && (ref.Name != instance.Name || ref.Namespace != instance.Namespace) {
+		return false, nil
+	}
+	if in.Spec.Namespaces == nil {
+		return true, nil
+	}
+	return in.Spec.Namespaces.Matches(ns)
+}
+
+// Validate checks dc against the policy. earlier is the number of clients in the same namespace
+// the policy applies to that were created before dc
+func (in *DexClientPolicy) Validate(dc *DexClient, ns *v1.Namespace, earlier int) (field.ErrorList, error) {
+	errs := field.ErrorList{}
+	spec := field.NewPath("spec")
+	detail := func(msg string) string {
+		return fmt.Sprintf("%s (DexClientPolicy %s)", msg, in.Name)
+	}
+
+	if rules := in.Spec.RedirectURIs; rules != nil {
+		p := spec.Child("redirectUris")
+		for i, raw := range dc.Spec.RedirectUris {
+			u, err := url.Parse(raw)
+			if err != nil {
+				// malformed URIs are reported by the DexClient validation
+				continue
+			}
+			if len(rules.AllowedSchemes) > 0 && !contains(rules.AllowedSchemes, u.Scheme) {
+				errs = append(errs, field.NotSupported(p.Index(i), u.Scheme, rules.AllowedSchemes))
+			}
+			if len(rules.AllowedHosts) > 0 && !matchesHost(rules.AllowedHosts, u.Hostname()) {
+				errs = append(errs, field.Forbidden(p.Index(i), detail(fmt.Sprintf("host %s is not allowed, must match one of %s", u.Hostname(), strings.Join(rules.AllowedHosts, ", ")))))
+			}
+		}
+	}
+
+	if rules := in.Spec.PublicClients; dc.Spec.Public && rules != nil && rules.AllowedNamespaces != nil {
+		ok, err := rules.AllowedNamespaces.Matches(ns)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			errs = append(errs, field.Forbidden(spec.Child("public"), detail(fmt.Sprintf("public clients are not allowed in namespace %s", dc.Namespace))))
+		}
+	}
+
+	if max := in.Spec.MaxClientsPerNamespace; max != nil && earlier >= int(*max) {
+		errs = append(errs, field.Forbidden(spec, detail(fmt.Sprintf("namespace %s cannot register more than %d clients", dc.Namespace, *max))))
+	}
+
+	return errs, nil
+}
+
+// matchesHost checks host against a list of patterns, where a leading "*." matches any subdomain
+func matchesHost(patterns []string, host string) bool {
+	for _, p := range patterns {
+		if p == host {
+			return true
+		}
+		if strings.HasPrefix(p, "*.") && strings.HasSuffix(host, p[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+func init() {
+	SchemeBuilder.Register(&DexClientPolicy{}, &DexClientPolicyList{})
+}
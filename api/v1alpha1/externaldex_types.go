@@ -0,0 +1,122 @@
+/*
+Copyright 2021 © MIKAMAI s.r.l
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// ExternalDexSpec defines how to reach a Dex server that is not managed by the operator
+type ExternalDexSpec struct {
+	// Address is the host:port of the Dex gRPC API
+	// +kubebuilder:validation:MinLength=1
+	Address string `json:"address"`
+
+	// IssuerURL is the public URL of the Dex server, written to the Secrets of the clients registered on it
+	// +kubebuilder:validation:MinLength=1
+	IssuerURL string `json:"issuerURL"`
+
+	// TLS configures the connection to the gRPC API. Plaintext is used if omitted
+	// +optional
+	TLS *ExternalDexTLS `json:"tls,omitempty"`
+}
+
+// ExternalDexTLS references the certificates used to connect to the gRPC API of an external Dex server
+type ExternalDexTLS struct {
+	// SecretName is the name of a Secret in the same namespace. The optional ca.crt key holds the CA used
+	// to verify the server, defaulting to the system roots, while the optional tls.crt and tls.key keys
+	// hold the client certificate used for mutual TLS
+	SecretName string `json:"secretName"`
+
+	// ServerName overrides the name used to verify the server certificate, defaulting to the host of the address
+	// +optional
+	ServerName string `json:"serverName,omitempty"`
+}
+
+// ExternalDexStatus defines the observed state of ExternalDex
+type ExternalDexStatus struct {
+	// Phase is the current phase of the operator.
+	Phase StatusPhase `json:"phase"`
+	// Message is a human-readable message indicating details about current operator phase or error.
+	Message string `json:"message"`
+	// Ready will be true if the gRPC API is reachable and its version is supported.
+	Ready bool `json:"ready"`
+	// ServerVersion is the version reported by the Dex server
+	// +optional
+	ServerVersion string `json:"serverVersion,omitempty"`
+	// APIVersion is the version of the gRPC API reported by the Dex server
+	// +optional
+	APIVersion int32 `json:"apiVersion,omitempty"`
+	// Reason is the class of the last health check failure, if any.
+	// +optional
+	Reason StatusReason `json:"reason,omitempty"`
+	// ObservedGeneration is the most recent generation observed by the operator.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// LastCheckTime is the time of the last health check
+	// +optional
+	LastCheckTime *metav1.Time `json:"lastCheckTime,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:path=externaldexes
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Address",type=string,JSONPath=`.spec.address`
+// +kubebuilder:printcolumn:name="URL",type=string,JSONPath=`.spec.issuerURL`
+// +kubebuilder:printcolumn:name="Version",type=string,JSONPath=`.status.serverVersion`
+// +kubebuilder:printcolumn:name="Ready",type=boolean,JSONPath=`.status.ready`
+// +kubebuilder:printcolumn:name="Message",type=string,JSONPath=`.status.message`,priority=1
+// +kubebuilder:printcolumn:name="Reason",type=string,JSONPath=`.status.reason`,priority=1
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// ExternalDex is the Schema for the externaldexes API
+type ExternalDex struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ExternalDexSpec   `json:"spec,omitempty"`
+	Status ExternalDexStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// ExternalDexList contains a list of ExternalDex
+type ExternalDexList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ExternalDex `json:"items"`
+}
+
+func (in *ExternalDex) NamespacedName() types.NamespacedName {
+	return types.NamespacedName{
+		Name:      in.Name,
+		Namespace: in.Namespace,
+	}
+}
+
+// InstanceKey returns the key identifying the instance in the status of the DexClients registered on it
+func (in *ExternalDex) InstanceKey() InstanceKey {
+	return InstanceKey{
+		Kind:           KindExternalDex,
+		NamespacedName: in.NamespacedName(),
+	}
+}
+
+func init() {
+	SchemeBuilder.Register(&ExternalDex{}, &ExternalDexList{})
+}
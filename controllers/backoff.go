@@ -0,0 +1,69 @@
+/*
+Copyright 2021 © MIKAMAI s.r.l
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const backoffJitter = 0.2
+
+// backoff tracks consecutive failures per object and computes
+// exponentially increasing, jittered requeue delays
+type backoff struct {
+	base     time.Duration
+	max      time.Duration
+	mu       sync.Mutex
+	failures map[types.NamespacedName]int
+}
+
+func newBackoff(base, max time.Duration) *backoff {
+	return &backoff{
+		base:     base,
+		max:      max,
+		failures: make(map[types.NamespacedName]int),
+	}
+}
+
+// Next records a failure for key and returns how long to wait before retrying
+func (b *backoff) Next(key types.NamespacedName) time.Duration {
+	b.mu.Lock()
+	n := b.failures[key]
+	b.failures[key] = n + 1
+	b.mu.Unlock()
+
+	d := b.base
+	for i := 0; i < n && d < b.max; i++ {
+		d *= 2
+	}
+	if d > b.max {
+		d = b.max
+	}
+
+	return wait.Jitter(d, backoffJitter)
+}
+
+// Reset forgets all failures recorded for key
+func (b *backoff) Reset(key types.NamespacedName) {
+	b.mu.Lock()
+	delete(b.failures, key)
+	b.mu.Unlock()
+}
@@ -18,16 +18,28 @@ package controllers
 
 import (
 	"context"
+	"fmt"
 	"github.com/karavel-io/dex-operator/dex"
+	"github.com/karavel-io/dex-operator/metrics"
 	"github.com/pkg/errors"
 	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2beta2 "k8s.io/api/autoscaling/v2beta2"
 	v1 "k8s.io/api/core/v1"
 	networkingv1 "k8s.io/api/networking/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
 	rbacv1 "k8s.io/api/rbac/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
 	kuberrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 	"time"
 
 	"github.com/go-logr/logr"
@@ -38,8 +50,14 @@ import (
 	dexv1alpha1 "github.com/karavel-io/dex-operator/api/v1alpha1"
 )
 
+// instanceFinalizer guards the cleanup of the cluster-scoped objects of a Dex instance,
+// which cannot be garbage collected through owner references
+const instanceFinalizer = "instances.finalizers.dex.karavel.io"
+
 var (
 	requeueAfterError = 30 * time.Second
+	backoffBase       = 2 * time.Second
+	backoffMax        = 5 * time.Minute
 )
 
 // DexReconciler reconciles a Dex object
@@ -49,17 +67,35 @@ type DexReconciler struct {
 	Scheme       *runtime.Scheme
 	Recorder     record.EventRecorder
 	DefaultImage string
+	// OperatorNamespace is the namespace the operator runs in, used to allow its traffic in NetworkPolicies
+	OperatorNamespace string
+	// OperatorLabels are the labels of the operator pods, used to allow their traffic in NetworkPolicies
+	OperatorLabels map[string]string
+	// NamespaceLabel is the namespace label holding its name, matched by NetworkPolicies. Defaults to dex.NamespaceNameLabel
+	NamespaceLabel string
+	// RBACScope defines how instances are granted access to their storage. Defaults to dex.RBACScopeCluster
+	RBACScope dex.RBACScope
+	// WatchNamespaces restricts the operator to the given namespaces. Empty means all namespaces
+	WatchNamespaces []string
+
+	backoff   *backoff
+	apiReader client.Reader
 }
 
 // +kubebuilder:rbac:groups=dex.karavel.io,resources=dexes,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=dex.karavel.io,resources=dexes/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=dex.karavel.io,resources=dexes/finalizers,verbs=update
 // +kubebuilder:rbac:groups="",resources=events;configmaps;serviceaccounts;services,verbs=get;list;watch;create;update;patch
+// +kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list
 // +kubebuilder:rbac:groups=apps,resources=deployments,verbs=get;list;watch;create;update;patch
-// +kubebuilder:rbac:groups=networking.k8s.io,resources=ingresses,verbs=get;list;watch;create;update;patch;delete
-// +kubebuilder:rbac:groups=rbac.authorization.k8s.io,resources=clusterroles;clusterrolebindings,verbs=get;list;watch;create;update;patch
+// +kubebuilder:rbac:groups=networking.k8s.io,resources=ingresses;networkpolicies,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=policy,resources=poddisruptionbudgets,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=autoscaling,resources=horizontalpodautoscalers,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=rbac.authorization.k8s.io,resources=clusterroles;clusterrolebindings;roles;rolebindings,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=dex.coreos.com,resources=*,verbs=*
-// +kubebuilder:rbac:groups=apiextensions.k8s.io,resources=customresourcedefinitions,verbs=create
+// +kubebuilder:rbac:groups=apiextensions.k8s.io,resources=customresourcedefinitions,verbs=get;list;watch;create;update;patch
+// +kubebuilder:rbac:groups=gateway.networking.k8s.io,resources=httproutes;backendtlspolicies,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=monitoring.coreos.com,resources=servicemonitors;prometheusrules,verbs=get;list;watch;create;update;patch;delete
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -72,9 +108,30 @@ func (r *DexReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.R
 	log.Info("Reconciling Dex resource")
 	var d dexv1alpha1.Dex
 	if err := r.Get(ctx, req.NamespacedName, &d); err != nil {
+		if kuberrors.IsNotFound(err) {
+			metrics.DeleteInstance(req.NamespacedName.String())
+			r.backoff.Reset(req.NamespacedName)
+		}
 		return ctrl.Result{}, client.IgnoreNotFound(err)
 	}
 
+	if !d.ObjectMeta.DeletionTimestamp.IsZero() {
+		return r.finalize(ctx, log, &d)
+	}
+
+	if !controllerutil.ContainsFinalizer(&d, instanceFinalizer) {
+		log.Info("Adding finalizer")
+		controllerutil.AddFinalizer(&d, instanceFinalizer)
+		if err := r.Update(ctx, &d); err != nil {
+			return r.ManageError(ctx, &d, err)
+		}
+	}
+
+	if d.Status.Reason == dexv1alpha1.ReasonPermanentError && d.Status.ObservedGeneration == d.Generation {
+		log.Info("Skipping reconciliation until the spec changes", "message", d.Status.Message)
+		return ctrl.Result{}, nil
+	}
+
 	first := d.Status.Phase == dexv1alpha1.NoPhase
 	if first {
 		d.Status.Phase = dexv1alpha1.PhaseInitialising
@@ -82,6 +139,7 @@ func (r *DexReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.R
 		if err := r.Client.Status().Update(ctx, &d); err != nil {
 			return r.ManageError(ctx, &d, err)
 		}
+		metrics.SetInstancePhase(d.NamespacedName().String(), d.Status.Phase)
 		r.Recorder.Eventf(&d, v1.EventTypeNormal, "Creating", "Creating resources")
 	}
 
@@ -91,7 +149,7 @@ func (r *DexReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.R
 
 	cm, err := dex.ConfigMap(&d)
 	if err != nil {
-		return ctrl.Result{RequeueAfter: requeueAfterError}, err
+		return r.ManageError(ctx, &d, Permanent(errors.Wrap(err, "failed to render Dex configuration")))
 	}
 	cmo := new(v1.ConfigMap)
 	cmo.Name = cm.Name
@@ -121,33 +179,8 @@ func (r *DexReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.R
 		return r.ManageError(ctx, &d, errors.Wrap(err, "failed to reconcile ServiceAccount"))
 	}
 
-	cr := dex.ClusterRole()
-	cro := new(rbacv1.ClusterRole)
-	cro.Name = cr.Name
-	log.Info("Reconciling ClusterRole", "name", cro.Name)
-	_, err = ctrl.CreateOrUpdate(ctx, r.Client, cro, func() error {
-		cro.Annotations = cr.Annotations
-		cro.Labels = cr.Labels
-		cro.Rules = cr.Rules
-		return nil
-	})
-	if err != nil {
-		return r.ManageError(ctx, &d, errors.Wrap(err, "failed to reconcile ClusterRole"))
-	}
-
-	crb := dex.ClusterRoleBinding(&d, &sa, &cr)
-	crbo := new(rbacv1.ClusterRoleBinding)
-	crbo.Name = crb.Name
-	log.Info("Reconciling ClusterRoleBinding", "name", crbo.Name)
-	_, err = ctrl.CreateOrUpdate(ctx, r.Client, crbo, func() error {
-		crbo.Annotations = crb.Annotations
-		crbo.Labels = crb.Labels
-		crbo.Subjects = crb.Subjects
-		crbo.RoleRef = crb.RoleRef
-		return nil
-	})
-	if err != nil {
-		return r.ManageError(ctx, &d, errors.Wrap(err, "failed to reconcile ClusterRoleBinding"))
+	if err := r.reconcileRBAC(ctx, log, &d, &sa); err != nil {
+		return r.ManageError(ctx, &d, err)
 	}
 
 	dep := dex.Deployment(&d, &cm, &sa)
@@ -161,7 +194,10 @@ func (r *DexReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.R
 			depo.Spec.Selector = dep.Spec.Selector
 			depo.Spec.Template.Labels = dep.Spec.Template.Labels
 		}
-		depo.Spec.Replicas = dep.Spec.Replicas
+		// the HorizontalPodAutoscaler owns the number of replicas when autoscaling is enabled
+		if !d.Spec.Autoscaling.Enabled || depo.Spec.Replicas == nil {
+			depo.Spec.Replicas = dep.Spec.Replicas
+		}
 		depo.Spec.Template = dep.Spec.Template
 		return controllerutil.SetControllerReference(&d, depo, r.Scheme)
 	})
@@ -176,6 +212,46 @@ func (r *DexReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.R
 	d.Status.Selector = sel.String()
 	d.Status.Replicas = *depo.Spec.Replicas
 
+	pdb := dex.PodDisruptionBudget(&d)
+	pdbo := new(policyv1beta1.PodDisruptionBudget)
+	pdbo.Name = pdb.Name
+	pdbo.Namespace = pdb.Namespace
+	if d.Spec.PodDisruptionBudget.Enabled {
+		_, err = ctrl.CreateOrUpdate(ctx, r.Client, pdbo, func() error {
+			log.Info("Reconciling PodDisruptionBudget", "name", pdbo.Name, "namespace", pdbo.Namespace, "version", pdbo.ResourceVersion)
+			pdbo.Labels = pdb.Labels
+			pdbo.Spec = pdb.Spec
+			return controllerutil.SetControllerReference(&d, pdbo, r.Scheme)
+		})
+		if err != nil {
+			return r.ManageError(ctx, &d, errors.Wrap(err, "failed to reconcile PodDisruptionBudget"))
+		}
+	} else {
+		if err := r.removeOwned(ctx, log, &d, pdbo, "PodDisruptionBudget"); err != nil {
+			return r.ManageError(ctx, &d, err)
+		}
+	}
+
+	hpa := dex.HorizontalPodAutoscaler(&d, depo)
+	hpao := new(autoscalingv2beta2.HorizontalPodAutoscaler)
+	hpao.Name = hpa.Name
+	hpao.Namespace = hpa.Namespace
+	if d.Spec.Autoscaling.Enabled {
+		_, err = ctrl.CreateOrUpdate(ctx, r.Client, hpao, func() error {
+			log.Info("Reconciling HorizontalPodAutoscaler", "name", hpao.Name, "namespace", hpao.Namespace, "version", hpao.ResourceVersion)
+			hpao.Labels = hpa.Labels
+			hpao.Spec = hpa.Spec
+			return controllerutil.SetControllerReference(&d, hpao, r.Scheme)
+		})
+		if err != nil {
+			return r.ManageError(ctx, &d, errors.Wrap(err, "failed to reconcile HorizontalPodAutoscaler"))
+		}
+	} else {
+		if err := r.removeOwned(ctx, log, &d, hpao, "HorizontalPodAutoscaler"); err != nil {
+			return r.ManageError(ctx, &d, err)
+		}
+	}
+
 	svc, host := dex.Service(&d)
 	d.Status.EndpointURL = host
 	svco := new(v1.Service)
@@ -184,17 +260,41 @@ func (r *DexReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.R
 	_, err = ctrl.CreateOrUpdate(ctx, r.Client, svco, func() error {
 		log.Info("Reconciling Service", "name", svco.Name, "namespace", svco.Namespace, "version", svco.ResourceVersion)
 		svco.Labels = svc.Labels
+		svco.Annotations = svc.Annotations
 		if svco.CreationTimestamp.IsZero() {
 			svco.Spec.Selector = svc.Spec.Selector
 		}
-		svco.Spec.Type = svc.Spec.Type
-		svco.Spec.Ports = svc.Spec.Ports
+		mutateServiceExposure(svco, &svc)
 		return controllerutil.SetControllerReference(&d, svco, r.Scheme)
 	})
 	if err != nil {
 		return r.ManageError(ctx, &d, errors.Wrap(err, "failed to reconcile Service"))
 	}
 
+	wsvc := dex.WebService(&d)
+	wsvco := new(v1.Service)
+	wsvco.Name = wsvc.Name
+	wsvco.Namespace = wsvc.Namespace
+	if d.Spec.Service.SeparateWeb {
+		_, err = ctrl.CreateOrUpdate(ctx, r.Client, wsvco, func() error {
+			log.Info("Reconciling web Service", "name", wsvco.Name, "namespace", wsvco.Namespace, "version", wsvco.ResourceVersion)
+			wsvco.Labels = wsvc.Labels
+			wsvco.Annotations = wsvc.Annotations
+			if wsvco.CreationTimestamp.IsZero() {
+				wsvco.Spec.Selector = wsvc.Spec.Selector
+			}
+			mutateServiceExposure(wsvco, &wsvc)
+			return controllerutil.SetControllerReference(&d, wsvco, r.Scheme)
+		})
+		if err != nil {
+			return r.ManageError(ctx, &d, errors.Wrap(err, "failed to reconcile web Service"))
+		}
+	} else {
+		if err := r.removeOwned(ctx, log, &d, wsvco, "web Service"); err != nil {
+			return r.ManageError(ctx, &d, err)
+		}
+	}
+
 	msvc := dex.MetricsService(&d)
 	msvco := new(v1.Service)
 	msvco.Name = msvc.Name
@@ -213,14 +313,20 @@ func (r *DexReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.R
 		return r.ManageError(ctx, &d, errors.Wrap(err, "failed to reconcile metrics Service"))
 	}
 
-	ing, err := dex.Ingress(&d)
+	ings, err := dex.Ingress(&d)
 	if err != nil {
-		return r.ManageError(ctx, &d, err)
+		return r.ManageError(ctx, &d, Permanent(err))
 	}
-	ingo := new(networkingv1.Ingress)
-	ingo.Name = ing.Name
-	ingo.Namespace = ing.Namespace
-	if *d.Spec.Ingress.Enabled {
+	if !*d.Spec.Ingress.Enabled {
+		ings = nil
+	}
+	keep := make(map[string]bool)
+	for i := range ings {
+		ing := &ings[i]
+		keep[ing.Name] = true
+		ingo := new(networkingv1.Ingress)
+		ingo.Name = ing.Name
+		ingo.Namespace = ing.Namespace
 		_, err = ctrl.CreateOrUpdate(ctx, r.Client, ingo, func() error {
 			log.Info("Reconciling Ingress", "name", ingo.Name, "namespace", ingo.Namespace, "version", ingo.ResourceVersion)
 			ingo.Labels = ing.Labels
@@ -231,14 +337,68 @@ func (r *DexReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.R
 		if err != nil {
 			return r.ManageError(ctx, &d, errors.Wrap(err, "failed to reconcile Ingress"))
 		}
+	}
+	if err := r.removeStaleIngresses(ctx, log, &d, keep); err != nil {
+		return r.ManageError(ctx, &d, err)
+	}
+
+	route, err := dex.HTTPRoute(&d)
+	if err != nil {
+		return r.ManageError(ctx, &d, Permanent(err))
+	}
+	routeo, err := r.reconcileOptional(ctx, log, &d, &route, d.Spec.Gateway.Enabled)
+	if err != nil {
+		return r.ManageError(ctx, &d, err)
+	}
+	if routeo != nil {
+		cond := dex.HTTPRouteAccepted(routeo)
+		cond.ObservedGeneration = d.Generation
+		meta.SetStatusCondition(&d.Status.Conditions, cond)
+	} else {
+		meta.RemoveStatusCondition(&d.Status.Conditions, string(dexv1alpha1.DexConditionRouteAccepted))
+	}
+
+	btp := dex.BackendTLSPolicy(&d)
+	if _, err := r.reconcileOptional(ctx, log, &d, &btp, d.Spec.Gateway.Enabled && d.Spec.Gateway.BackendTLS != nil); err != nil {
+		return r.ManageError(ctx, &d, err)
+	}
 
+	np := dex.NetworkPolicy(&d, r.OperatorNamespace, r.OperatorLabels, r.NamespaceLabel)
+	npo := new(networkingv1.NetworkPolicy)
+	npo.Name = np.Name
+	npo.Namespace = np.Namespace
+	if d.Spec.NetworkPolicy.Enabled {
+		if err := r.checkNamespaceLabels(ctx, &d); err != nil {
+			return r.ManageError(ctx, &d, err)
+		}
+		_, err = ctrl.CreateOrUpdate(ctx, r.Client, npo, func() error {
+			log.Info("Reconciling NetworkPolicy", "name", npo.Name, "namespace", npo.Namespace, "version", npo.ResourceVersion)
+			npo.Labels = np.Labels
+			npo.Spec = np.Spec
+			return controllerutil.SetControllerReference(&d, npo, r.Scheme)
+		})
+		if err != nil {
+			return r.ManageError(ctx, &d, errors.Wrap(err, "failed to reconcile NetworkPolicy"))
+		}
 	} else {
-		log.Info("Removing Ingress", "name", ingo.Name, "namespace", ingo.Namespace, "version", ingo.ResourceVersion)
-		if err := r.Client.Delete(ctx, ingo); err != nil && !kuberrors.IsNotFound(err) {
+		if err := r.removeOwned(ctx, log, &d, npo, "NetworkPolicy"); err != nil {
 			return r.ManageError(ctx, &d, err)
 		}
 	}
 
+	sm, err := dex.ServiceMonitor(&d)
+	if err != nil {
+		return r.ManageError(ctx, &d, Permanent(err))
+	}
+	if _, err := r.reconcileOptional(ctx, log, &d, &sm, d.Spec.Monitoring.ServiceMonitor.Enabled); err != nil {
+		return r.ManageError(ctx, &d, err)
+	}
+
+	pr := dex.PrometheusRule(&d)
+	if _, err := r.reconcileOptional(ctx, log, &d, &pr, d.Spec.Monitoring.PrometheusRule.Enabled); err != nil {
+		return r.ManageError(ctx, &d, err)
+	}
+
 	if first {
 		r.Recorder.Event(&d, v1.EventTypeNormal, "Created", "Creating resources")
 	}
@@ -246,41 +406,562 @@ func (r *DexReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.R
 	return r.ManageSuccess(ctx, &d)
 }
 
+// reconcileRBAC grants the Dex ServiceAccount access to the storage custom resources, either cluster-wide
+// or in the instance namespace only depending on the RBAC scope, and removes the grants of the other scope
+func (r *DexReconciler) reconcileRBAC(ctx context.Context, log logr.Logger, d *dexv1alpha1.Dex, sa *v1.ServiceAccount) error {
+	if r.RBACScope == dex.RBACScopeNamespace {
+		role := dex.Role(d)
+		roleo := new(rbacv1.Role)
+		roleo.Name = role.Name
+		roleo.Namespace = role.Namespace
+		log.Info("Reconciling Role", "name", roleo.Name, "namespace", roleo.Namespace)
+		_, err := ctrl.CreateOrUpdate(ctx, r.Client, roleo, func() error {
+			roleo.Labels = role.Labels
+			roleo.Rules = role.Rules
+			return controllerutil.SetControllerReference(d, roleo, r.Scheme)
+		})
+		if err != nil {
+			return errors.Wrap(err, "failed to reconcile Role")
+		}
+
+		rb := dex.RoleBinding(d, sa, &role)
+		rbo := new(rbacv1.RoleBinding)
+		rbo.Name = rb.Name
+		rbo.Namespace = rb.Namespace
+		log.Info("Reconciling RoleBinding", "name", rbo.Name, "namespace", rbo.Namespace)
+		_, err = ctrl.CreateOrUpdate(ctx, r.Client, rbo, func() error {
+			rbo.Labels = rb.Labels
+			rbo.Subjects = rb.Subjects
+			// the role reference is immutable, so it is only set on creation
+			if rbo.CreationTimestamp.IsZero() {
+				rbo.RoleRef = rb.RoleRef
+			}
+			return controllerutil.SetControllerReference(d, rbo, r.Scheme)
+		})
+		if err != nil {
+			return errors.Wrap(err, "failed to reconcile RoleBinding")
+		}
+
+		// the operator may not be allowed to touch cluster-scoped objects when restricted to a set of namespaces
+		if !r.clusterWide() {
+			return nil
+		}
+
+		crbo := new(rbacv1.ClusterRoleBinding)
+		crbo.Name = dex.ClusterRoleBindingName(d)
+		if err := r.Client.Delete(ctx, crbo); err == nil {
+			log.Info("Removed ClusterRoleBinding", "name", crbo.Name)
+		} else if !kuberrors.IsNotFound(err) {
+			return errors.Wrap(err, "failed to remove ClusterRoleBinding")
+		}
+		return r.removeLegacyClusterRoleBinding(ctx, log, d)
+	}
+
+	cr := dex.ClusterRole()
+	cro := new(rbacv1.ClusterRole)
+	cro.Name = cr.Name
+	log.Info("Reconciling ClusterRole", "name", cro.Name)
+	_, err := ctrl.CreateOrUpdate(ctx, r.Client, cro, func() error {
+		cro.Annotations = cr.Annotations
+		cro.Labels = cr.Labels
+		cro.Rules = cr.Rules
+		return nil
+	})
+	if kuberrors.IsNotFound(err) {
+		// removed by the deletion of the last other instance, and still in the cache
+		err = r.Client.Create(ctx, &cr)
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to reconcile ClusterRole")
+	}
+
+	crb := dex.ClusterRoleBinding(d, sa, &cr)
+	crbo := new(rbacv1.ClusterRoleBinding)
+	crbo.Name = crb.Name
+	log.Info("Reconciling ClusterRoleBinding", "name", crbo.Name)
+	_, err = ctrl.CreateOrUpdate(ctx, r.Client, crbo, func() error {
+		crbo.Annotations = crb.Annotations
+		crbo.Labels = crb.Labels
+		crbo.Subjects = crb.Subjects
+		crbo.RoleRef = crb.RoleRef
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to reconcile ClusterRoleBinding")
+	}
+	if err := r.removeLegacyClusterRoleBinding(ctx, log, d); err != nil {
+		return err
+	}
+
+	role := dex.Role(d)
+	for _, o := range []client.Object{&rbacv1.RoleBinding{}, &rbacv1.Role{}} {
+		o.SetName(role.Name)
+		o.SetNamespace(role.Namespace)
+		if err := r.Client.Delete(ctx, o); err != nil && !kuberrors.IsNotFound(err) {
+			return errors.Wrap(err, "failed to remove namespaced RBAC")
+		}
+	}
+	return nil
+}
+
+// installStorageCRDs creates or updates the CRDs backing the Dex kubernetes storage,
+// as instances are not allowed to register them in the namespaced RBAC scope
+func (r *DexReconciler) installStorageCRDs(ctx context.Context) error {
+	// CRDs are read bypassing the cache, which cannot hold cluster-scoped objects when restricted to a set of namespaces
+	for _, crd := range dex.StorageCRDs() {
+		crd := crd
+		r.Log.Info("Installing Dex storage CRD", "name", crd.Name)
+		crdo := new(apiextensionsv1.CustomResourceDefinition)
+		err := r.apiReader.Get(ctx, client.ObjectKey{Name: crd.Name}, crdo)
+		switch {
+		case kuberrors.IsNotFound(err):
+			err = r.Client.Create(ctx, &crd)
+		case err == nil:
+			crdo.Spec = crd.Spec
+			err = r.Client.Update(ctx, crdo)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "failed to install Dex storage CRD %s", crd.Name)
+		}
+	}
+	return nil
+}
+
+// finalize applies the deletion policy to the DexClients referencing a Dex instance being deleted,
+// removes its cluster-scoped objects, including the shared ClusterRole if no other instance is left,
+// and then releases the finalizer
+func (r *DexReconciler) finalize(ctx context.Context, log logr.Logger, d *dexv1alpha1.Dex) (ctrl.Result, error) {
+	if !controllerutil.ContainsFinalizer(d, instanceFinalizer) {
+		return ctrl.Result{}, nil
+	}
+
+	done, err := r.applyDeletionPolicy(ctx, log, d)
+	if err != nil {
+		return r.ManageError(ctx, d, err)
+	}
+	if !done {
+		return ctrl.Result{RequeueAfter: r.backoff.Next(d.NamespacedName())}, nil
+	}
+
+	if r.clusterWide() {
+		if err := r.removeClusterObjects(ctx, log, d); err != nil {
+			return r.ManageError(ctx, d, err)
+		}
+	}
+
+	log.Info("Removing finalizer")
+	controllerutil.RemoveFinalizer(d, instanceFinalizer)
+	if err := r.Update(ctx, d); err != nil {
+		return r.ManageError(ctx, d, err)
+	}
+	metrics.DeleteInstance(d.NamespacedName().String())
+	r.backoff.Reset(d.NamespacedName())
+	return ctrl.Result{}, nil
+}
+
+// removeClusterObjects deletes the ClusterRoleBinding of a Dex instance, and the shared ClusterRole
+// if no other instance is left
+func (r *DexReconciler) removeClusterObjects(ctx context.Context, log logr.Logger, d *dexv1alpha1.Dex) error {
+	crbo := new(rbacv1.ClusterRoleBinding)
+	crbo.Name = dex.ClusterRoleBindingName(d)
+	log.Info("Removing ClusterRoleBinding", "name", crbo.Name)
+	if err := r.Client.Delete(ctx, crbo); err != nil && !kuberrors.IsNotFound(err) {
+		return errors.Wrap(err, "failed to remove ClusterRoleBinding")
+	}
+	if err := r.removeLegacyClusterRoleBinding(ctx, log, d); err != nil {
+		return err
+	}
+
+	// the cache may not have seen instances created in the meantime yet, which would lose their ClusterRole
+	var list dexv1alpha1.DexList
+	if err := r.apiReader.List(ctx, &list); err != nil {
+		return err
+	}
+	last := true
+	for _, o := range list.Items {
+		if o.UID != d.UID && o.ObjectMeta.DeletionTimestamp.IsZero() {
+			last = false
+			break
+		}
+	}
+	if last {
+		cro := new(rbacv1.ClusterRole)
+		cro.Name = dex.ClusterRoleName
+		log.Info("Removing ClusterRole, no Dex instance left", "name", cro.Name)
+		if err := r.Client.Delete(ctx, cro); err != nil && !kuberrors.IsNotFound(err) {
+			return errors.Wrap(err, "failed to remove ClusterRole")
+		}
+	}
+
+	return nil
+}
+
+// applyDeletionPolicy handles the DexClients referencing d according to its deletion policy.
+// It returns false if the instance deletion must wait for the clients to go away.
+func (r *DexReconciler) applyDeletionPolicy(ctx context.Context, log logr.Logger, d *dexv1alpha1.Dex) (bool, error) {
+	var list dexv1alpha1.DexClientList
+	if err := r.Client.List(ctx, &list); err != nil {
+		return false, err
+	}
+	clients := make([]*dexv1alpha1.DexClient, 0)
+	for i := range list.Items {
+		if dc := &list.Items[i]; dc.References(d) {
+			clients = append(clients, dc)
+		}
+	}
+	if len(clients) == 0 {
+		return true, nil
+	}
+
+	switch d.Spec.DeletionPolicy {
+	case dexv1alpha1.DeletionPolicyBlock:
+		log.Info("Deletion blocked by referencing DexClients", "clients", len(clients))
+		r.Recorder.Eventf(d, v1.EventTypeWarning, "DeletionBlocked", "Waiting for %d DexClients referencing the instance to be deleted", len(clients))
+		return false, nil
+	case dexv1alpha1.DeletionPolicyCascade:
+		waiting := 0
+		for _, dc := range clients {
+			if !dc.ObjectMeta.DeletionTimestamp.IsZero() {
+				waiting++
+				continue
+			}
+			// clients targeting other instances as well are only removed from this one
+			if dc.Spec.InstanceSelector != nil || len(dc.InstanceRefs()) > 1 {
+				if err := r.deregisterClient(ctx, log, d, dc); err != nil {
+					return false, err
+				}
+				continue
+			}
+			log.Info("Deleting referencing DexClient", "dexclient", dc.NamespacedName())
+			if err := r.Client.Delete(ctx, dc); err != nil && !kuberrors.IsNotFound(err) {
+				return false, errors.Wrapf(err, "failed to delete DexClient %s", dc.NamespacedName())
+			}
+			waiting++
+		}
+		if waiting == 0 {
+			return true, nil
+		}
+		// the clients are removed from Dex by their finalizers, so the instance must stay up until they are gone
+		log.Info("Waiting for referencing DexClients to be deleted", "clients", waiting)
+		return false, nil
+	default:
+		for _, dc := range clients {
+			markInstanceMissing(dc, d.InstanceKey())
+			if err := r.Client.Status().Update(ctx, dc); err != nil && !kuberrors.IsNotFound(err) {
+				return false, errors.Wrapf(err, "failed to update DexClient %s", dc.NamespacedName())
+			}
+			r.Recorder.Eventf(dc, v1.EventTypeWarning, string(dexv1alpha1.ReasonInstanceMissing), "Dex instance %s has been deleted", d.NamespacedName())
+		}
+		return true, nil
+	}
+}
+
+// deregisterClient removes dc from the Dex instance d being deleted, leaving it registered on its other instances.
+// The remote cleanup is skipped if the instance is not ready, as it is going away anyway
+func (r *DexReconciler) deregisterClient(ctx context.Context, log logr.Logger, d *dexv1alpha1.Dex, dc *dexv1alpha1.DexClient) error {
+	k := d.InstanceKey()
+	if st := dc.Status.Instance(k); st == nil || !st.Registered {
+		return nil
+	}
+
+	log.Info("Removing referencing DexClient from the instance", "dexclient", dc.NamespacedName())
+	if d.Status.Ready {
+		op, err := dex.DeleteDexClient(ctx, log, dex.ManagedEndpoint(d), dc)
+		metrics.RecordClientOperation(k.String(), metrics.ActionDelete, string(op), err)
+		if err != nil {
+			return errors.Wrapf(err, "failed to remove DexClient %s from the instance", dc.NamespacedName())
+		}
+		r.Recorder.Eventf(dc, v1.EventTypeNormal, "Deleted", "deleted client from Dex instance %s, which is being deleted", k)
+	} else {
+		r.Recorder.Eventf(dc, v1.EventTypeWarning, "CleanupSkipped", "Dex instance %s is being deleted and is not ready, the client was not removed from it", k)
+	}
+
+	dc.Status.RemoveInstance(k)
+	if err := r.Client.Status().Update(ctx, dc); err != nil && !kuberrors.IsNotFound(err) {
+		return errors.Wrapf(err, "failed to update DexClient %s", dc.NamespacedName())
+	}
+	return nil
+}
+
+// removeLegacyClusterRoleBinding deletes the ClusterRoleBinding named after the instance alone,
+// which older versions of the operator shared between same-named instances in different namespaces
+func (r *DexReconciler) removeLegacyClusterRoleBinding(ctx context.Context, log logr.Logger, d *dexv1alpha1.Dex) error {
+	crbo := new(rbacv1.ClusterRoleBinding)
+	if err := r.Client.Get(ctx, client.ObjectKey{Name: d.Name}, crbo); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	if crbo.RoleRef.Kind != "ClusterRole" || crbo.RoleRef.Name != dex.ClusterRoleName {
+		return nil
+	}
+
+	log.Info("Removing legacy ClusterRoleBinding", "name", crbo.Name)
+	if err := r.Client.Delete(ctx, crbo); err != nil && !kuberrors.IsNotFound(err) {
+		return errors.Wrap(err, "failed to remove legacy ClusterRoleBinding")
+	}
+	return nil
+}
+
+// mutateServiceExposure applies the desired type and ports to svc, keeping the node ports
+// already allocated by the cluster so that they don't change at every reconciliation
+func mutateServiceExposure(svc *v1.Service, desired *v1.Service) {
+	nodePorts := make(map[string]int32)
+	for _, p := range svc.Spec.Ports {
+		nodePorts[p.Name] = p.NodePort
+	}
+
+	ports := make([]v1.ServicePort, len(desired.Spec.Ports))
+	for i, p := range desired.Spec.Ports {
+		if desired.Spec.Type != v1.ServiceTypeClusterIP {
+			p.NodePort = nodePorts[p.Name]
+		}
+		ports[i] = p
+	}
+
+	svc.Spec.Type = desired.Spec.Type
+	svc.Spec.Ports = ports
+	svc.Spec.ExternalTrafficPolicy = desired.Spec.ExternalTrafficPolicy
+	svc.Spec.LoadBalancerSourceRanges = desired.Spec.LoadBalancerSourceRanges
+}
+
+// removeStaleIngresses deletes the Ingress objects owned by d that are not listed in keep
+func (r *DexReconciler) removeStaleIngresses(ctx context.Context, log logr.Logger, d *dexv1alpha1.Dex, keep map[string]bool) error {
+	var list networkingv1.IngressList
+	if err := r.Client.List(ctx, &list, client.InNamespace(d.Namespace), client.MatchingLabels{dex.InstanceMarkerLabel: d.Name}); err != nil {
+		return err
+	}
+
+	for i := range list.Items {
+		ing := &list.Items[i]
+		if keep[ing.Name] || !metav1.IsControlledBy(ing, d) {
+			continue
+		}
+		log.Info("Removing Ingress", "name", ing.Name, "namespace", ing.Namespace, "version", ing.ResourceVersion)
+		if err := r.Client.Delete(ctx, ing); err != nil && !kuberrors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	// Ingress objects created by older versions of the operator lack the instance label
+	if keep[d.ServiceName()] {
+		return nil
+	}
+	ing := new(networkingv1.Ingress)
+	ing.Name = d.ServiceName()
+	ing.Namespace = d.Namespace
+	return r.removeOwned(ctx, log, d, ing, "Ingress")
+}
+
+// removeOwned deletes obj, identified by its name and namespace, if it exists and is controlled by d.
+// It is called at every reconciliation for disabled features, so missing objects are not logged
+func (r *DexReconciler) removeOwned(ctx context.Context, log logr.Logger, d *dexv1alpha1.Dex, obj client.Object, kind string) error {
+	if err := r.Client.Get(ctx, client.ObjectKeyFromObject(obj), obj); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	if !metav1.IsControlledBy(obj, d) {
+		return nil
+	}
+
+	log.Info("Removing "+kind, "name", obj.GetName(), "namespace", obj.GetNamespace())
+	if err := r.Client.Delete(ctx, obj); err != nil && !kuberrors.IsNotFound(err) {
+		return errors.Wrapf(err, "failed to remove %s", kind)
+	}
+	return nil
+}
+
+// reconcileOptional creates or updates obj if enabled, and removes it otherwise.
+// Nothing is done if the cluster does not serve the object kind, e.g. because its CRD is not installed.
+// The current state of the object is returned if it has been reconciled.
+func (r *DexReconciler) reconcileOptional(ctx context.Context, log logr.Logger, d *dexv1alpha1.Dex, obj *unstructured.Unstructured, enabled bool) (*unstructured.Unstructured, error) {
+	gvk := obj.GroupVersionKind()
+	ok, err := r.hasKind(gvk)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		if enabled {
+			log.Info("Skipping object, its CRD is not installed", "kind", gvk.Kind)
+			r.Recorder.Eventf(d, v1.EventTypeWarning, "MissingCRD", "%s is enabled but its CRD is not installed", gvk.Kind)
+		}
+		return nil, nil
+	}
+
+	o := new(unstructured.Unstructured)
+	o.SetGroupVersionKind(gvk)
+	o.SetName(obj.GetName())
+	o.SetNamespace(obj.GetNamespace())
+	if !enabled {
+		return nil, r.removeOwned(ctx, log, d, o, gvk.Kind)
+	}
+
+	_, err = ctrl.CreateOrUpdate(ctx, r.Client, o, func() error {
+		log.Info("Reconciling "+gvk.Kind, "name", o.GetName(), "namespace", o.GetNamespace(), "version", o.GetResourceVersion())
+		o.SetLabels(obj.GetLabels())
+		o.SetAnnotations(obj.GetAnnotations())
+		o.Object["spec"] = obj.Object["spec"]
+		return controllerutil.SetControllerReference(d, o, r.Scheme)
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to reconcile %s", gvk.Kind)
+	}
+	return o, nil
+}
+
+// hasKind checks whether the API server serves the given kind
+func (r *DexReconciler) hasKind(gvk schema.GroupVersionKind) (bool, error) {
+	_, err := r.Client.RESTMapper().RESTMapping(gvk.GroupKind(), gvk.Version)
+	if meta.IsNoMatchError(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// checkNamespaceLabels verifies that the namespaces allowed by the NetworkPolicy of d carry the label it matches.
+// Clusters older than Kubernetes 1.21 don't set it, and the policy would cut the operator off the gRPC API
+func (r *DexReconciler) checkNamespaceLabels(ctx context.Context, d *dexv1alpha1.Dex) error {
+	label := r.NamespaceLabel
+	if label == "" {
+		label = dex.NamespaceNameLabel
+	}
+	for _, name := range dex.NetworkPolicyNamespaces(d, r.OperatorNamespace) {
+		var ns v1.Namespace
+		if err := r.apiReader.Get(ctx, client.ObjectKey{Name: name}, &ns); err != nil {
+			if kuberrors.IsNotFound(err) {
+				continue
+			}
+			return errors.Wrapf(err, "failed to read namespace %s", name)
+		}
+		if ns.Labels[label] != name {
+			return fmt.Errorf("namespace %s is not labeled %s=%s, which the NetworkPolicy matches; label it or change the label with --namespace-label", name, label, name)
+		}
+	}
+	return nil
+}
+
 // SetupWithManager sets up the controller with the Manager.
 func (r *DexReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
+	r.backoff = newBackoff(backoffBase, backoffMax)
+	r.apiReader = mgr.GetAPIReader()
+	if r.RBACScope == "" {
+		r.RBACScope = dex.RBACScopeCluster
+	}
+	if r.RBACScope == dex.RBACScopeNamespace {
+		if err := mgr.Add(manager.RunnableFunc(r.installStorageCRDs)); err != nil {
+			return err
+		}
+	}
+
+	b := ctrl.NewControllerManagedBy(mgr)
+
+	// HTTPRoutes are watched to report their acceptance, but only if the Gateway API is installed at startup
+	if _, err := mgr.GetRESTMapper().RESTMapping(dex.HTTPRouteGVK.GroupKind(), dex.HTTPRouteGVK.Version); err == nil {
+		route := new(unstructured.Unstructured)
+		route.SetGroupVersionKind(dex.HTTPRouteGVK)
+		b = b.Owns(route)
+	}
+
+	// the monitoring objects are watched to correct drift, but only if the Prometheus operator is installed at startup
+	for _, gvk := range []schema.GroupVersionKind{dex.ServiceMonitorGVK, dex.PrometheusRuleGVK} {
+		if _, err := mgr.GetRESTMapper().RESTMapping(gvk.GroupKind(), gvk.Version); err == nil {
+			obj := new(unstructured.Unstructured)
+			obj.SetGroupVersionKind(gvk)
+			b = b.Owns(obj)
+		}
+	}
+
+	// the ClusterRole is shared and cannot be owned by namespaced instances: all of them restore it if it is removed
+	if r.clusterWide() {
+		b = b.Watches(&source.Kind{Type: &rbacv1.ClusterRole{}}, handler.EnqueueRequestsFromMapFunc(r.clusterRoleInstances))
+	}
+
+	return b.
 		For(&dexv1alpha1.Dex{}).
 		Owns(&v1.ConfigMap{}).
-		Owns(&rbacv1.ClusterRole{}).
-		Owns(&rbacv1.ClusterRoleBinding{}).
+		Owns(&rbacv1.Role{}).
+		Owns(&rbacv1.RoleBinding{}).
 		Owns(&appsv1.Deployment{}).
 		Owns(&v1.Service{}).
 		Owns(&networkingv1.Ingress{}).
+		Owns(&networkingv1.NetworkPolicy{}).
+		Owns(&policyv1beta1.PodDisruptionBudget{}).
+		Owns(&autoscalingv2beta2.HorizontalPodAutoscaler{}).
 		Complete(r)
 }
 
+// clusterRoleInstances maps the shared ClusterRole to the Dex instances bound to it
+func (r *DexReconciler) clusterRoleInstances(obj client.Object) []reconcile.Request {
+	if obj.GetName() != dex.ClusterRoleName || r.RBACScope == dex.RBACScopeNamespace {
+		return nil
+	}
+
+	var list dexv1alpha1.DexList
+	if err := r.Client.List(context.Background(), &list); err != nil {
+		r.Log.Error(err, "failed to list Dex instances", "clusterrole", obj.GetName())
+		return nil
+	}
+
+	res := make([]reconcile.Request, 0)
+	for i := range list.Items {
+		if d := &list.Items[i]; d.DeletionTimestamp.IsZero() {
+			res = append(res, reconcile.Request{NamespacedName: d.NamespacedName()})
+		}
+	}
+	return res
+}
+
+// clusterWide reports whether the operator watches all namespaces, and can thus manage cluster-scoped objects
+func (r *DexReconciler) clusterWide() bool {
+	return len(r.WatchNamespaces) == 0
+}
+
 func (r *DexReconciler) ManageSuccess(ctx context.Context, dex *dexv1alpha1.Dex) (ctrl.Result, error) {
 	dex.Status.Message = "active"
 	dex.Status.Ready = true
 	dex.Status.Phase = dexv1alpha1.PhaseActive
+	dex.Status.Reason = dexv1alpha1.NoReason
+	dex.Status.ObservedGeneration = dex.Generation
 
+	key := dex.NamespacedName()
 	if err := r.Client.Status().Update(ctx, dex); err != nil {
-		return ctrl.Result{
-			RequeueAfter: requeueAfterError,
-		}, err
+		if kuberrors.IsConflict(err) {
+			return ctrl.Result{Requeue: true}, nil
+		}
+		r.Log.Error(err, "failed to update status", "dex", key)
+		return ctrl.Result{RequeueAfter: r.backoff.Next(key)}, nil
 	}
+	metrics.SetInstancePhase(key.String(), dex.Status.Phase)
+	r.backoff.Reset(key)
 	return ctrl.Result{}, nil
 }
 
+// ManageError records issue on the Dex status and decides how to retry based on its class.
+// Transient errors are retried with an exponential backoff, conflicts immediately and
+// permanent errors only after the spec changes.
 func (r *DexReconciler) ManageError(ctx context.Context, dex *dexv1alpha1.Dex, issue error) (ctrl.Result, error) {
+	class := ClassifyError(issue)
+	key := dex.NamespacedName()
+	r.Log.Info("Reconciliation failed", "dex", key, "class", class, "error", issue.Error())
+
 	dex.Status.Message = issue.Error()
-	dex.Status.Ready = false
-	dex.Status.Phase = dexv1alpha1.PhaseFailing
+	dex.Status.Reason = class.Reason()
+	dex.Status.ObservedGeneration = dex.Generation
+	if class != ErrorClassConflict {
+		dex.Status.Ready = false
+		dex.Status.Phase = dexv1alpha1.PhaseFailing
+		r.Recorder.Event(dex, v1.EventTypeWarning, string(dex.Status.Reason), issue.Error())
+	}
 
-	r.Recorder.Event(dex, v1.EventTypeWarning, "Error", issue.Error())
+	if err := r.Client.Status().Update(ctx, dex); err != nil && !kuberrors.IsConflict(err) {
+		return ctrl.Result{}, err
+	}
+	metrics.SetInstancePhase(key.String(), dex.Status.Phase)
 
-	return ctrl.Result{
-		RequeueAfter: requeueAfterError,
-		Requeue:      true,
-	}, r.Client.Status().Update(ctx, dex)
+	switch class {
+	case ErrorClassConflict:
+		return ctrl.Result{Requeue: true}, nil
+	case ErrorClassPermanent:
+		r.backoff.Reset(key)
+		return ctrl.Result{}, nil
+	default:
+		return ctrl.Result{RequeueAfter: r.backoff.Next(key)}, nil
+	}
 }
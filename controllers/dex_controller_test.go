@@ -0,0 +1,440 @@
+/*
+Copyright 2021 © MIKAMAI s.r.l
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	kuberrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	dexv1alpha1 "github.com/karavel-io/dex-operator/api/v1alpha1"
+	"github.com/karavel-io/dex-operator/dex"
+)
+
+// testDexReconciler returns a DexReconciler backed by a fake client holding objs
+func testDexReconciler(t *testing.T, objs ...client.Object) *DexReconciler {
+	t.Helper()
+	c, s := testClient(t, objs...)
+	return &DexReconciler{
+		Client:    c,
+		Log:       ctrl.Log.WithName("test"),
+		Scheme:    s,
+		backoff:   newBackoff(backoffBase, backoffMax),
+		apiReader: c,
+	}
+}
+
+func TestCheckNamespaceLabels(t *testing.T) {
+	namespace := func(name string, labels map[string]string) *v1.Namespace {
+		return &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels}}
+	}
+	named := func(label, name string) *v1.Namespace {
+		return namespace(name, map[string]string{label: name})
+	}
+
+	tests := []struct {
+		name    string
+		label   string
+		objs    []client.Object
+		wantErr bool
+	}{
+		{
+			name: "labeled namespaces",
+			objs: []client.Object{named("kubernetes.io/metadata.name", "dex-operator"), named("kubernetes.io/metadata.name", "ingress-nginx")},
+		},
+		{
+			name: "missing ingress namespace",
+			objs: []client.Object{named("kubernetes.io/metadata.name", "dex-operator")},
+		},
+		{
+			name:    "operator namespace without the label",
+			objs:    []client.Object{namespace("dex-operator", nil), named("kubernetes.io/metadata.name", "ingress-nginx")},
+			wantErr: true,
+		},
+		{
+			name:    "ingress namespace without the label",
+			objs:    []client.Object{named("kubernetes.io/metadata.name", "dex-operator"), namespace("ingress-nginx", nil)},
+			wantErr: true,
+		},
+		{
+			name:  "custom label",
+			label: "name",
+			objs:  []client.Object{named("name", "dex-operator"), named("name", "ingress-nginx")},
+		},
+		{
+			name:    "custom label on a newer cluster",
+			label:   "name",
+			objs:    []client.Object{named("kubernetes.io/metadata.name", "dex-operator"), named("name", "ingress-nginx")},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := testDexReconciler(t, tt.objs...)
+			r.OperatorNamespace = "dex-operator"
+			r.NamespaceLabel = tt.label
+			d := &dexv1alpha1.Dex{ObjectMeta: metav1.ObjectMeta{Name: "dex", Namespace: "dex"}}
+			d.Spec.NetworkPolicy.IngressNamespaces = []string{"ingress-nginx"}
+			if err := r.checkNamespaceLabels(context.Background(), d); (err != nil) != tt.wantErr {
+				t.Errorf("checkNamespaceLabels() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRemoveClusterObjects(t *testing.T) {
+	now := metav1.Now()
+	instance := func(name string, deleting bool) *dexv1alpha1.Dex {
+		d := &dexv1alpha1.Dex{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "dex", UID: types.UID(name)}}
+		if deleting {
+			d.DeletionTimestamp = &now
+			d.Finalizers = []string{instanceFinalizer}
+		}
+		return d
+	}
+	binding := func(d *dexv1alpha1.Dex) *rbacv1.ClusterRoleBinding {
+		return &rbacv1.ClusterRoleBinding{ObjectMeta: metav1.ObjectMeta{Name: dex.ClusterRoleBindingName(d)}}
+	}
+	deleted := instance("deleted", true)
+	cr := dex.ClusterRole()
+
+	tests := []struct {
+		name        string
+		cached      []client.Object
+		live        []client.Object
+		wantRemoved bool
+	}{
+		{
+			name:        "last instance",
+			cached:      []client.Object{deleted},
+			live:        []client.Object{deleted},
+			wantRemoved: true,
+		},
+		{
+			name:        "other instance being deleted",
+			cached:      []client.Object{deleted, instance("other", true)},
+			live:        []client.Object{deleted, instance("other", true)},
+			wantRemoved: true,
+		},
+		{
+			name:   "other instance",
+			cached: []client.Object{deleted, instance("other", false)},
+			live:   []client.Object{deleted, instance("other", false)},
+		},
+		{
+			name:   "instance created in the meantime",
+			cached: []client.Object{deleted},
+			live:   []client.Object{deleted, instance("new", false)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := testDexReconciler(t, append(tt.cached, cr.DeepCopy(), binding(deleted))...)
+			r.apiReader, _ = testClient(t, tt.live...)
+
+			if err := r.removeClusterObjects(context.Background(), r.Log, deleted); err != nil {
+				t.Fatalf("removeClusterObjects() error = %v", err)
+			}
+			err := r.Client.Get(context.Background(), client.ObjectKey{Name: dex.ClusterRoleBindingName(deleted)}, &rbacv1.ClusterRoleBinding{})
+			if !kuberrors.IsNotFound(err) {
+				t.Errorf("ClusterRoleBinding lookup error = %v, want NotFound", err)
+			}
+			err = r.Client.Get(context.Background(), client.ObjectKey{Name: dex.ClusterRoleName}, &rbacv1.ClusterRole{})
+			if removed := kuberrors.IsNotFound(err); removed != tt.wantRemoved {
+				t.Errorf("ClusterRole removed = %v (error %v), want %v", removed, err, tt.wantRemoved)
+			}
+		})
+	}
+}
+
+func TestClusterRoleInstances(t *testing.T) {
+	now := metav1.Now()
+	deleting := &dexv1alpha1.Dex{ObjectMeta: metav1.ObjectMeta{Name: "deleting", Namespace: "dex", DeletionTimestamp: &now, Finalizers: []string{instanceFinalizer}}}
+	r := testDexReconciler(t,
+		&dexv1alpha1.Dex{ObjectMeta: metav1.ObjectMeta{Name: "dex", Namespace: "dex"}},
+		&dexv1alpha1.Dex{ObjectMeta: metav1.ObjectMeta{Name: "dex", Namespace: "other"}},
+		deleting,
+	)
+	cr := dex.ClusterRole()
+
+	if got := r.clusterRoleInstances(&cr); len(got) != 2 {
+		t.Errorf("clusterRoleInstances() = %v, want the 2 instances not being deleted", got)
+	}
+	other := &rbacv1.ClusterRole{ObjectMeta: metav1.ObjectMeta{Name: "admin"}}
+	if got := r.clusterRoleInstances(other); len(got) != 0 {
+		t.Errorf("clusterRoleInstances() for another ClusterRole = %v, want none", got)
+	}
+	r.RBACScope = dex.RBACScopeNamespace
+	if got := r.clusterRoleInstances(&cr); len(got) != 0 {
+		t.Errorf("clusterRoleInstances() with the namespace scope = %v, want none", got)
+	}
+}
+
+func TestRemoveOwned(t *testing.T) {
+	d := &dexv1alpha1.Dex{ObjectMeta: metav1.ObjectMeta{Name: "dex", Namespace: "dex", UID: "dex-uid"}}
+	meta := func() metav1.ObjectMeta {
+		return metav1.ObjectMeta{Name: d.ServiceName(), Namespace: d.Namespace}
+	}
+
+	tests := []struct {
+		name        string
+		obj         func() client.Object
+		owned       bool
+		exists      bool
+		wantRemoved bool
+	}{
+		{name: "missing", obj: func() client.Object { return &policyv1beta1.PodDisruptionBudget{ObjectMeta: meta()} }},
+		{
+			name:        "owned",
+			obj:         func() client.Object { return &networkingv1.NetworkPolicy{ObjectMeta: meta()} },
+			owned:       true,
+			exists:      true,
+			wantRemoved: true,
+		},
+		{
+			name:   "owned by someone else",
+			obj:    func() client.Object { return &v1.Service{ObjectMeta: meta()} },
+			exists: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			objs := make([]client.Object, 0)
+			r := testDexReconciler(t)
+			if tt.exists {
+				o := tt.obj()
+				if tt.owned {
+					if err := controllerutil.SetControllerReference(d, o, r.Scheme); err != nil {
+						t.Fatal(err)
+					}
+				}
+				objs = append(objs, o)
+			}
+			r = testDexReconciler(t, objs...)
+
+			if err := r.removeOwned(context.Background(), r.Log, d, tt.obj(), "test object"); err != nil {
+				t.Fatalf("removeOwned() error = %v", err)
+			}
+			err := r.Client.Get(context.Background(), client.ObjectKey{Name: d.ServiceName(), Namespace: d.Namespace}, tt.obj())
+			if removed := kuberrors.IsNotFound(err); removed != (tt.wantRemoved || !tt.exists) {
+				t.Errorf("object removed = %v (error %v), want %v", removed, err, tt.wantRemoved)
+			}
+		})
+	}
+}
+
+func TestReconcileRBAC(t *testing.T) {
+	d := &dexv1alpha1.Dex{ObjectMeta: metav1.ObjectMeta{Name: "dex", Namespace: "auth", UID: "dex-uid"}}
+	d.Spec.ServiceAccountName = "dex"
+	sa := dex.ServiceAccount(d)
+	role := dex.Role(d)
+	rb := dex.RoleBinding(d, &sa, &role)
+	cr := dex.ClusterRole()
+	crb := dex.ClusterRoleBinding(d, &sa, &cr)
+
+	tests := []struct {
+		name            string
+		scope           dex.RBACScope
+		watch           []string
+		objs            []client.Object
+		wantNamespaced  bool
+		wantClusterRole bool
+		wantBinding     bool
+	}{
+		{name: "cluster scope", scope: dex.RBACScopeCluster, wantClusterRole: true, wantBinding: true},
+		{
+			name:            "cluster scope removes namespaced grants",
+			scope:           dex.RBACScopeCluster,
+			objs:            []client.Object{role.DeepCopy(), rb.DeepCopy()},
+			wantClusterRole: true,
+			wantBinding:     true,
+		},
+		{name: "namespace scope", scope: dex.RBACScopeNamespace, wantNamespaced: true},
+		{
+			name:            "namespace scope removes the instance binding",
+			scope:           dex.RBACScopeNamespace,
+			objs:            []client.Object{cr.DeepCopy(), crb.DeepCopy()},
+			wantNamespaced:  true,
+			wantClusterRole: true,
+		},
+		{
+			name:            "namespace scope leaves cluster objects alone when restricted to namespaces",
+			scope:           dex.RBACScopeNamespace,
+			watch:           []string{"auth"},
+			objs:            []client.Object{cr.DeepCopy(), crb.DeepCopy()},
+			wantNamespaced:  true,
+			wantClusterRole: true,
+			wantBinding:     true,
+		},
+	}
+
+	exists := func(t *testing.T, c client.Client, key client.ObjectKey, obj client.Object) bool {
+		t.Helper()
+		err := c.Get(context.Background(), key, obj)
+		if err != nil && !kuberrors.IsNotFound(err) {
+			t.Fatal(err)
+		}
+		return err == nil
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := testDexReconciler(t, tt.objs...)
+			r.RBACScope = tt.scope
+			r.WatchNamespaces = tt.watch
+
+			if err := r.reconcileRBAC(context.Background(), r.Log, d.DeepCopy(), &sa); err != nil {
+				t.Fatalf("reconcileRBAC() error = %v", err)
+			}
+
+			key := client.ObjectKey{Name: role.Name, Namespace: role.Namespace}
+			if got := exists(t, r.Client, key, &rbacv1.Role{}) && exists(t, r.Client, key, &rbacv1.RoleBinding{}); got != tt.wantNamespaced {
+				t.Errorf("Role and RoleBinding present = %v, want %v", got, tt.wantNamespaced)
+			}
+			if got := exists(t, r.Client, client.ObjectKey{Name: cr.Name}, &rbacv1.ClusterRole{}); got != tt.wantClusterRole {
+				t.Errorf("ClusterRole present = %v, want %v", got, tt.wantClusterRole)
+			}
+			if got := exists(t, r.Client, client.ObjectKey{Name: crb.Name}, &rbacv1.ClusterRoleBinding{}); got != tt.wantBinding {
+				t.Errorf("ClusterRoleBinding present = %v, want %v", got, tt.wantBinding)
+			}
+		})
+	}
+}
+
+func TestInstallStorageCRDs(t *testing.T) {
+	outdated := dex.StorageCRDs()[0]
+	outdated.Spec.Versions = nil
+
+	r := testDexReconciler(t, &outdated)
+	if err := r.installStorageCRDs(context.Background()); err != nil {
+		t.Fatalf("installStorageCRDs() error = %v", err)
+	}
+
+	for _, want := range dex.StorageCRDs() {
+		crd := new(apiextensionsv1.CustomResourceDefinition)
+		if err := r.Client.Get(context.Background(), client.ObjectKey{Name: want.Name}, crd); err != nil {
+			t.Fatalf("CRD %s: %v", want.Name, err)
+		}
+		if len(crd.Spec.Versions) != 1 || crd.Spec.Names.Kind != want.Spec.Names.Kind {
+			t.Errorf("CRD %s spec = %v, want %v", want.Name, crd.Spec, want.Spec)
+		}
+	}
+}
+
+func TestApplyDeletionPolicy(t *testing.T) {
+	deleted := metav1.Now()
+	d := &dexv1alpha1.Dex{ObjectMeta: metav1.ObjectMeta{Name: "dex", Namespace: "dex", DeletionTimestamp: &deleted}}
+	ref := dexv1alpha1.InstanceRef{Name: "dex", Namespace: "dex"}
+	single := &dexv1alpha1.DexClient{ObjectMeta: metav1.ObjectMeta{Name: "single", Namespace: "app"}}
+	single.Spec.InstanceRef = ref
+	multi := &dexv1alpha1.DexClient{ObjectMeta: metav1.ObjectMeta{Name: "multi", Namespace: "app"}}
+	multi.Spec.InstanceRefs = []dexv1alpha1.InstanceRef{ref, {Name: "other", Namespace: "dex"}}
+	other := &dexv1alpha1.DexClient{ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "app"}}
+	other.Spec.InstanceRef = dexv1alpha1.InstanceRef{Name: "other", Namespace: "dex"}
+
+	tests := []struct {
+		name        string
+		policy      dexv1alpha1.DeletionPolicy
+		objs        []client.Object
+		wantDone    bool
+		wantDeleted []string
+		wantMissing []string
+	}{
+		{name: "no referencing clients", policy: dexv1alpha1.DeletionPolicyBlock, objs: []client.Object{other}, wantDone: true},
+		{name: "block", policy: dexv1alpha1.DeletionPolicyBlock, objs: []client.Object{single, other}},
+		{
+			name:        "cascade",
+			policy:      dexv1alpha1.DeletionPolicyCascade,
+			objs:        []client.Object{single, multi, other},
+			wantDeleted: []string{"single"},
+		},
+		{name: "cascade with clients targeting other instances", policy: dexv1alpha1.DeletionPolicyCascade, objs: []client.Object{multi}, wantDone: true},
+		{
+			name:        "orphan",
+			policy:      dexv1alpha1.DeletionPolicyOrphan,
+			objs:        []client.Object{single, multi, other},
+			wantDone:    true,
+			wantMissing: []string{"multi", "single"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			objs := make([]client.Object, len(tt.objs))
+			for i, o := range tt.objs {
+				objs[i] = o.DeepCopyObject().(client.Object)
+			}
+			r := testDexReconciler(t, objs...)
+			r.Recorder = record.NewFakeRecorder(10)
+			dd := d.DeepCopy()
+			dd.Spec.DeletionPolicy = tt.policy
+
+			done, err := r.applyDeletionPolicy(context.Background(), r.Log, dd)
+			if err != nil {
+				t.Fatalf("applyDeletionPolicy() error = %v", err)
+			}
+			if done != tt.wantDone {
+				t.Errorf("applyDeletionPolicy() = %v, want %v", done, tt.wantDone)
+			}
+
+			var list dexv1alpha1.DexClientList
+			if err := r.Client.List(context.Background(), &list); err != nil {
+				t.Fatal(err)
+			}
+			present := make(map[string]bool)
+			missing := make([]string, 0)
+			for _, dc := range list.Items {
+				present[dc.Name] = true
+				if dc.Status.Reason == dexv1alpha1.ReasonInstanceMissing {
+					missing = append(missing, dc.Name)
+				}
+			}
+			for _, name := range tt.wantDeleted {
+				if present[name] {
+					t.Errorf("DexClient %s was not deleted", name)
+				}
+			}
+			if len(list.Items)+len(tt.wantDeleted) != len(tt.objs) {
+				t.Errorf("%d DexClients left, want %d", len(list.Items), len(tt.objs)-len(tt.wantDeleted))
+			}
+			sort.Strings(missing)
+			if tt.wantMissing == nil {
+				tt.wantMissing = []string{}
+			}
+			if !reflect.DeepEqual(missing, tt.wantMissing) {
+				t.Errorf("DexClients marked InstanceMissing = %v, want %v", missing, tt.wantMissing)
+			}
+		})
+	}
+}
@@ -18,12 +18,28 @@ package controllers
 
 import (
 	"context"
+	"fmt"
 	"github.com/karavel-io/dex-operator/dex"
+	"github.com/karavel-io/dex-operator/metrics"
+	"github.com/karavel-io/dex-operator/utils"
+	"github.com/pkg/errors"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	kuberrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/go-logr/logr"
 	"k8s.io/apimachinery/pkg/runtime"
@@ -39,12 +55,38 @@ type DexClientReconciler struct {
 	Log      logr.Logger
 	Scheme   *runtime.Scheme
 	Recorder record.EventRecorder
+	// DeletionTimeout is how long a DexClient being deleted or migrated waits for its Dex instance to become
+	// reachable before the remote cleanup is skipped. Zero means waiting forever
+	DeletionTimeout time.Duration
+	// WatchNamespaces restricts the operator to the given namespaces. Empty means all namespaces
+	WatchNamespaces []string
+
+	backoff   *backoff
+	apiReader client.Reader
 }
 
+const clientFinalizer = "clients.finalizers.dex.karavel.io"
+
 //+kubebuilder:rbac:groups=dex.karavel.io,resources=dexclients,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=dex.karavel.io,resources=dexclients/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=dex.karavel.io,resources=dexclients/finalizers,verbs=update
-//+kubebuilder:rbac:groups="",resources=secrets;events,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups="",resources=secrets;configmaps;events,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list
+//+kubebuilder:rbac:groups=dex.karavel.io,resources=dexclientpolicies,verbs=get;list;watch
+//+kubebuilder:rbac:groups=dex.karavel.io,resources=externaldexes,verbs=get;list;watch
+
+// instance is a Dex server a DexClient can be registered on, either managed by the operator or external
+type instance struct {
+	key dexv1alpha1.InstanceKey
+	// ready will be true if the server can register clients
+	ready bool
+	// issuer is the public URL of the server
+	issuer string
+	// dex is the instance managed by the operator, nil for external servers
+	dex *dexv1alpha1.Dex
+	// endpoint is only set on ready instances
+	endpoint dex.Endpoint
+}
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -57,9 +99,18 @@ func (r *DexClientReconciler) Reconcile(ctx context.Context, req ctrl.Request) (
 	log.Info("Reconciling DexClient resource")
 	var dc dexv1alpha1.DexClient
 	if err := r.Get(ctx, req.NamespacedName, &dc); err != nil {
+		if kuberrors.IsNotFound(err) {
+			r.backoff.Reset(req.NamespacedName)
+		}
 		return ctrl.Result{}, client.IgnoreNotFound(err)
 	}
 
+	permanent := dc.Status.Reason == dexv1alpha1.ReasonPermanentError && dc.Status.ObservedGeneration == dc.Generation
+	if permanent && dc.ObjectMeta.DeletionTimestamp.IsZero() {
+		log.Info("Skipping reconciliation until the spec changes", "message", dc.Status.Message)
+		return ctrl.Result{}, nil
+	}
+
 	if dc.Status.Phase == dexv1alpha1.NoPhase {
 		dc.Status.Phase = dexv1alpha1.PhaseInitialising
 		dc.Status.Ready = false
@@ -68,163 +119,1247 @@ func (r *DexClientReconciler) Reconcile(ctx context.Context, req ctrl.Request) (
 		}
 	}
 
-	var d dexv1alpha1.Dex
-	k := types.NamespacedName{
-		Name:      dc.Spec.InstanceRef.Name,
-		Namespace: dc.Spec.InstanceRef.Namespace,
-	}
-	if k.Namespace == "" {
-		k.Namespace = dc.Namespace
+	if !dc.ObjectMeta.DeletionTimestamp.IsZero() {
+		return r.finalize(ctx, log, &dc)
 	}
-	if err := r.Client.Get(ctx, k, &d); err != nil && dc.ObjectMeta.DeletionTimestamp.IsZero() {
+
+	targets, unwatched, err := r.targets(ctx, &dc)
+	if err != nil {
 		return r.ManageError(ctx, &dc, err)
 	}
-
-	if !d.Status.Ready {
-		return ctrl.Result{
-			RequeueAfter: requeueAfterError,
-		}, nil
+	if len(unwatched) > 0 {
+		return r.ManageInstanceNotWatched(ctx, &dc, unwatched)
 	}
 
-	var svc v1.Service
-	svk := types.NamespacedName{
-		Name:      d.ServiceName(),
-		Namespace: d.Namespace,
+	instances := make([]*instance, 0, len(targets))
+	missing := make([]dexv1alpha1.InstanceKey, 0)
+	for _, k := range targets {
+		in, err := r.getInstance(ctx, k)
+		if err != nil {
+			if !kuberrors.IsNotFound(err) {
+				return r.ManageError(ctx, &dc, err)
+			}
+			missing = append(missing, k)
+			continue
+		}
+		if in.dex != nil && leaving(in.dex) {
+			// the instance removes its clients itself, registering again would leave them behind
+			missing = append(missing, k)
+			continue
+		}
+		instances = append(instances, in)
 	}
-	if err := r.Client.Get(ctx, svk, &svc); err != nil && dc.ObjectMeta.DeletionTimestamp.IsZero() {
-		return r.ManageError(ctx, &dc, err)
+	if len(instances) == 0 {
+		return r.ManageInstanceMissing(ctx, &dc, missing)
 	}
 
-	log = log.WithValues("dex", k)
+	registered := controllerutil.ContainsFinalizer(&dc, clientFinalizer)
+	if !registered {
+		log.Info("adding finalizer")
+		controllerutil.AddFinalizer(&dc, clientFinalizer)
+		if err := r.Update(ctx, &dc); err != nil {
+			return r.ManageError(ctx, &dc, err)
+		}
+	}
+	observed := dc.Status.DeepCopy()
+
+	stale, migrating := migration(&dc, targets)
+	if migrating {
+		if err := r.startMigration(ctx, &dc, stale); err != nil {
+			return r.ManageError(ctx, &dc, err)
+		}
+	}
 
-	host := d.Status.EndpointURL
-	finalizer := "clients.finalizers.dex.karavel.io"
-	if dc.ObjectMeta.DeletionTimestamp.IsZero() {
-		if !controllerutil.ContainsFinalizer(&dc, finalizer) {
-			log.Info("adding finalizer")
-			controllerutil.AddFinalizer(&dc, finalizer)
-			if err := r.Update(ctx, &dc); err != nil {
+	ready := make([]*instance, 0, len(instances))
+	rejected := make([]string, 0)
+	rejectReason := ""
+	tolerated := make([]string, 0)
+	waiting := false
+	for _, in := range instances {
+		reason, msg, violations, err := r.checkPolicies(ctx, &dc, in)
+		if err != nil {
+			return r.ManageError(ctx, &dc, err)
+		}
+		if violations != "" {
+			tolerated = append(tolerated, violations)
+		}
+		if msg != "" {
+			if err := r.rejectOn(ctx, log, &dc, in, msg); err != nil {
 				return r.ManageError(ctx, &dc, err)
 			}
+			rejected = append(rejected, msg)
+			rejectReason = reason
+			continue
 		}
-	} else {
-		if controllerutil.ContainsFinalizer(&dc, finalizer) {
-			// our finalizer is present, so lets handle any external dependency
-			op, err := dex.DeleteDexClient(ctx, log, host, &dc)
-			if err != nil {
-				// if fail to delete the external dependency here, return with error
-				// so that it can be retried
-				return r.ManageError(ctx, &dc, err)
+		if !in.ready {
+			waiting = true
+			st := instanceStatus(&dc, in.key)
+			st.Ready = false
+			st.Reason = dexv1alpha1.NoReason
+			st.Message = "waiting for the Dex instance to become ready"
+			dc.Status.SetInstance(st)
+			continue
+		}
+		ready = append(ready, in)
+	}
+
+	r.reportPolicyViolations(&dc, observed, tolerated)
+
+	var failed error
+	if len(ready) > 0 {
+		secret, recreate, err := r.reconcileSecret(ctx, log, &dc, ready, registered)
+		if err != nil {
+			return r.ManageError(ctx, &dc, err)
+		}
+		if err := r.reconcileConfigMap(ctx, log, &dc, ready[0].issuer); err != nil {
+			return r.ManageError(ctx, &dc, errors.Wrap(err, "failed to reconcile ConfigMap"))
+		}
+		if err := r.reconcileSecretCopies(ctx, log, &dc, ready); err != nil {
+			return r.ManageError(ctx, &dc, errors.Wrap(err, "failed to copy the Secret"))
+		}
+		for _, in := range ready {
+			if err := r.registerOn(ctx, log, &dc, in, secret, recreate); err != nil && failed == nil {
+				failed = err
 			}
-			if op == dex.OpDeleted {
-				r.Recorder.Eventf(&dc, v1.EventTypeNormal, "Deleted", "deleted client from Dex instance")
+		}
+	}
+
+	// clients are removed from the instances they don't target anymore only once registered on the new ones
+	if failed == nil && len(ready) > 0 {
+		expired := false
+		if c := meta.FindStatusCondition(dc.Status.Conditions, string(dexv1alpha1.DexClientConditionMigrating)); c != nil {
+			expired, _ = r.timeoutExpired(c.LastTransitionTime.Time)
+		}
+		for _, k := range stale {
+			done, err := r.removeFrom(ctx, log, &dc, k, expired)
+			if err != nil {
+				failed = err
+				break
 			}
+			waiting = waiting || !done
+		}
+	}
 
-			// remove our finalizer from the list and update it.
-			log.Info("Removing finalizer")
-			controllerutil.RemoveFinalizer(&dc, finalizer)
-			if err := r.Update(context.Background(), &dc); err != nil {
-				return r.ManageError(ctx, &dc, err)
+	if failed != nil {
+		return r.ManageError(ctx, &dc, failed)
+	}
+	if len(rejected) > 0 {
+		return r.ManageNotAllowed(ctx, &dc, rejectReason, strings.Join(rejected, "; "))
+	}
+	meta.RemoveStatusCondition(&dc.Status.Conditions, string(dexv1alpha1.DexClientConditionNotAllowed))
+	if len(missing) > 0 {
+		return r.ManageInstanceMissing(ctx, &dc, missing)
+	}
+	if waiting {
+		if !equality.Semantic.DeepEqual(&dc.Status, observed) {
+			if err := r.Client.Status().Update(ctx, &dc); err != nil && !kuberrors.IsConflict(err) {
+				return ctrl.Result{}, err
 			}
 		}
+		return ctrl.Result{RequeueAfter: requeueAfterError}, nil
+	}
+	r.completeMigration(&dc)
+
+	log.Info("Finished reconciling DexClient resource")
+	return r.ManageSuccess(ctx, &dc, observed)
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *DexClientReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	r.backoff = newBackoff(backoffBase, backoffMax)
+	r.apiReader = mgr.GetAPIReader()
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&dexv1alpha1.DexClient{}).
+		Owns(&v1.Secret{}).
+		Owns(&v1.ConfigMap{}).
+		Watches(&source.Kind{Type: &v1.Secret{}}, handler.EnqueueRequestsFromMapFunc(copyingClient)).
+		Watches(&source.Kind{Type: &dexv1alpha1.Dex{}}, handler.EnqueueRequestsFromMapFunc(r.instanceClients)).
+		Watches(&source.Kind{Type: &dexv1alpha1.ExternalDex{}}, handler.EnqueueRequestsFromMapFunc(r.externalClients),
+			builder.WithPredicates(externalDexChanged)).
+		Complete(r)
+}
+
+// externalDexChanged filters out the status updates of the periodic health checks, which only move the
+// time of the last check, so that clients only follow spec changes and servers becoming (un)available
+var externalDexChanged = predicate.Funcs{
+	UpdateFunc: func(e event.UpdateEvent) bool {
+		old, ok := e.ObjectOld.(*dexv1alpha1.ExternalDex)
+		if !ok {
+			return true
+		}
+		ed, ok := e.ObjectNew.(*dexv1alpha1.ExternalDex)
+		if !ok {
+			return true
+		}
+		return old.Generation != ed.Generation || old.Status.Ready != ed.Status.Ready || old.Status.APIVersion != ed.Status.APIVersion
+	},
+}
+
+// copyingClient maps a copy of a credentials Secret to the DexClient managing it
+func copyingClient(obj client.Object) []reconcile.Request {
+	l := obj.GetLabels()
+	name, namespace := l[dexv1alpha1.ClientNameLabel], l[dexv1alpha1.ClientNamespaceLabel]
+	if name == "" || namespace == "" {
+		return nil
+	}
+	return []reconcile.Request{{NamespacedName: types.NamespacedName{Name: name, Namespace: namespace}}}
+}
+
+// instanceClients maps a Dex instance to the DexClients referencing it, selecting it by label or registered on it,
+// so that they follow instances being created, becoming ready or relabeled
+func (r *DexClientReconciler) instanceClients(obj client.Object) []reconcile.Request {
+	d, ok := obj.(*dexv1alpha1.Dex)
+	if !ok {
+		return nil
+	}
+
+	var list dexv1alpha1.DexClientList
+	if err := r.Client.List(context.Background(), &list); err != nil {
+		r.Log.Error(err, "failed to list DexClients", "dex", d.NamespacedName())
+		return nil
+	}
+
+	res := make([]reconcile.Request, 0)
+	for i := range list.Items {
+		dc := &list.Items[i]
+		if dc.References(d) || dc.Status.Instance(d.InstanceKey()) != nil {
+			res = append(res, reconcile.Request{NamespacedName: dc.NamespacedName()})
+		}
+	}
+	return res
+}
 
-		// Stop reconciliation as the item is being deleted
-		return r.ManageSuccess(ctx, &dc)
+// externalClients maps an external Dex server to the DexClients referencing it or registered on it,
+// so that they follow its health checks
+func (r *DexClientReconciler) externalClients(obj client.Object) []reconcile.Request {
+	ed, ok := obj.(*dexv1alpha1.ExternalDex)
+	if !ok {
+		return nil
 	}
 
-	sec, secret, err := dex.Secret(&d, &dc)
+	var list dexv1alpha1.DexClientList
+	if err := r.Client.List(context.Background(), &list); err != nil {
+		r.Log.Error(err, "failed to list DexClients", "externaldex", ed.NamespacedName())
+		return nil
+	}
+
+	k := ed.InstanceKey()
+	res := make([]reconcile.Request, 0)
+	for i := range list.Items {
+		dc := &list.Items[i]
+		referenced := false
+		for _, ref := range dc.InstanceRefs() {
+			referenced = referenced || dc.TargetKey(ref) == k
+		}
+		if referenced || dc.Status.Instance(k) != nil {
+			res = append(res, reconcile.Request{NamespacedName: dc.NamespacedName()})
+		}
+	}
+	return res
+}
+
+// targets returns the keys of the Dex instances targeted by dc, and those of the instances it references by name
+// outside of the watched namespaces. The selector only matches the instances in the cache
+func (r *DexClientReconciler) targets(ctx context.Context, dc *dexv1alpha1.DexClient) ([]dexv1alpha1.InstanceKey, []dexv1alpha1.InstanceKey, error) {
+	unwatched := make([]dexv1alpha1.InstanceKey, 0)
+	for _, k := range dc.InstanceRefs() {
+		if !r.watches(k.Namespace) {
+			unwatched = append(unwatched, dc.TargetKey(k))
+		}
+	}
+	names, err := dc.Instances(ctx, r.Client)
 	if err != nil {
-		return r.ManageError(ctx, &dc, err)
+		return nil, nil, Permanent(errors.Wrap(err, "invalid instance selector"))
+	}
+	keys := make([]dexv1alpha1.InstanceKey, len(names))
+	for i, k := range names {
+		keys[i] = dc.TargetKey(k)
+	}
+	return keys, unwatched, nil
+}
+
+// reconcileSecret makes sure the Secret holding the client credentials exists, and returns the client secret.
+// The second value is true if the secret was generated, in which case the client must be registered again.
+// Public clients have no secret, and the Secret they may have had as confidential clients is removed
+func (r *DexClientReconciler) reconcileSecret(ctx context.Context, log logr.Logger, dc *dexv1alpha1.DexClient, instances []*instance, registered bool) (string, bool, error) {
+	if dc.Spec.Public {
+		if err := r.deleteOwned(ctx, log, dc, &v1.Secret{}, dc.SecretName()); err != nil {
+			return "", false, err
+		}
+		dc.Status.SecretName = ""
+		return "", false, nil
 	}
 
 	log.Info("Reconciling Secret")
 	seco := new(v1.Secret)
-	seco.Name = sec.Name
-	seco.Namespace = sec.Namespace
 	sk := types.NamespacedName{
-		Name:      sec.Name,
-		Namespace: sec.Namespace,
+		Name:      dc.SecretName(),
+		Namespace: dc.Namespace,
 	}
-	err = r.Client.Get(ctx, sk, seco)
+	err := r.Client.Get(ctx, sk, seco)
 	if err != nil && !kuberrors.IsNotFound(err) {
-		return r.ManageError(ctx, &dc, err)
+		return "", false, err
 	}
 
 	recreate := kuberrors.IsNotFound(err)
-	if dex.ShouldRecreateClientSecret(&dc, seco) {
+	rotated := recreate && registered
+	if !recreate && dex.ShouldRecreateClientSecret(dc, seco) {
+		rotated = true
 		if err := r.Client.Delete(ctx, seco); client.IgnoreNotFound(err) != nil {
-			return r.ManageError(ctx, &dc, err)
+			return "", false, err
 		}
 
 		recreate = true
 	}
+	if rotated {
+		for _, in := range instances {
+			metrics.ClientSecretRotations.WithLabelValues(in.key.String()).Inc()
+		}
+	}
+
+	// the client must keep the credentials applications already have, even when registered on a new instance
+	secret := string(seco.Data[dc.Spec.ClientSecretKey])
+	if recreate {
+		if secret, err = dex.NewClientSecret(); err != nil {
+			return "", false, err
+		}
+	}
+
+	// all instances share the credentials, and the Secret carries the issuer of the first one
+	sec, err := dex.Secret(instances[0].issuer, dc, secret)
+	if err != nil {
+		return "", false, Permanent(errors.Wrap(err, "failed to render the Secret template"))
+	}
 
 	if recreate {
-		log.Info("Secret is missing, creating", "secret", seco.Name)
-		seco.Labels = sec.Labels
-		seco.Annotations = sec.Annotations
+		log.Info("Secret is missing, creating", "secret", sec.Name)
+		if err := r.createSecret(ctx, dc, &sec); err != nil {
+			return "", false, err
+		}
+		return secret, true, nil
+	}
+
+	// the other entries follow the spec and the issuer. Secrets changing type, and immutable Secrets whose
+	// entries change or that become mutable, are replaced
+	if !secretChanged(seco, &sec) {
+		dc.Status.SecretName = seco.Name
+		return secret, false, nil
+	}
+	if seco.Type != sec.Type || isTrue(seco.Immutable) && (secretDataChanged(seco, &sec) || !isTrue(sec.Immutable)) {
+		log.Info("Replacing Secret", "secret", sec.Name)
+		if err := r.Client.Delete(ctx, seco); client.IgnoreNotFound(err) != nil {
+			return "", false, err
+		}
+		if err := r.createSecret(ctx, dc, &sec); err != nil {
+			return "", false, err
+		}
+		return secret, false, nil
+	}
+
+	log.Info("Updating Secret", "secret", sec.Name)
+	if !isTrue(seco.Immutable) {
 		seco.Data = map[string][]byte{}
 		seco.StringData = sec.StringData
-		if err := controllerutil.SetControllerReference(&dc, seco, r.Scheme); err != nil {
-			return r.ManageError(ctx, &dc, err)
+	}
+	seco.Immutable = sec.Immutable
+	seco.Labels = mergeStrings(seco.Labels, sec.Labels)
+	seco.Annotations = mergeStrings(seco.Annotations, sec.Annotations)
+	if err := r.Client.Update(ctx, seco); err != nil {
+		return "", false, err
+	}
+	dc.Status.SecretName = seco.Name
+	return secret, false, nil
+}
+
+// createSecret creates the Secret holding the credentials of dc
+func (r *DexClientReconciler) createSecret(ctx context.Context, dc *dexv1alpha1.DexClient, sec *v1.Secret) error {
+	if err := controllerutil.SetControllerReference(dc, sec, r.Scheme); err != nil {
+		return err
+	}
+	if err := r.Client.Create(ctx, sec); err != nil {
+		return err
+	}
+	dc.Status.SecretName = sec.Name
+	return nil
+}
+
+// secretChanged reports whether the entries, the type, the immutability or the template labels and annotations
+// of the existing Secret differ from desired. Labels and annotations added by others are left alone
+func secretChanged(existing *v1.Secret, desired *v1.Secret) bool {
+	if existing.Type != desired.Type || isTrue(existing.Immutable) != isTrue(desired.Immutable) {
+		return true
+	}
+	return secretDataChanged(existing, desired) ||
+		!isSubset(desired.Labels, existing.Labels) ||
+		!isSubset(desired.Annotations, existing.Annotations)
+}
+
+// secretDataChanged reports whether the entries of the existing Secret differ from desired
+func secretDataChanged(existing *v1.Secret, desired *v1.Secret) bool {
+	if len(existing.Data) != len(desired.StringData) {
+		return true
+	}
+	for k, v := range desired.StringData {
+		if d, ok := existing.Data[k]; !ok || string(d) != v {
+			return true
 		}
+	}
+	return false
+}
 
-		if err := r.Client.Create(ctx, seco); err != nil {
-			return r.ManageError(ctx, &dc, err)
+// isSubset reports whether all the entries of sub are in m
+func isSubset(sub, m map[string]string) bool {
+	for k, v := range sub {
+		if mv, ok := m[k]; !ok || mv != v {
+			return false
 		}
+	}
+	return true
+}
 
-		recreate = true
+// mergeStrings sets the entries of src in dst, allocating it if needed
+func mergeStrings(dst, src map[string]string) map[string]string {
+	if len(src) == 0 {
+		return dst
+	}
+	if dst == nil {
+		dst = make(map[string]string, len(src))
+	}
+	for k, v := range src {
+		dst[k] = v
+	}
+	return dst
+}
+
+func isTrue(b *bool) bool {
+	return b != nil && *b
+}
+
+// reconcileConfigMap writes the client metadata to its ConfigMap, if enabled, and removes the ConfigMap
+// previously written if it was disabled or renamed
+func (r *DexClientReconciler) reconcileConfigMap(ctx context.Context, log logr.Logger, dc *dexv1alpha1.DexClient, issuer string) error {
+	name := dc.ConfigMapName()
+	if old := dc.Status.ConfigMapName; old != "" && old != name {
+		if err := r.deleteOwned(ctx, log, dc, &v1.ConfigMap{}, old); err != nil {
+			return err
+		}
+		dc.Status.ConfigMapName = ""
+	}
+	if name == "" {
+		return nil
 	}
 
-	r.Recorder.Eventf(&dc, v1.EventTypeNormal, "Asserting", "Asserting on Dex instance %s", k)
-	op, err := dex.AssertDexClient(ctx, log, host, &dc, secret, recreate)
+	cm := dex.ClientConfigMap(issuer, dc)
+	cmo := new(v1.ConfigMap)
+	cmo.Name = cm.Name
+	cmo.Namespace = cm.Namespace
+	log.Info("Reconciling ConfigMap", "name", cmo.Name, "namespace", cmo.Namespace)
+	_, err := ctrl.CreateOrUpdate(ctx, r.Client, cmo, func() error {
+		cmo.Labels = cm.Labels
+		cmo.Annotations = cm.Annotations
+		cmo.Data = cm.Data
+		return controllerutil.SetControllerReference(dc, cmo, r.Scheme)
+	})
 	if err != nil {
-		return r.ManageError(ctx, &dc, err)
+		return err
+	}
+	dc.Status.ConfigMapName = name
+	return nil
+}
+
+// reconcileSecretCopies copies the credentials Secret to the namespaces targeted by dc and allowed by the client
+// policy of the Dex instances, and removes the copies from the namespaces that are not targeted anymore
+func (r *DexClientReconciler) reconcileSecretCopies(ctx context.Context, log logr.Logger, dc *dexv1alpha1.DexClient, instances []*instance) error {
+	namespaces, err := r.secretTargets(ctx, dc)
+	if err != nil {
+		return err
+	}
+
+	var src v1.Secret
+	if len(namespaces) > 0 {
+		// the Secret may have just been created, so it is read bypassing the cache
+		sk := types.NamespacedName{
+			Name:      dc.Status.SecretName,
+			Namespace: dc.Namespace,
+		}
+		if err := r.apiReader.Get(ctx, sk, &src); err != nil {
+			return err
+		}
+	}
+
+	keep := make(map[string]bool, len(namespaces))
+	skipped := make([]string, 0)
+	taken := make([]string, 0)
+	for i := range namespaces {
+		ns := &namespaces[i]
+		allowed, err := r.allowsCopy(ctx, ns, instances)
+		if err != nil {
+			return err
+		}
+		if !allowed {
+			skipped = append(skipped, ns.Name)
+			continue
+		}
+		copied, err := r.copySecret(ctx, log, dc, &src, ns.Name)
+		if err != nil {
+			return err
+		}
+		if !copied {
+			taken = append(taken, ns.Name)
+			continue
+		}
+		keep[ns.Name] = true
+	}
+	if len(skipped) > 0 {
+		r.Recorder.Eventf(dc, v1.EventTypeWarning, "SecretCopySkipped", "Secret not copied to namespaces %s, which are not watched by the operator or not allowed by the client policy of its Dex instances", strings.Join(skipped, ", "))
+	}
+	if len(taken) > 0 {
+		r.Recorder.Eventf(dc, v1.EventTypeWarning, "SecretCopySkipped", "Secret not copied to namespaces %s, where a Secret with the same name is not managed by the client", strings.Join(taken, ", "))
+	}
+
+	copies, err := r.deleteSecretCopies(ctx, log, dc, keep)
+	if err != nil {
+		return err
+	}
+	dc.Status.SecretCopies = copies
+	return nil
+}
+
+// secretTargets resolves the namespaces dc copies its Secret to, sorted by name. Public clients have no Secret
+func (r *DexClientReconciler) secretTargets(ctx context.Context, dc *dexv1alpha1.DexClient) ([]v1.Namespace, error) {
+	t := dc.Spec.SecretTargets
+	if t == nil || dc.Spec.Public {
+		return nil, nil
 	}
+
+	found := make(map[string]v1.Namespace)
+	for _, n := range t.Names {
+		var ns v1.Namespace
+		if err := r.apiReader.Get(ctx, client.ObjectKey{Name: n}, &ns); err != nil {
+			if kuberrors.IsNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+		found[n] = ns
+	}
+	if t.Selector != nil {
+		sel, err := metav1.LabelSelectorAsSelector(t.Selector)
+		if err != nil {
+			return nil, Permanent(errors.Wrap(err, "invalid secretTargets selector"))
+		}
+		var list v1.NamespaceList
+		if err := r.apiReader.List(ctx, &list, client.MatchingLabelsSelector{Selector: sel}); err != nil {
+			return nil, err
+		}
+		for _, ns := range list.Items {
+			found[ns.Name] = ns
+		}
+	}
+	delete(found, dc.Namespace)
+
+	res := make([]v1.Namespace, 0, len(found))
+	for _, ns := range found {
+		res = append(res, ns)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Name < res[j].Name
+	})
+	return res, nil
+}
+
+// allowsCopy reports whether the Secret can be copied to ns: the namespace must be watched by the operator
+// and allowed by the client policy of all the Dex instances managed by the operator.
+// Invalid policies are retried like transient errors, as they are fixed on the Dex instances
+func (r *DexClientReconciler) allowsCopy(ctx context.Context, ns *v1.Namespace, instances []*instance) (bool, error) {
+	if !r.watches(ns.Name) {
+		return false, nil
+	}
+	for _, in := range instances {
+		if in.dex == nil {
+			continue
+		}
+		ok, err := in.dex.AllowsNamespace(ns)
+		if err != nil {
+			return false, errors.Wrapf(err, "invalid client policy on Dex instance %s", in.key)
+		}
+		if !ok {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// copySecret writes a copy of src to namespace. Copies cannot be owned by the DexClient across namespaces,
+// so they are labeled with its name and namespace instead. It returns false if a Secret with the same name
+// exists in namespace and is not a copy managed by dc, in which case it is left untouched
+func (r *DexClientReconciler) copySecret(ctx context.Context, log logr.Logger, dc *dexv1alpha1.DexClient, src *v1.Secret, namespace string) (bool, error) {
+	labels := utils.ShallowCopyLabels(src.Labels)
+	for k, v := range dc.CopyLabels() {
+		labels[k] = v
+	}
+	desired := v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        src.Name,
+			Namespace:   namespace,
+			Labels:      labels,
+			Annotations: src.Annotations,
+		},
+		Type:      src.Type,
+		Immutable: src.Immutable,
+		Data:      src.Data,
+	}
+
+	var existing v1.Secret
+	err := r.Client.Get(ctx, types.NamespacedName{Name: desired.Name, Namespace: namespace}, &existing)
+	if err != nil && !kuberrors.IsNotFound(err) {
+		return false, err
+	}
+	if kuberrors.IsNotFound(err) {
+		log.Info("Copying Secret", "secret", desired.Name, "namespace", namespace)
+		return true, r.Client.Create(ctx, &desired)
+	}
+
+	if existing.Labels[dexv1alpha1.ClientNameLabel] != dc.Name || existing.Labels[dexv1alpha1.ClientNamespaceLabel] != dc.Namespace {
+		return false, nil
+	}
+	if existing.Type == desired.Type && isTrue(existing.Immutable) == isTrue(desired.Immutable) &&
+		equality.Semantic.DeepEqual(existing.Data, desired.Data) && equality.Semantic.DeepEqual(existing.Labels, desired.Labels) &&
+		equality.Semantic.DeepEqual(existing.Annotations, desired.Annotations) {
+		return true, nil
+	}
+
+	if existing.Type != desired.Type || isTrue(existing.Immutable) {
+		log.Info("Replacing Secret copy", "secret", desired.Name, "namespace", namespace)
+		if err := r.Client.Delete(ctx, &existing); client.IgnoreNotFound(err) != nil {
+			return false, err
+		}
+		return true, r.Client.Create(ctx, &desired)
+	}
+
+	log.Info("Updating Secret copy", "secret", desired.Name, "namespace", namespace)
+	existing.Labels = desired.Labels
+	existing.Annotations = desired.Annotations
+	existing.Immutable = desired.Immutable
+	existing.Data = desired.Data
+	return true, r.Client.Update(ctx, &existing)
+}
+
+// deleteSecretCopies removes the copies of the Secret managed by dc outside of the namespaces to keep,
+// and returns the sorted namespaces still holding a copy
+func (r *DexClientReconciler) deleteSecretCopies(ctx context.Context, log logr.Logger, dc *dexv1alpha1.DexClient, keep map[string]bool) ([]string, error) {
+	var list v1.SecretList
+	if err := r.Client.List(ctx, &list, client.MatchingLabels(dc.CopyLabels())); err != nil {
+		return nil, err
+	}
+
+	copies := make([]string, 0)
+	for i := range list.Items {
+		sec := &list.Items[i]
+		if keep[sec.Namespace] {
+			copies = append(copies, sec.Namespace)
+			continue
+		}
+		log.Info("Deleting Secret copy", "secret", sec.Name, "namespace", sec.Namespace)
+		if err := r.Client.Delete(ctx, sec); client.IgnoreNotFound(err) != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(copies)
+	return copies, nil
+}
+
+// deleteOwned deletes the object called name in the namespace of dc, if it is controlled by dc
+func (r *DexClientReconciler) deleteOwned(ctx context.Context, log logr.Logger, dc *dexv1alpha1.DexClient, obj client.Object, name string) error {
+	k := types.NamespacedName{
+		Name:      name,
+		Namespace: dc.Namespace,
+	}
+	if err := r.Client.Get(ctx, k, obj); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	if !metav1.IsControlledBy(obj, dc) {
+		return nil
+	}
+
+	log.Info("Deleting object no longer needed by the client", "name", name, "namespace", dc.Namespace)
+	return client.IgnoreNotFound(r.Client.Delete(ctx, obj))
+}
+
+// registerOn creates or updates the client on the Dex instance in and records the outcome in its status
+func (r *DexClientReconciler) registerOn(ctx context.Context, log logr.Logger, dc *dexv1alpha1.DexClient, in *instance, secret string, recreate bool) error {
+	k := in.key
+	st := instanceStatus(dc, k)
+	fail := func(err error) error {
+		st.Ready = false
+		st.Reason = ClassifyError(err).Reason()
+		st.Message = err.Error()
+		dc.Status.SetInstance(st)
+		return errors.Wrapf(err, "failed to register on Dex instance %s", k)
+	}
+
+	if d := in.dex; d != nil {
+		var svc v1.Service
+		svk := types.NamespacedName{
+			Name:      d.ServiceName(),
+			Namespace: d.Namespace,
+		}
+		if err := r.Client.Get(ctx, svk, &svc); err != nil {
+			return fail(err)
+		}
+	}
+
+	// Dex cannot change the public flag of a client, so it is registered again with the same credentials
+	flipped := st.Registered && st.Public != dc.Spec.Public
+
+	r.Recorder.Eventf(dc, v1.EventTypeNormal, "Asserting", "Asserting on Dex instance %s", k)
+	op, err := dex.AssertDexClient(ctx, log, in.endpoint, dc, secret, recreate || flipped)
+	metrics.RecordClientOperation(k.String(), metrics.ActionAssert, string(op), err)
+	if err != nil {
+		return fail(err)
+	}
+
+	st.Registered = true
+	st.Public = dc.Spec.Public
+	st.Ready = true
+	st.Reason = dexv1alpha1.NoReason
+	st.Message = ""
+	dc.Status.SetInstance(st)
+	metrics.ClientLastSync.WithLabelValues(dc.Namespace, dc.Name, k.String()).SetToCurrentTime()
+	r.updateInstanceClients(ctx, k, dc)
 	if op == dex.OpCreated {
-		r.Recorder.Eventf(&dc, v1.EventTypeNormal, "Created", "Created on Dex instance %s", k)
+		r.Recorder.Eventf(dc, v1.EventTypeNormal, "Created", "Created on Dex instance %s", k)
 	} else if op == dex.OpUpdated {
-		r.Recorder.Eventf(&dc, v1.EventTypeNormal, "Updated", "Updated on Dex instance %s", k)
+		r.Recorder.Eventf(dc, v1.EventTypeNormal, "Updated", "Updated on Dex instance %s", k)
 	}
+	return nil
+}
 
-	log.Info("Finished reconciling DexClient resource")
-	return r.ManageSuccess(ctx, &dc)
+// rejectOn removes the client from the Dex instance in, where it is not allowed anymore, and records the
+// rejection in its status. The removal is retried until the instance is ready
+func (r *DexClientReconciler) rejectOn(ctx context.Context, log logr.Logger, dc *dexv1alpha1.DexClient, in *instance, msg string) error {
+	k := in.key
+	st := instanceStatus(dc, k)
+	if st.Registered && in.ready {
+		op, err := dex.DeleteDexClient(ctx, log, in.endpoint, dc)
+		metrics.RecordClientOperation(k.String(), metrics.ActionDelete, string(op), err)
+		if err != nil {
+			return err
+		}
+		if op == dex.OpDeleted {
+			r.Recorder.Eventf(dc, v1.EventTypeNormal, "Deleted", "deleted client from Dex instance %s as it is not allowed anymore", k)
+		}
+		st.Registered = false
+		dc.Status.SetInstance(st)
+		metrics.ClientLastSync.DeleteLabelValues(dc.Namespace, dc.Name, k.String())
+		r.updateInstanceClients(ctx, k, dc)
+	}
+
+	st.Ready = false
+	st.Reason = dexv1alpha1.ReasonNotAllowed
+	st.Message = msg
+	dc.Status.SetInstance(st)
+	return nil
 }
 
-// SetupWithManager sets up the controller with the Manager.
-func (r *DexClientReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
-		For(&dexv1alpha1.DexClient{}).
-		Owns(&v1.Secret{}).
-		Complete(r)
+// checkPolicies evaluates the client policy of in and the DexClientPolicies against dc, returning
+// the reason and the message of the rejection if the client is not allowed on in, and the DexClientPolicy
+// violations tolerated because the client is already registered on in. External servers have no client policy
+func (r *DexClientReconciler) checkPolicies(ctx context.Context, dc *dexv1alpha1.DexClient, in *instance) (string, string, string, error) {
+	if in.dex != nil {
+		allowed, err := r.allowed(ctx, in.dex, dc)
+		if err != nil {
+			return "", "", "", err
+		}
+		if !allowed {
+			return "NamespaceNotAllowed", fmt.Sprintf("namespace %s is not allowed to register clients on Dex instance %s", dc.Namespace, in.key), "", nil
+		}
+	}
+
+	violations, err := dc.EvaluatePolicies(ctx, r.apiReader, in.key.NamespacedName)
+	if err != nil {
+		return "", "", "", err
+	}
+	if len(violations) == 0 {
+		return "", "", "", nil
+	}
+	// spec changes are checked by the webhook, so registered clients have been admitted before the policies changed
+	if st := dc.Status.Instance(in.key); st != nil && st.Registered {
+		return "", "", violations.ToAggregate().Error(), nil
+	}
+	return "PolicyViolation", violations.ToAggregate().Error(), "", nil
+}
+
+// reportPolicyViolations sets the PolicyViolation condition with the DexClientPolicy violations tolerated
+// on the existing registrations of dc, or removes it if there are none
+func (r *DexClientReconciler) reportPolicyViolations(dc *dexv1alpha1.DexClient, observed *dexv1alpha1.DexClientStatus, violations []string) {
+	ct := string(dexv1alpha1.DexClientConditionPolicyViolation)
+	if len(violations) == 0 {
+		meta.RemoveStatusCondition(&dc.Status.Conditions, ct)
+		return
+	}
+
+	msg := strings.Join(violations, "; ")
+	if c := meta.FindStatusCondition(observed.Conditions, ct); c == nil || c.Message != msg {
+		r.Recorder.Event(dc, v1.EventTypeWarning, ct, msg)
+	}
+	meta.SetStatusCondition(&dc.Status.Conditions, metav1.Condition{
+		Type:               ct,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: dc.Generation,
+		Reason:             "ExistingRegistration",
+		Message:            msg,
+	})
+}
+
+// finalize removes the client from all the Dex instances it is registered on and releases the finalizer.
+// If an instance is gone, or cannot be reached within the deletion timeout, its remote cleanup is skipped
+// so that the DexClient doesn't hang in Terminating forever.
+func (r *DexClientReconciler) finalize(ctx context.Context, log logr.Logger, dc *dexv1alpha1.DexClient) (ctrl.Result, error) {
+	if !controllerutil.ContainsFinalizer(dc, clientFinalizer) {
+		return ctrl.Result{}, nil
+	}
+
+	keys := make([]dexv1alpha1.InstanceKey, 0, len(dc.Status.Instances))
+	for _, st := range dc.Status.Instances {
+		if st.Registered {
+			keys = append(keys, st.Key())
+		}
+	}
+	if len(dc.Status.Instances) == 0 {
+		// clients reconciled before registrations were tracked per instance
+		for _, k := range dc.InstanceRefs() {
+			keys = append(keys, dc.TargetKey(k))
+		}
+	}
+
+	expired, remaining := r.timeoutExpired(dc.ObjectMeta.DeletionTimestamp.Time)
+	waiting := false
+	for _, k := range keys {
+		done, err := r.removeFrom(ctx, log, dc, k, expired)
+		if err != nil {
+			// if fail to delete the external dependency here, return with error
+			// so that it can be retried
+			return r.ManageError(ctx, dc, err)
+		}
+		waiting = waiting || !done
+	}
+	if waiting {
+		wait := requeueAfterError
+		if remaining > 0 && remaining < wait {
+			wait = remaining
+		}
+		return ctrl.Result{RequeueAfter: wait}, nil
+	}
+
+	if _, err := r.deleteSecretCopies(ctx, log, dc, nil); err != nil {
+		return r.ManageError(ctx, dc, err)
+	}
+
+	// remove our finalizer from the list and update it.
+	log.Info("Removing finalizer")
+	controllerutil.RemoveFinalizer(dc, clientFinalizer)
+	if err := r.Update(ctx, dc); err != nil {
+		return r.ManageError(ctx, dc, err)
+	}
+	r.backoff.Reset(dc.NamespacedName())
+	return ctrl.Result{}, nil
 }
 
-func (r *DexClientReconciler) ManageSuccess(ctx context.Context, client *dexv1alpha1.DexClient) (ctrl.Result, error) {
-	if client.Status.Phase != dexv1alpha1.PhaseActive {
-		client.Status.Message = "active"
-		client.Status.Ready = true
-		client.Status.Phase = dexv1alpha1.PhaseActive
-		client.Status.ClientID = client.ClientID()
+// removeFrom removes the client from the Dex instance k. It returns false while the instance is not ready
+// and expired is false. The removal is skipped with a warning event if the instance is gone, not watched
+// by the operator, or still unreachable after the timeout expired
+func (r *DexClientReconciler) removeFrom(ctx context.Context, log logr.Logger, dc *dexv1alpha1.DexClient, k dexv1alpha1.InstanceKey, expired bool) (bool, error) {
+	in, err := r.getInstance(ctx, k)
+	switch {
+	case kuberrors.IsNotFound(err):
+		log.Info("Dex instance is gone, skipping remote cleanup", "instance", k)
+		r.Recorder.Eventf(dc, v1.EventTypeWarning, "CleanupSkipped", "Dex instance %s no longer exists, the client was not removed from it", k)
+	case err != nil:
+		return false, err
+	case in.ready:
+		op, err := dex.DeleteDexClient(ctx, log, in.endpoint, dc)
+		metrics.RecordClientOperation(k.String(), metrics.ActionDelete, string(op), err)
+		if err != nil {
+			if !expired {
+				return false, err
+			}
+			r.Recorder.Eventf(dc, v1.EventTypeWarning, "CleanupSkipped", "Failed to remove the client from Dex instance %s within %s, giving up: %v", k, r.DeletionTimeout, err)
+		}
+		if op == dex.OpDeleted {
+			r.Recorder.Eventf(dc, v1.EventTypeNormal, "Deleted", "deleted client from Dex instance %s", k)
+		}
+	case !expired:
+		log.Info("Waiting for the Dex instance to become ready to remove the client", "instance", k)
+		return false, nil
+	default:
+		log.Info("Dex instance did not become ready within the deletion timeout, skipping remote cleanup", "instance", k, "timeout", r.DeletionTimeout)
+		r.Recorder.Eventf(dc, v1.EventTypeWarning, "CleanupSkipped", "Dex instance %s was not ready within %s, the client was not removed from it", k, r.DeletionTimeout)
+	}
+
+	dc.Status.RemoveInstance(k)
+	metrics.ClientLastSync.DeleteLabelValues(dc.Namespace, dc.Name, k.String())
+	r.updateInstanceClients(ctx, k, dc)
+	return true, nil
+}
 
+// getInstance reads the Dex instance or the external Dex server k, depending on its kind.
+// Instances outside of the watched namespaces are reported as not found
+func (r *DexClientReconciler) getInstance(ctx context.Context, k dexv1alpha1.InstanceKey) (*instance, error) {
+	if k.Kind == dexv1alpha1.KindExternalDex {
+		return r.getExternalInstance(ctx, k)
+	}
+
+	if !r.watches(k.Namespace) {
+		return nil, kuberrors.NewNotFound(dexv1alpha1.GroupVersion.WithResource("dexes").GroupResource(), k.Name)
+	}
+	d := new(dexv1alpha1.Dex)
+	if err := r.Client.Get(ctx, k.NamespacedName, d); err != nil {
+		return nil, err
+	}
+	return &instance{
+		key:      k,
+		ready:    d.Status.Ready,
+		issuer:   d.Spec.PublicURL,
+		dex:      d,
+		endpoint: dex.ManagedEndpoint(d),
+	}, nil
+}
+
+// getExternalInstance reads the external Dex server k. Its endpoint is only built when the server is ready,
+// as its health checks already report issues with its TLS Secret
+func (r *DexClientReconciler) getExternalInstance(ctx context.Context, k dexv1alpha1.InstanceKey) (*instance, error) {
+	if !r.watches(k.Namespace) {
+		return nil, kuberrors.NewNotFound(dexv1alpha1.GroupVersion.WithResource("externaldexes").GroupResource(), k.Name)
+	}
+	var ed dexv1alpha1.ExternalDex
+	if err := r.Client.Get(ctx, k.NamespacedName, &ed); err != nil {
+		return nil, err
+	}
+
+	in := &instance{
+		key:    k,
+		ready:  ed.Status.Ready,
+		issuer: ed.Spec.IssuerURL,
+	}
+	if !in.ready {
+		return in, nil
+	}
+
+	sec, err := externalDexSecret(ctx, r.Client, &ed)
+	if err != nil {
+		// not wrapped, so that a missing Secret is not mistaken for a missing instance
+		return nil, fmt.Errorf("failed to read the TLS Secret of ExternalDex %s: %v", k, err)
+	}
+	// the TLS configuration is fixed on the ExternalDex, not on the client, so it is retried like a transient error
+	if in.endpoint, err = dex.ExternalEndpoint(&ed, sec); err != nil {
+		return nil, errors.Wrapf(err, "invalid TLS configuration of ExternalDex %s", k)
+	}
+	return in, nil
+}
+
+// timeoutExpired reports whether the deletion timeout has elapsed since start, and otherwise how long is left.
+// A zero DeletionTimeout never expires.
+func (r *DexClientReconciler) timeoutExpired(start time.Time) (bool, time.Duration) {
+	if r.DeletionTimeout <= 0 {
+		return false, 0
+	}
+	remaining := r.DeletionTimeout - time.Since(start)
+	return remaining <= 0, remaining
+}
+
+// migration returns the Dex instances dc is still registered on but does not target anymore, and whether
+// the client is being migrated. The status of untargeted instances the client never registered on is dropped
+func migration(dc *dexv1alpha1.DexClient, targets []dexv1alpha1.InstanceKey) ([]dexv1alpha1.InstanceKey, bool) {
+	targeted := make(map[dexv1alpha1.InstanceKey]bool, len(targets))
+	for _, k := range targets {
+		targeted[k] = true
+	}
+
+	stale := make([]dexv1alpha1.InstanceKey, 0)
+	flipped := false
+	for _, st := range append([]dexv1alpha1.InstanceStatus(nil), dc.Status.Instances...) {
+		k := st.Key()
+		switch {
+		case targeted[k]:
+			flipped = flipped || st.Registered && st.Public != dc.Spec.Public
+		case st.Registered:
+			stale = append(stale, k)
+		default:
+			dc.Status.RemoveInstance(k)
+		}
+	}
+	return stale, len(stale) > 0 || flipped
+}
+
+// startMigration records on the DexClient status that it is being migrated.
+// The condition is only set once, so that the deletion timeout is measured from the start of the migration
+func (r *DexClientReconciler) startMigration(ctx context.Context, dc *dexv1alpha1.DexClient, stale []dexv1alpha1.InstanceKey) error {
+	if meta.IsStatusConditionTrue(dc.Status.Conditions, string(dexv1alpha1.DexClientConditionMigrating)) {
+		return nil
+	}
+
+	msg := fmt.Sprintf("registering the client again with public set to %t", dc.Spec.Public)
+	if len(stale) > 0 {
+		names := make([]string, len(stale))
+		for i, k := range stale {
+			names[i] = k.String()
+		}
+		msg = fmt.Sprintf("moving the client away from Dex instances %s", strings.Join(names, ", "))
+	}
+	r.Recorder.Event(dc, v1.EventTypeNormal, "Migrating", msg)
+	meta.SetStatusCondition(&dc.Status.Conditions, metav1.Condition{
+		Type:               string(dexv1alpha1.DexClientConditionMigrating),
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: dc.Generation,
+		Reason:             "Migrating",
+		Message:            msg,
+	})
+	return r.Client.Status().Update(ctx, dc)
+}
+
+// completeMigration records the end of a migration in the DexClient conditions, if one was in progress.
+// The new registrations are saved by ManageSuccess
+func (r *DexClientReconciler) completeMigration(dc *dexv1alpha1.DexClient) {
+	c := meta.FindStatusCondition(dc.Status.Conditions, string(dexv1alpha1.DexClientConditionMigrating))
+	if c == nil || c.Status != metav1.ConditionTrue {
+		return
+	}
+
+	msg := c.Message
+	r.Recorder.Event(dc, v1.EventTypeNormal, "Migrated", msg)
+	meta.SetStatusCondition(&dc.Status.Conditions, metav1.Condition{
+		Type:               string(dexv1alpha1.DexClientConditionMigrating),
+		Status:             metav1.ConditionFalse,
+		ObservedGeneration: dc.Generation,
+		Reason:             "Migrated",
+		Message:            msg,
+	})
+}
+
+// instanceStatus returns a copy of the status of the registration on the Dex instance k, or a new one.
+// The kind of external servers is recorded so that the client can be removed once they are not referenced anymore
+func instanceStatus(dc *dexv1alpha1.DexClient, k dexv1alpha1.InstanceKey) dexv1alpha1.InstanceStatus {
+	if st := dc.Status.Instance(k); st != nil {
+		return *st
+	}
+	return dexv1alpha1.InstanceStatus{Name: k.Name, Namespace: k.Namespace, Kind: k.Kind}
+}
+
+// leaving reports whether the Dex instance d is being deleted without waiting for its clients to go away
+func leaving(d *dexv1alpha1.Dex) bool {
+	return !d.ObjectMeta.DeletionTimestamp.IsZero() && d.Spec.DeletionPolicy != dexv1alpha1.DeletionPolicyBlock
+}
+
+// allowed evaluates the client policy of d against the namespace of dc.
+// Namespaces are read bypassing the cache, which may be restricted to a set of namespaces
+func (r *DexClientReconciler) allowed(ctx context.Context, d *dexv1alpha1.Dex, dc *dexv1alpha1.DexClient) (bool, error) {
+	ns := v1.Namespace{}
+	ns.Name = dc.Namespace
+	if d.Spec.ClientPolicy.SelectsNamespaceLabels() {
+		if err := r.apiReader.Get(ctx, client.ObjectKey{Name: dc.Namespace}, &ns); err != nil {
+			return false, err
+		}
+	}
+
+	// an invalid policy is fixed on the Dex instance, not on the client, so it is retried like a transient error
+	ok, err := d.AllowsNamespace(&ns)
+	if err != nil {
+		return false, errors.Wrapf(err, "invalid client policy on Dex instance %s", d.NamespacedName())
+	}
+	return ok, nil
+}
+
+// watches reports whether namespace is among the ones watched by the operator
+func (r *DexClientReconciler) watches(namespace string) bool {
+	if len(r.WatchNamespaces) == 0 {
+		return true
+	}
+	for _, ns := range r.WatchNamespaces {
+		if ns == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// updateInstanceClients refreshes the number of DexClients registered on the instance identified by k.
+// current replaces its cached copy, as its status has not been saved yet
+func (r *DexClientReconciler) updateInstanceClients(ctx context.Context, k dexv1alpha1.InstanceKey, current *dexv1alpha1.DexClient) {
+	var list dexv1alpha1.DexClientList
+	if err := r.Client.List(ctx, &list); err != nil {
+		r.Log.Error(err, "failed to list DexClients", "instance", k.String())
+		return
+	}
+
+	count := 0
+	for i := range list.Items {
+		dc := &list.Items[i]
+		if dc.NamespacedName() == current.NamespacedName() {
+			dc = current
+		}
+		if !dc.ObjectMeta.DeletionTimestamp.IsZero() {
+			continue
+		}
+		if st := dc.Status.Instance(k); st != nil && st.Registered {
+			count++
+		}
+	}
+	metrics.InstanceClients.WithLabelValues(k.String()).Set(float64(count))
+}
+
+// ManageSuccess marks the DexClient as active, updating its status only if it differs from the observed one
+func (r *DexClientReconciler) ManageSuccess(ctx context.Context, client *dexv1alpha1.DexClient, observed *dexv1alpha1.DexClientStatus) (ctrl.Result, error) {
+	key := client.NamespacedName()
+	client.Status.Message = "active"
+	client.Status.Ready = true
+	client.Status.Phase = dexv1alpha1.PhaseActive
+	client.Status.ClientID = client.ClientID()
+	client.Status.Reason = dexv1alpha1.NoReason
+	client.Status.ObservedGeneration = client.Generation
+
+	if !equality.Semantic.DeepEqual(&client.Status, observed) {
 		if err := r.Client.Status().Update(ctx, client); err != nil {
-			r.Log.Error(err, "ERROR", "dexclient", client.NamespacedName())
-			return ctrl.Result{
-				RequeueAfter: requeueAfterError,
-			}, err
+			if kuberrors.IsConflict(err) {
+				return ctrl.Result{Requeue: true}, nil
+			}
+			r.Log.Error(err, "ERROR", "dexclient", key)
+			return ctrl.Result{RequeueAfter: r.backoff.Next(key)}, nil
 		}
 	}
+	r.backoff.Reset(key)
 	return ctrl.Result{}, nil
 }
 
-func (r *DexClientReconciler) ManageError(ctx context.Context, client *dexv1alpha1.DexClient, issue error) (ctrl.Result, error) {
-	r.Log.Error(issue, "ERROR", "dexclient", client.NamespacedName())
-	client.Status.Message = issue.Error()
+// ManageInstanceMissing records on the DexClient status that some of its Dex instances do not exist,
+// or that its selector matches none, and retries with an exponential backoff until they show up
+func (r *DexClientReconciler) ManageInstanceMissing(ctx context.Context, client *dexv1alpha1.DexClient, missing []dexv1alpha1.InstanceKey) (ctrl.Result, error) {
+	key := client.NamespacedName()
+	observed := client.Status.DeepCopy()
+	markInstanceMissing(client, missing...)
+	if !equality.Semantic.DeepEqual(&client.Status, observed) {
+		if observed.Reason != dexv1alpha1.ReasonInstanceMissing || observed.Message != client.Status.Message {
+			r.Recorder.Event(client, v1.EventTypeWarning, string(client.Status.Reason), client.Status.Message)
+		}
+		if err := r.Client.Status().Update(ctx, client); err != nil && !kuberrors.IsConflict(err) {
+			return ctrl.Result{}, err
+		}
+	}
+	return ctrl.Result{RequeueAfter: r.backoff.Next(key)}, nil
+}
+
+// ManageNotAllowed records on the DexClient status that it is rejected by the client policy of some of its
+// Dex instances or by a DexClientPolicy, and retries with an exponential backoff until the policies allow it.
+// The client has already been removed from the instances rejecting it
+func (r *DexClientReconciler) ManageNotAllowed(ctx context.Context, client *dexv1alpha1.DexClient, reason string, msg string) (ctrl.Result, error) {
+	key := client.NamespacedName()
+	if client.Status.Reason != dexv1alpha1.ReasonNotAllowed {
+		r.Recorder.Event(client, v1.EventTypeWarning, string(dexv1alpha1.ReasonNotAllowed), msg)
+	}
+	client.Status.Message = msg
+	client.Status.Reason = dexv1alpha1.ReasonNotAllowed
+	client.Status.ObservedGeneration = client.Generation
 	client.Status.Ready = false
 	client.Status.Phase = dexv1alpha1.PhaseFailing
 	client.Status.ClientID = ""
-	r.Recorder.Event(client, v1.EventTypeWarning, "Error", issue.Error())
+	meta.SetStatusCondition(&client.Status.Conditions, metav1.Condition{
+		Type:               string(dexv1alpha1.DexClientConditionNotAllowed),
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: client.Generation,
+		Reason:             reason,
+		Message:            msg,
+	})
+	if err := r.Client.Status().Update(ctx, client); err != nil && !kuberrors.IsConflict(err) {
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{RequeueAfter: r.backoff.Next(key)}, nil
+}
+
+// ManageInstanceNotWatched records on the DexClient status that it references Dex instances outside of the
+// namespaces watched by the operator, and retries with an exponential backoff in case the operator is reconfigured
+func (r *DexClientReconciler) ManageInstanceNotWatched(ctx context.Context, client *dexv1alpha1.DexClient, unwatched []dexv1alpha1.InstanceKey) (ctrl.Result, error) {
+	key := client.NamespacedName()
+	observed := client.Status.DeepCopy()
+	names := make([]string, len(unwatched))
+	for i, k := range unwatched {
+		names[i] = k.String()
+		st := instanceStatus(client, k)
+		st.Ready = false
+		st.Reason = dexv1alpha1.ReasonInstanceNotWatched
+		st.Message = "Dex instance is outside of the namespaces watched by the operator"
+		client.Status.SetInstance(st)
+	}
 
-	return ctrl.Result{
-		RequeueAfter: requeueAfterError,
-	}, r.Client.Status().Update(ctx, client)
+	client.Status.Message = fmt.Sprintf("Dex instance %s is outside of the namespaces watched by the operator", strings.Join(names, ", "))
+	client.Status.Reason = dexv1alpha1.ReasonInstanceNotWatched
+	client.Status.ObservedGeneration = client.Generation
+	client.Status.Ready = false
+	client.Status.Phase = dexv1alpha1.PhaseFailing
+	client.Status.ClientID = ""
+	if !equality.Semantic.DeepEqual(&client.Status, observed) {
+		if observed.Reason != client.Status.Reason || observed.Message != client.Status.Message {
+			r.Recorder.Event(client, v1.EventTypeWarning, string(client.Status.Reason), client.Status.Message)
+		}
+		if err := r.Client.Status().Update(ctx, client); err != nil && !kuberrors.IsConflict(err) {
+			return ctrl.Result{}, err
+		}
+	}
+	return ctrl.Result{RequeueAfter: r.backoff.Next(key)}, nil
+}
+
+// markInstanceMissing sets the status of a DexClient whose Dex instances do not exist.
+// No missing instance means that the instance selector matches none
+func markInstanceMissing(client *dexv1alpha1.DexClient, missing ...dexv1alpha1.InstanceKey) {
+	names := make([]string, len(missing))
+	for i, k := range missing {
+		names[i] = k.String()
+		st := instanceStatus(client, k)
+		st.Ready = false
+		st.Reason = dexv1alpha1.ReasonInstanceMissing
+		st.Message = "Dex instance not found"
+		client.Status.SetInstance(st)
+	}
+
+	client.Status.Message = fmt.Sprintf("Dex instance %s not found", strings.Join(names, ", "))
+	if len(missing) == 0 {
+		client.Status.Message = "no Dex instance matches the instance selector"
+	}
+	client.Status.Reason = dexv1alpha1.ReasonInstanceMissing
+	client.Status.ObservedGeneration = client.Generation
+	client.Status.Ready = false
+	client.Status.Phase = dexv1alpha1.PhaseFailing
+	client.Status.ClientID = ""
+}
+
+// ManageError records issue on the DexClient status and decides how to retry based on its class.
+// Transient errors are retried with an exponential backoff, conflicts immediately and
+// permanent errors only after the spec changes.
+func (r *DexClientReconciler) ManageError(ctx context.Context, client *dexv1alpha1.DexClient, issue error) (ctrl.Result, error) {
+	class := ClassifyError(issue)
+	key := client.NamespacedName()
+	r.Log.Error(issue, "ERROR", "dexclient", key, "class", class)
+
+	client.Status.Message = issue.Error()
+	client.Status.Reason = class.Reason()
+	client.Status.ObservedGeneration = client.Generation
+	if class != ErrorClassConflict {
+		client.Status.Ready = false
+		client.Status.Phase = dexv1alpha1.PhaseFailing
+		client.Status.ClientID = ""
+		r.Recorder.Event(client, v1.EventTypeWarning, string(client.Status.Reason), issue.Error())
+	}
+
+	if err := r.Client.Status().Update(ctx, client); err != nil && !kuberrors.IsConflict(err) {
+		return ctrl.Result{}, err
+	}
+
+	switch class {
+	case ErrorClassConflict:
+		return ctrl.Result{Requeue: true}, nil
+	case ErrorClassPermanent:
+		r.backoff.Reset(key)
+		return ctrl.Result{}, nil
+	default:
+		return ctrl.Result{RequeueAfter: r.backoff.Next(key)}, nil
+	}
 }
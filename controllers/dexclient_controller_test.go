@@ -0,0 +1,888 @@
+/*
+Copyright 2021 © MIKAMAI s.r.l
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	kuberrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	dexv1alpha1 "github.com/karavel-io/dex-operator/api/v1alpha1"
+)
+
+func TestMigration(t *testing.T) {
+	nn := types.NamespacedName{Name: "dex", Namespace: "dex"}
+	other := types.NamespacedName{Name: "other", Namespace: "dex"}
+	dexKey := dexv1alpha1.InstanceKey{Kind: dexv1alpha1.KindDex, NamespacedName: nn}
+	externalKey := dexv1alpha1.InstanceKey{Kind: dexv1alpha1.KindExternalDex, NamespacedName: nn}
+	otherKey := dexv1alpha1.InstanceKey{Kind: dexv1alpha1.KindDex, NamespacedName: other}
+	status := func(k dexv1alpha1.InstanceKey, registered, public bool) dexv1alpha1.InstanceStatus {
+		return dexv1alpha1.InstanceStatus{Name: k.Name, Namespace: k.Namespace, Kind: k.Kind, Registered: registered, Public: public}
+	}
+
+	tests := []struct {
+		name      string
+		public    bool
+		instances []dexv1alpha1.InstanceStatus
+		targets   []dexv1alpha1.InstanceKey
+		stale     []dexv1alpha1.InstanceKey
+		migrating bool
+		remaining []dexv1alpha1.InstanceKey
+	}{
+		{
+			name:      "new client",
+			targets:   []dexv1alpha1.InstanceKey{dexKey},
+			stale:     []dexv1alpha1.InstanceKey{},
+			remaining: []dexv1alpha1.InstanceKey{},
+		},
+		{
+			name:      "registered on its target",
+			instances: []dexv1alpha1.InstanceStatus{status(dexKey, true, false)},
+			targets:   []dexv1alpha1.InstanceKey{dexKey},
+			stale:     []dexv1alpha1.InstanceKey{},
+			remaining: []dexv1alpha1.InstanceKey{dexKey},
+		},
+		{
+			name:      "status written before the kind was recorded",
+			instances: []dexv1alpha1.InstanceStatus{{Name: nn.Name, Namespace: nn.Namespace, Registered: true}},
+			targets:   []dexv1alpha1.InstanceKey{dexKey},
+			stale:     []dexv1alpha1.InstanceKey{},
+			remaining: []dexv1alpha1.InstanceKey{dexKey},
+		},
+		{
+			name:      "moved to another instance",
+			instances: []dexv1alpha1.InstanceStatus{status(dexKey, true, false)},
+			targets:   []dexv1alpha1.InstanceKey{otherKey},
+			stale:     []dexv1alpha1.InstanceKey{dexKey},
+			migrating: true,
+			remaining: []dexv1alpha1.InstanceKey{dexKey},
+		},
+		{
+			name:      "moved to an external server with the same name",
+			instances: []dexv1alpha1.InstanceStatus{status(dexKey, true, false)},
+			targets:   []dexv1alpha1.InstanceKey{externalKey},
+			stale:     []dexv1alpha1.InstanceKey{dexKey},
+			migrating: true,
+			remaining: []dexv1alpha1.InstanceKey{dexKey},
+		},
+		{
+			name:      "never registered on the previous instance",
+			instances: []dexv1alpha1.InstanceStatus{status(dexKey, false, false)},
+			targets:   []dexv1alpha1.InstanceKey{otherKey},
+			stale:     []dexv1alpha1.InstanceKey{},
+			remaining: []dexv1alpha1.InstanceKey{},
+		},
+		{
+			name:      "public flag flipped",
+			public:    true,
+			instances: []dexv1alpha1.InstanceStatus{status(dexKey, true, false)},
+			targets:   []dexv1alpha1.InstanceKey{dexKey},
+			stale:     []dexv1alpha1.InstanceKey{},
+			migrating: true,
+			remaining: []dexv1alpha1.InstanceKey{dexKey},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dc := &dexv1alpha1.DexClient{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "apps"}}
+			dc.Spec.Public = tt.public
+			dc.Status.Instances = tt.instances
+
+			stale, migrating := migration(dc, tt.targets)
+			if !reflect.DeepEqual(stale, tt.stale) {
+				t.Errorf("migration() stale = %v, want %v", stale, tt.stale)
+			}
+			if migrating != tt.migrating {
+				t.Errorf("migration() migrating = %v, want %v", migrating, tt.migrating)
+			}
+			remaining := make([]dexv1alpha1.InstanceKey, 0)
+			for _, st := range dc.Status.Instances {
+				remaining = append(remaining, st.Key())
+			}
+			if !reflect.DeepEqual(remaining, tt.remaining) {
+				t.Errorf("status instances = %v, want %v", remaining, tt.remaining)
+			}
+		})
+	}
+}
+
+func TestSecretChanged(t *testing.T) {
+	immutable := true
+	existing := func() *v1.Secret {
+		return &v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "dex-app-credentials",
+				Labels:      map[string]string{"app": "app", "added-by": "someone"},
+				Annotations: map[string]string{"reloader": "true"},
+			},
+			Type: v1.SecretTypeOpaque,
+			Data: map[string][]byte{"clientID": []byte("apps-app"), "clientSecret": []byte("s3cr3t")},
+		}
+	}
+	desired := func() *v1.Secret {
+		return &v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   "dex-app-credentials",
+				Labels: map[string]string{"app": "app"},
+			},
+			Type:       v1.SecretTypeOpaque,
+			StringData: map[string]string{"clientID": "apps-app", "clientSecret": "s3cr3t"},
+		}
+	}
+
+	tests := []struct {
+		name        string
+		update      func(existing, desired *v1.Secret)
+		want        bool
+		dataChanged bool
+	}{
+		{name: "unchanged", update: func(existing, desired *v1.Secret) {}},
+		{
+			name:   "empty entry",
+			update: func(existing, desired *v1.Secret) { existing.Data["empty"], desired.StringData["empty"] = nil, "" },
+		},
+		{
+			name:        "entry changed",
+			update:      func(existing, desired *v1.Secret) { desired.StringData["clientSecret"] = "other" },
+			want:        true,
+			dataChanged: true,
+		},
+		{
+			name:        "entry added",
+			update:      func(existing, desired *v1.Secret) { desired.StringData["issuerURL"] = "https://dex.example.com" },
+			want:        true,
+			dataChanged: true,
+		},
+		{
+			name: "entry renamed",
+			update: func(existing, desired *v1.Secret) {
+				desired.StringData = map[string]string{"id": "apps-app", "clientSecret": "s3cr3t"}
+			},
+			want:        true,
+			dataChanged: true,
+		},
+		{
+			name:   "type changed",
+			update: func(existing, desired *v1.Secret) { desired.Type = v1.SecretTypeBasicAuth },
+			want:   true,
+		},
+		{
+			name:   "made immutable",
+			update: func(existing, desired *v1.Secret) { desired.Immutable = &immutable },
+			want:   true,
+		},
+		{
+			name:   "label added",
+			update: func(existing, desired *v1.Secret) { desired.Labels["team"] = "identity" },
+			want:   true,
+		},
+		{
+			name:   "label changed",
+			update: func(existing, desired *v1.Secret) { desired.Labels["app"] = "other" },
+			want:   true,
+		},
+		{
+			name:   "annotation added",
+			update: func(existing, desired *v1.Secret) { desired.Annotations = map[string]string{"team": "identity"} },
+			want:   true,
+		},
+		{
+			name:   "metadata set by others",
+			update: func(existing, desired *v1.Secret) { desired.Labels = nil },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, d := existing(), desired()
+			tt.update(e, d)
+			if got := secretChanged(e, d); got != tt.want {
+				t.Errorf("secretChanged() = %v, want %v", got, tt.want)
+			}
+			if got := secretDataChanged(e, d); got != tt.dataChanged {
+				t.Errorf("secretDataChanged() = %v, want %v", got, tt.dataChanged)
+			}
+		})
+	}
+}
+
+// testClient returns a fake client holding objs, along with its scheme
+func testClient(t *testing.T, objs ...client.Object) (client.Client, *runtime.Scheme) {
+	t.Helper()
+	s := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+	if err := apiextensionsv1.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+	if err := dexv1alpha1.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+	return fake.NewClientBuilder().WithScheme(s).WithObjects(objs...).Build(), s
+}
+
+// testReconciler returns a DexClientReconciler backed by a fake client holding objs
+func testReconciler(t *testing.T, objs ...client.Object) *DexClientReconciler {
+	t.Helper()
+	c, s := testClient(t, objs...)
+	return &DexClientReconciler{
+		Client:    c,
+		Log:       ctrl.Log.WithName("test"),
+		Scheme:    s,
+		apiReader: c,
+		backoff:   newBackoff(backoffBase, backoffMax),
+	}
+}
+
+func TestCopySecret(t *testing.T) {
+	immutable := true
+	dc := &dexv1alpha1.DexClient{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "apps"}}
+	src := func() *v1.Secret {
+		return &v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "dex-app-credentials",
+				Namespace:   "apps",
+				Labels:      map[string]string{"app": "app"},
+				Annotations: map[string]string{"reloader": "true"},
+			},
+			Type: v1.SecretTypeOpaque,
+			Data: map[string][]byte{"clientID": []byte("apps-app"), "clientSecret": []byte("s3cr3t")},
+		}
+	}
+	existing := func(labels map[string]string, update func(sec *v1.Secret)) *v1.Secret {
+		sec := src()
+		sec.Namespace = "frontend"
+		sec.Labels = labels
+		sec.Data = map[string][]byte{"clientSecret": []byte("old")}
+		if update != nil {
+			update(sec)
+		}
+		return sec
+	}
+	copyLabels := map[string]string{"app": "app", dexv1alpha1.ClientNameLabel: "app", dexv1alpha1.ClientNamespaceLabel: "apps"}
+
+	tests := []struct {
+		name   string
+		objs   []client.Object
+		update func(src *v1.Secret)
+		copied bool
+		want   func() *v1.Secret
+	}{
+		{
+			name:   "new copy",
+			copied: true,
+		},
+		{
+			name:   "outdated copy",
+			objs:   []client.Object{existing(copyLabels, nil)},
+			copied: true,
+		},
+		{
+			name:   "immutable copy",
+			objs:   []client.Object{existing(copyLabels, func(sec *v1.Secret) { sec.Immutable = &immutable })},
+			copied: true,
+		},
+		{
+			name:   "copy changing type",
+			objs:   []client.Object{existing(copyLabels, func(sec *v1.Secret) { sec.Type = v1.SecretTypeBasicAuth })},
+			copied: true,
+		},
+		{
+			name:   "source made immutable",
+			objs:   []client.Object{existing(copyLabels, nil)},
+			update: func(src *v1.Secret) { src.Immutable = &immutable },
+			copied: true,
+		},
+		{
+			name: "copy of another client",
+			objs: []client.Object{existing(map[string]string{dexv1alpha1.ClientNameLabel: "other", dexv1alpha1.ClientNamespaceLabel: "apps"}, nil)},
+			want: func() *v1.Secret {
+				return existing(map[string]string{dexv1alpha1.ClientNameLabel: "other", dexv1alpha1.ClientNamespaceLabel: "apps"}, nil)
+			},
+		},
+		{
+			name: "foreign Secret",
+			objs: []client.Object{existing(nil, nil)},
+			want: func() *v1.Secret { return existing(nil, nil) },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := testReconciler(t, tt.objs...)
+			sec := src()
+			if tt.update != nil {
+				tt.update(sec)
+			}
+			copied, err := r.copySecret(context.Background(), r.Log, dc, sec, "frontend")
+			if err != nil {
+				t.Fatalf("copySecret() error = %v", err)
+			}
+			if copied != tt.copied {
+				t.Errorf("copySecret() = %v, want %v", copied, tt.copied)
+			}
+
+			want := sec.DeepCopy()
+			want.Namespace = "frontend"
+			want.Labels = copyLabels
+			if tt.want != nil {
+				want = tt.want()
+			}
+			var got v1.Secret
+			if err := r.Client.Get(context.Background(), types.NamespacedName{Name: want.Name, Namespace: "frontend"}, &got); err != nil {
+				t.Fatalf("failed to get the copy: %v", err)
+			}
+			if got.Type != want.Type || isTrue(got.Immutable) != isTrue(want.Immutable) || !reflect.DeepEqual(got.Data, want.Data) ||
+				!reflect.DeepEqual(got.Labels, want.Labels) || !reflect.DeepEqual(got.Annotations, want.Annotations) {
+				t.Errorf("copy = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestDeleteSecretCopies(t *testing.T) {
+	dc := &dexv1alpha1.DexClient{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "apps"}}
+	secret := func(namespace string, labels map[string]string) *v1.Secret {
+		return &v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "dex-app-credentials", Namespace: namespace, Labels: labels}}
+	}
+	other := &dexv1alpha1.DexClient{ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "apps"}}
+	r := testReconciler(t,
+		secret("apps", nil),
+		secret("frontend-a", dc.CopyLabels()),
+		secret("frontend-b", dc.CopyLabels()),
+		secret("frontend-c", other.CopyLabels()),
+		secret("frontend-d", nil),
+	)
+
+	copies, err := r.deleteSecretCopies(context.Background(), r.Log, dc, map[string]bool{"frontend-b": true, "frontend-d": true})
+	if err != nil {
+		t.Fatalf("deleteSecretCopies() error = %v", err)
+	}
+	if want := []string{"frontend-b"}; !reflect.DeepEqual(copies, want) {
+		t.Errorf("deleteSecretCopies() = %v, want %v", copies, want)
+	}
+
+	var list v1.SecretList
+	if err := r.Client.List(context.Background(), &list); err != nil {
+		t.Fatal(err)
+	}
+	remaining := make([]string, 0)
+	for _, sec := range list.Items {
+		remaining = append(remaining, sec.Namespace)
+	}
+	if want := []string{"apps", "frontend-b", "frontend-c", "frontend-d"}; !reflect.DeepEqual(remaining, want) {
+		t.Errorf("remaining Secrets = %v, want %v", remaining, want)
+	}
+}
+
+func TestExternalDexChanged(t *testing.T) {
+	now := metav1.Now()
+	tests := []struct {
+		name   string
+		update func(ed *dexv1alpha1.ExternalDex)
+		want   bool
+	}{
+		{
+			name:   "health check",
+			update: func(ed *dexv1alpha1.ExternalDex) { ed.Status.LastCheckTime = &now },
+		},
+		{
+			name:   "spec changed",
+			update: func(ed *dexv1alpha1.ExternalDex) { ed.Generation++ },
+			want:   true,
+		},
+		{
+			name:   "server unavailable",
+			update: func(ed *dexv1alpha1.ExternalDex) { ed.Status.Ready = false },
+			want:   true,
+		},
+		{
+			name:   "server upgraded",
+			update: func(ed *dexv1alpha1.ExternalDex) { ed.Status.APIVersion++ },
+			want:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			old := &dexv1alpha1.ExternalDex{ObjectMeta: metav1.ObjectMeta{Name: "dex", Namespace: "dex", Generation: 1}}
+			old.Status.Ready = true
+			ed := old.DeepCopy()
+			tt.update(ed)
+			if got := externalDexChanged.Update(event.UpdateEvent{ObjectOld: old, ObjectNew: ed}); got != tt.want {
+				t.Errorf("externalDexChanged.Update() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInstanceClients(t *testing.T) {
+	d := &dexv1alpha1.Dex{ObjectMeta: metav1.ObjectMeta{Name: "dex", Namespace: "dex", Labels: map[string]string{"env": "prod"}}}
+	dexClient := func(name string, update func(dc *dexv1alpha1.DexClient)) *dexv1alpha1.DexClient {
+		dc := &dexv1alpha1.DexClient{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "apps"}}
+		update(dc)
+		return dc
+	}
+	ref := dexv1alpha1.InstanceRef{Name: "dex", Namespace: "dex"}
+
+	r := testReconciler(t,
+		dexClient("ref", func(dc *dexv1alpha1.DexClient) { dc.Spec.InstanceRef = ref }),
+		dexClient("refs", func(dc *dexv1alpha1.DexClient) {
+			dc.Spec.InstanceRefs = []dexv1alpha1.InstanceRef{{Name: "other", Namespace: "dex"}, ref}
+		}),
+		dexClient("selector", func(dc *dexv1alpha1.DexClient) {
+			dc.Spec.InstanceSelector = &metav1.LabelSelector{MatchLabels: map[string]string{"env": "prod"}}
+		}),
+		dexClient("registered", func(dc *dexv1alpha1.DexClient) {
+			dc.Spec.InstanceRef = dexv1alpha1.InstanceRef{Name: "other", Namespace: "dex"}
+			dc.Status.Instances = []dexv1alpha1.InstanceStatus{{Name: "dex", Namespace: "dex", Kind: dexv1alpha1.KindDex, Registered: true}}
+		}),
+		dexClient("other-selector", func(dc *dexv1alpha1.DexClient) {
+			dc.Spec.InstanceSelector = &metav1.LabelSelector{MatchLabels: map[string]string{"env": "staging"}}
+		}),
+		dexClient("external", func(dc *dexv1alpha1.DexClient) {
+			dc.Spec.InstanceRef = dexv1alpha1.InstanceRef{Kind: dexv1alpha1.KindExternalDex, Name: "dex", Namespace: "dex"}
+		}),
+	)
+
+	got := make([]string, 0)
+	for _, req := range r.instanceClients(d) {
+		got = append(got, req.Name)
+	}
+	sort.Strings(got)
+	if want := []string{"ref", "refs", "registered", "selector"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("instanceClients() = %v, want %v", got, want)
+	}
+}
+
+func TestFinalize(t *testing.T) {
+	registered := []dexv1alpha1.InstanceStatus{{Kind: dexv1alpha1.KindDex, Namespace: "dex", Name: "dex", Registered: true}}
+	notReady := &dexv1alpha1.Dex{ObjectMeta: metav1.ObjectMeta{Name: "dex", Namespace: "dex"}}
+
+	tests := []struct {
+		name         string
+		instance     *dexv1alpha1.Dex
+		timeout      time.Duration
+		deletedSince time.Duration
+		wantReleased bool
+		wantRequeue  time.Duration
+		wantEvent    bool
+	}{
+		{name: "instance gone", wantReleased: true, wantEvent: true},
+		{name: "instance not ready", instance: notReady, deletedSince: time.Hour, wantRequeue: requeueAfterError},
+		{
+			name:         "instance not ready within the timeout",
+			instance:     notReady,
+			timeout:      time.Minute,
+			deletedSince: 2 * time.Minute,
+			wantReleased: true,
+			wantEvent:    true,
+		},
+		{
+			name:         "instance not ready, timeout about to expire",
+			instance:     notReady,
+			timeout:      time.Minute,
+			deletedSince: time.Minute - 5*time.Second,
+			wantRequeue:  5 * time.Second,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			deleted := metav1.NewTime(time.Now().Add(-tt.deletedSince))
+			dc := &dexv1alpha1.DexClient{ObjectMeta: metav1.ObjectMeta{
+				Name:              "client",
+				Namespace:         "app",
+				Finalizers:        []string{clientFinalizer},
+				DeletionTimestamp: &deleted,
+			}}
+			dc.Spec.InstanceRef = dexv1alpha1.InstanceRef{Name: "dex", Namespace: "dex"}
+			dc.Status.Instances = registered
+
+			objs := []client.Object{dc.DeepCopy()}
+			if tt.instance != nil {
+				objs = append(objs, tt.instance.DeepCopy())
+			}
+			r := testReconciler(t, objs...)
+			recorder := record.NewFakeRecorder(10)
+			r.Recorder = recorder
+			r.DeletionTimeout = tt.timeout
+
+			if err := r.Get(context.Background(), dc.NamespacedName(), dc); err != nil {
+				t.Fatal(err)
+			}
+			res, err := r.finalize(context.Background(), r.Log, dc)
+			if err != nil {
+				t.Fatalf("finalize() error = %v", err)
+			}
+			if res.RequeueAfter > tt.wantRequeue || (tt.wantRequeue > 0) != (res.RequeueAfter > 0) {
+				t.Errorf("finalize() requeue after = %v, want at most %v", res.RequeueAfter, tt.wantRequeue)
+			}
+
+			var got dexv1alpha1.DexClient
+			err = r.Get(context.Background(), dc.NamespacedName(), &got)
+			released := kuberrors.IsNotFound(err) || (err == nil && !controllerutil.ContainsFinalizer(&got, clientFinalizer))
+			if released != tt.wantReleased {
+				t.Errorf("finalizer released = %v, want %v", released, tt.wantReleased)
+			}
+
+			select {
+			case e := <-recorder.Events:
+				if !tt.wantEvent || !strings.Contains(e, "CleanupSkipped") {
+					t.Errorf("unexpected event %q", e)
+				}
+			default:
+				if tt.wantEvent {
+					t.Error("missing CleanupSkipped event")
+				}
+			}
+		})
+	}
+}
+
+func TestTargets(t *testing.T) {
+	labeled := func(name, namespace string) *dexv1alpha1.Dex {
+		return &dexv1alpha1.Dex{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace, Labels: map[string]string{"tier": "auth"}}}
+	}
+
+	tests := []struct {
+		name          string
+		watch         []string
+		spec          dexv1alpha1.DexClientSpec
+		wantTargets   []string
+		wantUnwatched []string
+	}{
+		{
+			name:        "cluster-wide",
+			spec:        dexv1alpha1.DexClientSpec{InstanceRef: dexv1alpha1.InstanceRef{Name: "dex", Namespace: "other"}},
+			wantTargets: []string{"other/dex"},
+		},
+		{
+			name:        "reference in a watched namespace",
+			watch:       []string{"auth", "app"},
+			spec:        dexv1alpha1.DexClientSpec{InstanceRef: dexv1alpha1.InstanceRef{Name: "dex", Namespace: "auth"}},
+			wantTargets: []string{"auth/dex"},
+		},
+		{
+			name:  "references outside of the watched namespaces",
+			watch: []string{"auth", "app"},
+			spec: dexv1alpha1.DexClientSpec{InstanceRefs: []dexv1alpha1.InstanceRef{
+				{Name: "dex", Namespace: "auth"},
+				{Name: "dex", Namespace: "other"},
+			}},
+			wantTargets:   []string{"auth/dex", "other/dex"},
+			wantUnwatched: []string{"other/dex"},
+		},
+		{
+			name:        "selector",
+			watch:       []string{"auth", "app"},
+			spec:        dexv1alpha1.DexClientSpec{InstanceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"tier": "auth"}}},
+			wantTargets: []string{"app/dex", "auth/dex"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := testReconciler(t, labeled("dex", "auth"), labeled("dex", "app"))
+			r.WatchNamespaces = tt.watch
+			dc := &dexv1alpha1.DexClient{ObjectMeta: metav1.ObjectMeta{Name: "client", Namespace: "app"}, Spec: tt.spec}
+
+			targets, unwatched, err := r.targets(context.Background(), dc)
+			if err != nil {
+				t.Fatalf("targets() error = %v", err)
+			}
+			names := func(keys []dexv1alpha1.InstanceKey) []string {
+				res := make([]string, len(keys))
+				for i, k := range keys {
+					res[i] = k.NamespacedName.String()
+				}
+				sort.Strings(res)
+				return res
+			}
+			if tt.wantUnwatched == nil {
+				tt.wantUnwatched = []string{}
+			}
+			if got := names(targets); !reflect.DeepEqual(got, tt.wantTargets) {
+				t.Errorf("targets() = %v, want %v", got, tt.wantTargets)
+			}
+			if got := names(unwatched); !reflect.DeepEqual(got, tt.wantUnwatched) {
+				t.Errorf("targets() unwatched = %v, want %v", got, tt.wantUnwatched)
+			}
+
+			// unwatched instances are never read, even if they would be in the cache
+			for _, k := range unwatched {
+				if _, err := r.getInstance(context.Background(), k); !kuberrors.IsNotFound(err) {
+					t.Errorf("getInstance(%s) error = %v, want NotFound", k, err)
+				}
+			}
+		})
+	}
+}
+
+func TestManageInstanceNotWatched(t *testing.T) {
+	dc := &dexv1alpha1.DexClient{ObjectMeta: metav1.ObjectMeta{Name: "client", Namespace: "app"}}
+	dc.Spec.InstanceRef = dexv1alpha1.InstanceRef{Name: "dex", Namespace: "other"}
+	r := testReconciler(t, dc.DeepCopy())
+	recorder := record.NewFakeRecorder(10)
+	r.Recorder = recorder
+	r.WatchNamespaces = []string{"app"}
+
+	if err := r.Get(context.Background(), dc.NamespacedName(), dc); err != nil {
+		t.Fatal(err)
+	}
+	k := dc.TargetKey(dc.InstanceRefs()[0])
+	res, err := r.ManageInstanceNotWatched(context.Background(), dc, []dexv1alpha1.InstanceKey{k})
+	if err != nil {
+		t.Fatalf("ManageInstanceNotWatched() error = %v", err)
+	}
+	if res.RequeueAfter <= 0 {
+		t.Error("ManageInstanceNotWatched() does not retry")
+	}
+
+	var got dexv1alpha1.DexClient
+	if err := r.Get(context.Background(), dc.NamespacedName(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Status.Ready || got.Status.Reason != dexv1alpha1.ReasonInstanceNotWatched {
+		t.Errorf("status = %v, want not ready with reason %s", got.Status, dexv1alpha1.ReasonInstanceNotWatched)
+	}
+	if st := got.Status.Instance(k); st == nil || st.Reason != dexv1alpha1.ReasonInstanceNotWatched {
+		t.Errorf("instance status = %v, want reason %s", st, dexv1alpha1.ReasonInstanceNotWatched)
+	}
+	if len(recorder.Events) != 1 {
+		t.Errorf("recorded %d events, want 1", len(recorder.Events))
+	}
+}
+
+func TestMigrationConditions(t *testing.T) {
+	stale := []dexv1alpha1.InstanceKey{{Kind: dexv1alpha1.KindDex, NamespacedName: types.NamespacedName{Name: "dex", Namespace: "dex"}}}
+
+	tests := []struct {
+		name    string
+		stale   []dexv1alpha1.InstanceKey
+		started bool
+		want    string
+	}{
+		{name: "moved to another instance", stale: stale, want: "moving the client away from Dex instances dex/dex"},
+		{name: "public flag flipped", want: "registering the client again with public set to true"},
+		{name: "already started", stale: stale, started: true, want: "registering the client again with public set to false"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dc := &dexv1alpha1.DexClient{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "apps"}}
+			dc.Spec.Public = !tt.started
+			r := testReconciler(t, dc.DeepCopy())
+			recorder := record.NewFakeRecorder(10)
+			r.Recorder = recorder
+			if err := r.Get(context.Background(), dc.NamespacedName(), dc); err != nil {
+				t.Fatal(err)
+			}
+			if tt.started {
+				// the first migration message is kept, so that the timeout is measured from its start
+				dc.Spec.Public = false
+				if err := r.startMigration(context.Background(), dc, nil); err != nil {
+					t.Fatal(err)
+				}
+				<-recorder.Events
+			}
+
+			if err := r.startMigration(context.Background(), dc, tt.stale); err != nil {
+				t.Fatalf("startMigration() error = %v", err)
+			}
+			c := meta.FindStatusCondition(dc.Status.Conditions, string(dexv1alpha1.DexClientConditionMigrating))
+			if c == nil || c.Status != metav1.ConditionTrue || c.Message != tt.want {
+				t.Fatalf("Migrating condition = %v, want true with message %q", c, tt.want)
+			}
+			if tt.started {
+				if len(recorder.Events) > 0 {
+					t.Errorf("startMigration() recorded %q again", <-recorder.Events)
+				}
+			} else if e := <-recorder.Events; !strings.Contains(e, "Migrating") {
+				t.Errorf("event = %q, want Migrating", e)
+			}
+
+			var saved dexv1alpha1.DexClient
+			if err := r.Get(context.Background(), dc.NamespacedName(), &saved); err != nil {
+				t.Fatal(err)
+			}
+			if !meta.IsStatusConditionTrue(saved.Status.Conditions, string(dexv1alpha1.DexClientConditionMigrating)) {
+				t.Error("startMigration() did not save the Migrating condition")
+			}
+
+			r.completeMigration(dc)
+			c = meta.FindStatusCondition(dc.Status.Conditions, string(dexv1alpha1.DexClientConditionMigrating))
+			if c.Status != metav1.ConditionFalse || c.Reason != "Migrated" || c.Message != tt.want {
+				t.Errorf("Migrating condition = %v, want false with reason Migrated", c)
+			}
+			if e := <-recorder.Events; !strings.Contains(e, "Migrated") {
+				t.Errorf("event = %q, want Migrated", e)
+			}
+
+			// nothing to complete anymore
+			r.completeMigration(dc)
+			if len(recorder.Events) > 0 {
+				t.Errorf("completeMigration() recorded %q without a migration in progress", <-recorder.Events)
+			}
+		})
+	}
+}
+
+func TestReconcileConfigMap(t *testing.T) {
+	_, scheme := testClient(t)
+	dc := &dexv1alpha1.DexClient{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "apps", UID: "client-uid"}}
+	owned := func(name string) *v1.ConfigMap {
+		cm := &v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "apps"}}
+		if err := controllerutil.SetControllerReference(dc, cm, scheme); err != nil {
+			t.Fatal(err)
+		}
+		return cm
+	}
+	foreign := &v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "dex-app-client", Namespace: "apps"}}
+
+	tests := []struct {
+		name       string
+		out        *dexv1alpha1.ConfigMapOutput
+		previous   string
+		objs       []client.Object
+		wantStatus string
+		want       []string
+	}{
+		{name: "disabled", want: []string{}},
+		{
+			name:       "enabled",
+			out:        &dexv1alpha1.ConfigMapOutput{ClientIDKey: "clientID", IssuerURLKey: "issuerURL"},
+			wantStatus: "dex-app-client",
+			want:       []string{"dex-app-client"},
+		},
+		{
+			name:       "renamed",
+			out:        &dexv1alpha1.ConfigMapOutput{Name: "oidc", ClientIDKey: "clientID"},
+			previous:   "dex-app-client",
+			objs:       []client.Object{owned("dex-app-client")},
+			wantStatus: "oidc",
+			want:       []string{"oidc"},
+		},
+		{
+			name:     "disabled after being enabled",
+			previous: "dex-app-client",
+			objs:     []client.Object{owned("dex-app-client")},
+			want:     []string{},
+		},
+		{
+			name:     "disabled with a foreign ConfigMap",
+			previous: "dex-app-client",
+			objs:     []client.Object{foreign},
+			want:     []string{"dex-app-client"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := testReconciler(t, tt.objs...)
+			c := dc.DeepCopy()
+			c.Spec.ConfigMap = tt.out
+			c.Status.ConfigMapName = tt.previous
+
+			if err := r.reconcileConfigMap(context.Background(), r.Log, c, "https://dex.example.com"); err != nil {
+				t.Fatalf("reconcileConfigMap() error = %v", err)
+			}
+			if c.Status.ConfigMapName != tt.wantStatus {
+				t.Errorf("status configMapName = %q, want %q", c.Status.ConfigMapName, tt.wantStatus)
+			}
+
+			var list v1.ConfigMapList
+			if err := r.Client.List(context.Background(), &list, client.InNamespace("apps")); err != nil {
+				t.Fatal(err)
+			}
+			got := make([]string, 0)
+			for _, cm := range list.Items {
+				got = append(got, cm.Name)
+				if cm.Name == tt.wantStatus && cm.Data["clientID"] != c.ClientID() {
+					t.Errorf("ConfigMap %s data = %v, want the client ID", cm.Name, cm.Data)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ConfigMaps = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReconcilePublicSecret(t *testing.T) {
+	_, scheme := testClient(t)
+	dc := &dexv1alpha1.DexClient{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "apps", UID: "client-uid"}}
+	dc.Spec.Public = true
+	dc.Status.SecretName = dc.SecretName()
+	owned := &v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: dc.SecretName(), Namespace: "apps"}}
+	if err := controllerutil.SetControllerReference(dc, owned, scheme); err != nil {
+		t.Fatal(err)
+	}
+	foreign := &v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: dc.SecretName(), Namespace: "apps"}}
+
+	tests := []struct {
+		name     string
+		objs     []client.Object
+		wantKept bool
+	}{
+		{name: "no Secret"},
+		{name: "Secret left from a confidential client", objs: []client.Object{owned}},
+		{name: "foreign Secret", objs: []client.Object{foreign}, wantKept: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := testReconciler(t, tt.objs...)
+			c := dc.DeepCopy()
+
+			secret, generated, err := r.reconcileSecret(context.Background(), r.Log, c, nil, true)
+			if err != nil {
+				t.Fatalf("reconcileSecret() error = %v", err)
+			}
+			if secret != "" || generated {
+				t.Errorf("reconcileSecret() = %q, %v, want no secret for a public client", secret, generated)
+			}
+			if c.Status.SecretName != "" {
+				t.Errorf("status secretName = %q, want none", c.Status.SecretName)
+			}
+			err = r.Client.Get(context.Background(), types.NamespacedName{Name: dc.SecretName(), Namespace: "apps"}, &v1.Secret{})
+			if kept := err == nil; kept != tt.wantKept {
+				t.Errorf("Secret kept = %v, want %v", kept, tt.wantKept)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+/*
+Copyright 2021 © MIKAMAI s.r.l
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"errors"
+
+	dexv1alpha1 "github.com/karavel-io/dex-operator/api/v1alpha1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	kuberrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// ErrorClass determines how a reconciliation failure is retried
+type ErrorClass string
+
+const (
+	ErrorClassTransient ErrorClass = "transient"
+	ErrorClassPermanent ErrorClass = "permanent"
+	ErrorClassConflict  ErrorClass = "conflict"
+)
+
+// Reason returns the status reason reported for errors of this class
+func (c ErrorClass) Reason() dexv1alpha1.StatusReason {
+	switch c {
+	case ErrorClassPermanent:
+		return dexv1alpha1.ReasonPermanentError
+	case ErrorClassConflict:
+		return dexv1alpha1.ReasonConflict
+	default:
+		return dexv1alpha1.ReasonTransientError
+	}
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// Permanent marks err as an error that will not go away without a change to the object spec
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// ClassifyError inspects err and decides whether it is permanent, transient or caused by a conflict.
+// Errors that cannot be positively identified are considered transient, and so are authorization
+// failures, as they are fixed by granting the operator more permissions rather than by changing the spec.
+// Objects that already exist are transient too: they may be owned by someone else, and retrying them
+// immediately as conflicts would never let the backoff kick in.
+func ClassifyError(err error) ErrorClass {
+	var perr *permanentError
+	if errors.As(err, &perr) {
+		return ErrorClassPermanent
+	}
+
+	switch {
+	case kuberrors.IsConflict(err):
+		return ErrorClassConflict
+	case kuberrors.IsInvalid(err), kuberrors.IsBadRequest(err):
+		return ErrorClassPermanent
+	}
+
+	if s, ok := grpcStatus(err); ok {
+		switch s.Code() {
+		case codes.InvalidArgument, codes.FailedPrecondition, codes.Unimplemented:
+			return ErrorClassPermanent
+		case codes.Aborted:
+			return ErrorClassConflict
+		}
+	}
+
+	return ErrorClassTransient
+}
+
+// grpcStatus walks the error chain looking for a gRPC status
+func grpcStatus(err error) (*status.Status, bool) {
+	for err != nil {
+		if se, ok := err.(interface{ GRPCStatus() *status.Status }); ok {
+			return se.GRPCStatus(), true
+		}
+		err = errors.Unwrap(err)
+	}
+	return nil, false
+}
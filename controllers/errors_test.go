@@ -0,0 +1,113 @@
+/*
+Copyright 2021 © MIKAMAI s.r.l
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	kuberrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+
+	dexv1alpha1 "github.com/karavel-io/dex-operator/api/v1alpha1"
+)
+
+func TestClassifyError(t *testing.T) {
+	gr := schema.GroupResource{Group: "dex.karavel.io", Resource: "dexclients"}
+	tests := []struct {
+		name string
+		err  error
+		want ErrorClass
+	}{
+		{"unknown", fmt.Errorf("boom"), ErrorClassTransient},
+		{"marked permanent", Permanent(fmt.Errorf("bad spec")), ErrorClassPermanent},
+		{"wrapped permanent", errors.Wrap(Permanent(fmt.Errorf("bad spec")), "context"), ErrorClassPermanent},
+		{"conflict", kuberrors.NewConflict(gr, "test", fmt.Errorf("stale")), ErrorClassConflict},
+		{"already exists", kuberrors.NewAlreadyExists(gr, "test"), ErrorClassTransient},
+		{"invalid", kuberrors.NewInvalid(schema.GroupKind{Group: gr.Group, Kind: "DexClient"}, "test", field.ErrorList{}), ErrorClassPermanent},
+		{"bad request", kuberrors.NewBadRequest("bad"), ErrorClassPermanent},
+		{"forbidden", kuberrors.NewForbidden(gr, "test", fmt.Errorf("rbac")), ErrorClassTransient},
+		{"wrapped forbidden", errors.Wrap(kuberrors.NewForbidden(gr, "test", fmt.Errorf("rbac")), "context"), ErrorClassTransient},
+		{"not found", kuberrors.NewNotFound(gr, "test"), ErrorClassTransient},
+		{"grpc invalid argument", status.Error(codes.InvalidArgument, "bad"), ErrorClassPermanent},
+		{"grpc failed precondition", status.Error(codes.FailedPrecondition, "bad"), ErrorClassPermanent},
+		{"grpc unimplemented", status.Error(codes.Unimplemented, "old"), ErrorClassPermanent},
+		{"grpc permission denied", status.Error(codes.PermissionDenied, "denied"), ErrorClassTransient},
+		{"grpc already exists", status.Error(codes.AlreadyExists, "dup"), ErrorClassTransient},
+		{"grpc aborted", status.Error(codes.Aborted, "retry"), ErrorClassConflict},
+		{"grpc unavailable", status.Error(codes.Unavailable, "down"), ErrorClassTransient},
+		{"wrapped grpc", errors.Wrap(status.Error(codes.InvalidArgument, "bad"), "context"), ErrorClassPermanent},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ClassifyError(tt.err); got != tt.want {
+				t.Errorf("ClassifyError() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestErrorClassReason(t *testing.T) {
+	tests := []struct {
+		class ErrorClass
+		want  dexv1alpha1.StatusReason
+	}{
+		{ErrorClassPermanent, dexv1alpha1.ReasonPermanentError},
+		{ErrorClassConflict, dexv1alpha1.ReasonConflict},
+		{ErrorClassTransient, dexv1alpha1.ReasonTransientError},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.class), func(t *testing.T) {
+			if got := tt.class.Reason(); got != tt.want {
+				t.Errorf("Reason() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	base, max := time.Second, 10*time.Second
+	within := func(d, want time.Duration) bool {
+		return d >= want && d <= want+time.Duration(float64(want)*backoffJitter)
+	}
+
+	b := newBackoff(base, max)
+	key := types.NamespacedName{Name: "test", Namespace: "default"}
+	for i, want := range []time.Duration{base, 2 * base, 4 * base, 8 * base, max, max} {
+		if d := b.Next(key); !within(d, want) {
+			t.Errorf("failure %d: Next() = %v, want %v plus jitter", i+1, d, want)
+		}
+	}
+
+	other := types.NamespacedName{Name: "other", Namespace: "default"}
+	if d := b.Next(other); !within(d, base) {
+		t.Errorf("Next() for another key = %v, want %v plus jitter", d, base)
+	}
+
+	b.Reset(key)
+	if d := b.Next(key); !within(d, base) {
+		t.Errorf("Next() after Reset() = %v, want %v plus jitter", d, base)
+	}
+}
@@ -0,0 +1,186 @@
+/*
+Copyright 2021 © MIKAMAI s.r.l
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"github.com/karavel-io/dex-operator/dex"
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	kuberrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"time"
+
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	dexv1alpha1 "github.com/karavel-io/dex-operator/api/v1alpha1"
+)
+
+var (
+	// healthCheckInterval is how often the gRPC API of healthy external Dex servers is checked
+	healthCheckInterval = time.Minute
+	healthCheckTimeout  = 10 * time.Second
+)
+
+// ExternalDexReconciler checks the health of the Dex servers not managed by the operator
+type ExternalDexReconciler struct {
+	client.Client
+	Log      logr.Logger
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+
+	backoff *backoff
+}
+
+//+kubebuilder:rbac:groups=dex.karavel.io,resources=externaldexes,verbs=get;list;watch
+//+kubebuilder:rbac:groups=dex.karavel.io,resources=externaldexes/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch
+
+// Reconcile connects to the gRPC API of the external Dex server and records its version.
+// Servers are checked again periodically, and failures are retried with an exponential backoff
+// regardless of their class, as they may be fixed outside of the ExternalDex spec.
+func (r *ExternalDexReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := r.Log.WithValues("externaldex", req.NamespacedName)
+
+	log.Info("Checking ExternalDex health")
+	var ed dexv1alpha1.ExternalDex
+	if err := r.Get(ctx, req.NamespacedName, &ed); err != nil {
+		if kuberrors.IsNotFound(err) {
+			r.backoff.Reset(req.NamespacedName)
+		}
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	if ed.Status.Phase == dexv1alpha1.NoPhase {
+		ed.Status.Phase = dexv1alpha1.PhaseInitialising
+		ed.Status.Ready = false
+		if err := r.Client.Status().Update(ctx, &ed); err != nil {
+			return r.ManageError(ctx, &ed, err)
+		}
+	}
+
+	sec, err := externalDexSecret(ctx, r.Client, &ed)
+	if err != nil {
+		return r.ManageError(ctx, &ed, errors.Wrap(err, "failed to read the TLS Secret"))
+	}
+	ep, err := dex.ExternalEndpoint(&ed, sec)
+	if err != nil {
+		return r.ManageError(ctx, &ed, errors.Wrap(err, "invalid TLS configuration"))
+	}
+
+	tctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	v, err := dex.Version(tctx, log, ep)
+	if err != nil {
+		return r.ManageError(ctx, &ed, errors.Wrap(err, "failed to get the server version"))
+	}
+	ed.Status.ServerVersion = v.Server
+	ed.Status.APIVersion = v.Api
+	if v.Api < dex.MinAPIVersion {
+		return r.ManageError(ctx, &ed, fmt.Errorf("gRPC API version %d is not supported, at least %d is required", v.Api, dex.MinAPIVersion))
+	}
+
+	log.Info("ExternalDex is healthy", "version", v.Server, "apiVersion", v.Api)
+	return r.ManageSuccess(ctx, &ed)
+}
+
+// SetupWithManager sets up the controller with the Manager.
+// Status updates are ignored, as every health check writes one and schedules the next check itself
+func (r *ExternalDexReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	r.backoff = newBackoff(backoffBase, backoffMax)
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&dexv1alpha1.ExternalDex{}, builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Complete(r)
+}
+
+// externalDexSecret reads the Secret holding the certificates of ed, or returns nil if it doesn't use TLS
+func externalDexSecret(ctx context.Context, c client.Reader, ed *dexv1alpha1.ExternalDex) (*v1.Secret, error) {
+	if ed.Spec.TLS == nil {
+		return nil, nil
+	}
+
+	var sec v1.Secret
+	sk := types.NamespacedName{
+		Name:      ed.Spec.TLS.SecretName,
+		Namespace: ed.Namespace,
+	}
+	if err := c.Get(ctx, sk, &sec); err != nil {
+		return nil, err
+	}
+	return &sec, nil
+}
+
+// ManageSuccess marks the ExternalDex as ready and schedules the next health check
+func (r *ExternalDexReconciler) ManageSuccess(ctx context.Context, ed *dexv1alpha1.ExternalDex) (ctrl.Result, error) {
+	key := ed.NamespacedName()
+	if !ed.Status.Ready {
+		r.Recorder.Eventf(ed, v1.EventTypeNormal, "Connected", "Connected to Dex %s", ed.Status.ServerVersion)
+	}
+	now := metav1.Now()
+	ed.Status.Message = "connected"
+	ed.Status.Ready = true
+	ed.Status.Phase = dexv1alpha1.PhaseActive
+	ed.Status.Reason = dexv1alpha1.NoReason
+	ed.Status.ObservedGeneration = ed.Generation
+	ed.Status.LastCheckTime = &now
+
+	if err := r.Client.Status().Update(ctx, ed); err != nil {
+		if kuberrors.IsConflict(err) {
+			return ctrl.Result{Requeue: true}, nil
+		}
+		r.Log.Error(err, "ERROR", "externaldex", key)
+		return ctrl.Result{RequeueAfter: r.backoff.Next(key)}, nil
+	}
+	r.backoff.Reset(key)
+	return ctrl.Result{RequeueAfter: healthCheckInterval}, nil
+}
+
+// ManageError records issue on the ExternalDex status. Conflicts are retried immediately,
+// any other error with an exponential backoff
+func (r *ExternalDexReconciler) ManageError(ctx context.Context, ed *dexv1alpha1.ExternalDex, issue error) (ctrl.Result, error) {
+	class := ClassifyError(issue)
+	key := ed.NamespacedName()
+	r.Log.Info("Health check failed", "externaldex", key, "class", class, "error", issue.Error())
+
+	if class == ErrorClassConflict {
+		return ctrl.Result{Requeue: true}, nil
+	}
+
+	if ed.Status.Ready || ed.Status.Message != issue.Error() {
+		r.Recorder.Event(ed, v1.EventTypeWarning, string(class.Reason()), issue.Error())
+	}
+	now := metav1.Now()
+	ed.Status.Message = issue.Error()
+	ed.Status.Reason = class.Reason()
+	ed.Status.ObservedGeneration = ed.Generation
+	ed.Status.Ready = false
+	ed.Status.Phase = dexv1alpha1.PhaseFailing
+	ed.Status.LastCheckTime = &now
+
+	if err := r.Client.Status().Update(ctx, ed); err != nil && !kuberrors.IsConflict(err) {
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{RequeueAfter: r.backoff.Next(key)}, nil
+}
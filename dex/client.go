@@ -2,16 +2,22 @@ package dex
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"github.com/dexidp/dex/api/v2"
 	"github.com/go-logr/logr"
 	dexv1alpha1 "github.com/karavel-io/dex-operator/api/v1alpha1"
+	"github.com/karavel-io/dex-operator/metrics"
 	"github.com/karavel-io/dex-operator/utils"
 	"github.com/pkg/errors"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net"
+	"strings"
+	"time"
 )
 
 type Op string
@@ -23,6 +29,79 @@ const (
 	OpDeleted    = "deleted"
 )
 
+// MinAPIVersion is the oldest version of the Dex gRPC API the operator can register clients with
+const MinAPIVersion int32 = 2
+
+// Keys of the Secret holding the certificates used to connect to an external Dex server
+const (
+	TLSCAKey   = "ca.crt"
+	TLSCertKey = v1.TLSCertKey
+	TLSKeyKey  = v1.TLSPrivateKeyKey
+)
+
+// Endpoint describes how to reach the gRPC API of a Dex server
+type Endpoint struct {
+	// Instance identifies the server in logs and metrics
+	Instance string
+	// Address is the host:port of the gRPC API
+	Address string
+	// TLS is the configuration of the connection, plaintext is used if nil
+	TLS *tls.Config
+}
+
+// ManagedEndpoint returns the endpoint of the Dex instance d, managed by the operator
+func ManagedEndpoint(d *dexv1alpha1.Dex) Endpoint {
+	return Endpoint{
+		Instance: d.NamespacedName().String(),
+		Address:  d.Status.EndpointURL,
+	}
+}
+
+// ExternalEndpoint returns the endpoint of the external Dex server ed. sec holds its certificates
+// and must be provided if ed has a TLS configuration
+func ExternalEndpoint(ed *dexv1alpha1.ExternalDex, sec *v1.Secret) (Endpoint, error) {
+	ep := Endpoint{
+		Instance: ed.NamespacedName().String(),
+		Address:  ed.Spec.Address,
+	}
+	if ed.Spec.TLS == nil {
+		return ep, nil
+	}
+
+	serverName := ed.Spec.TLS.ServerName
+	if serverName == "" {
+		host, _, err := net.SplitHostPort(ed.Spec.Address)
+		if err != nil {
+			return Endpoint{}, errors.Wrap(err, "invalid address")
+		}
+		serverName = host
+	}
+	cfg := &tls.Config{
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if ca := sec.Data[TLSCAKey]; len(ca) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return Endpoint{}, fmt.Errorf("secret %s does not contain a valid PEM encoded %s", sec.Name, TLSCAKey)
+		}
+		cfg.RootCAs = pool
+	}
+
+	crt, key := sec.Data[TLSCertKey], sec.Data[TLSKeyKey]
+	if len(crt) > 0 || len(key) > 0 {
+		cert, err := tls.X509KeyPair(crt, key)
+		if err != nil {
+			return Endpoint{}, errors.Wrapf(err, "invalid client certificate in secret %s", sec.Name)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	ep.TLS = cfg
+	return ep, nil
+}
+
 func ShouldRecreateClientSecret(dc *dexv1alpha1.DexClient, obj *v1.Secret) bool {
 	idKey := dc.Spec.ClientIDKey
 	secretKey := dc.Spec.ClientSecretKey
@@ -30,55 +109,101 @@ func ShouldRecreateClientSecret(dc *dexv1alpha1.DexClient, obj *v1.Secret) bool
 	return obj.Data[idKey] == nil || obj.Data[secretKey] == nil
 }
 
-func Secret(d *dexv1alpha1.Dex, dc *dexv1alpha1.DexClient) (v1.Secret, string, error) {
-	idKey := dc.Spec.ClientIDKey
-	secretKey := dc.Spec.ClientSecretKey
-	secret, err := utils.GenerateRandomString(15)
-	if err != nil {
-		return v1.Secret{}, "", err
-	}
+// NewClientSecret generates a random client secret
+func NewClientSecret() (string, error) {
+	return utils.GenerateRandomString(15)
+}
 
+// Secret returns the Secret holding the credentials of dc, along with the entries rendered from its template.
+// issuer is the URL of the Dex server, omitted from the Secret if empty
+func Secret(issuer string, dc *dexv1alpha1.DexClient, secret string) (v1.Secret, error) {
 	tpl := dc.Spec.Template
-	if tpl.ObjectMeta.Name == "" {
-		tpl.ObjectMeta.Name = fmt.Sprintf("dex-%s-credentials", dc.Name)
+	values := SecretValues{
+		ClientID:     dc.ClientID(),
+		ClientSecret: secret,
+		IssuerURL:    issuer,
+		RedirectURIs: dc.Spec.RedirectUris,
+		Name:         dc.Spec.Name,
+	}
+	if issuer != "" {
+		values.DiscoveryURL = DiscoveryURL(issuer)
+	}
+	data, err := RenderSecretData(&tpl, values)
+	if err != nil {
+		return v1.Secret{}, err
 	}
 
-	data := map[string]string{
-		idKey:     dc.ClientID(),
-		secretKey: secret,
+	data[dc.Spec.ClientIDKey] = dc.ClientID()
+	data[dc.Spec.ClientSecretKey] = secret
+	if issuer != "" {
+		data[dc.Spec.IssuerURLKey] = issuer
 	}
 
-	if d.Spec.PublicURL != "" {
-		data[dc.Spec.IssuerURLKey] = d.Spec.PublicURL
+	typ := tpl.Type
+	if typ == "" {
+		typ = v1.SecretTypeOpaque
 	}
 
 	return v1.Secret{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:        tpl.ObjectMeta.Name,
+			Name:        dc.SecretName(),
 			Namespace:   dc.Namespace,
 			Labels:      tpl.ObjectMeta.Labels,
 			Annotations: tpl.ObjectMeta.Annotations,
 		},
+		Type:       typ,
+		Immutable:  tpl.Immutable,
 		StringData: data,
-	}, secret, nil
+	}, nil
 }
 
-func AssertDexClient(ctx context.Context, log logr.Logger, host string, client *dexv1alpha1.DexClient, secret string, recreate bool) (Op, error) {
-	if secret == "" {
-		return OpNone, errors.New("a client must have a secret")
+// ClientConfigMap returns the ConfigMap holding the metadata of dc that is not secret.
+// issuer is the URL of the Dex server, the issuer and discovery URLs are omitted if empty
+func ClientConfigMap(issuer string, dc *dexv1alpha1.DexClient) v1.ConfigMap {
+	out := dc.Spec.ConfigMap
+	data := map[string]string{
+		out.ClientIDKey:     dc.ClientID(),
+		out.RedirectURIsKey: strings.Join(dc.Spec.RedirectUris, "\n"),
+	}
+	if issuer != "" {
+		data[out.IssuerURLKey] = issuer
+		data[out.DiscoveryURLKey] = DiscoveryURL(issuer)
+	}
+
+	return v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        dc.ConfigMapName(),
+			Namespace:   dc.Namespace,
+			Labels:      out.Labels,
+			Annotations: out.Annotations,
+		},
+		Data: data,
+	}
+}
+
+// DiscoveryURL returns the URL of the OpenID Connect discovery document of the issuer
+func DiscoveryURL(issuer string) string {
+	return strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration"
+}
+
+// AssertDexClient creates or updates the client on the Dex server reachable at ep
+func AssertDexClient(ctx context.Context, log logr.Logger, ep Endpoint, client *dexv1alpha1.DexClient, secret string, recreate bool) (Op, error) {
+	if secret == "" && !client.Spec.Public {
+		return OpNone, errors.New("a confidential client must have a secret")
 	}
 
 	if recreate {
-		_, err := DeleteDexClient(ctx, log, host, client)
+		_, err := DeleteDexClient(ctx, log, ep, client)
 		if err != nil {
 			return OpNone, err
 		}
 	}
 
-	a, err := buildDexApi(log, host, "")
+	a, conn, err := buildDexApi(log, ep)
 	if err != nil {
 		return OpNone, err
 	}
+	defer conn.Close()
 
 	id := client.ClientID()
 	name := client.Spec.Name
@@ -120,11 +245,13 @@ func AssertDexClient(ctx context.Context, log logr.Logger, host string, client *
 	return OpUpdated, nil
 }
 
-func DeleteDexClient(ctx context.Context, log logr.Logger, host string, client *dexv1alpha1.DexClient) (Op, error) {
-	a, err := buildDexApi(log, host, "")
+// DeleteDexClient removes the client from the Dex server reachable at ep
+func DeleteDexClient(ctx context.Context, log logr.Logger, ep Endpoint, client *dexv1alpha1.DexClient) (Op, error) {
+	a, conn, err := buildDexApi(log, ep)
 	if err != nil {
 		return OpNone, err
 	}
+	defer conn.Close()
 
 	id := client.ClientID()
 	name := client.Spec.Name
@@ -145,23 +272,42 @@ func DeleteDexClient(ctx context.Context, log logr.Logger, host string, client *
 	return OpDeleted, nil
 }
 
-func buildDexApi(log logr.Logger, host string, caPath string) (api.DexClient, error) {
-	log.Info("Opening gRPC connection", "host", host)
-	opts := make([]grpc.DialOption, 0)
-	if caPath != "" {
-		creds, err := credentials.NewClientTLSFromFile(caPath, "")
-		if err != nil {
-			return nil, fmt.Errorf("load svc cert: %v", err)
-		}
-		opts = append(opts, grpc.WithTransportCredentials(creds))
+// Version returns the versions of the Dex server reachable at ep and of its gRPC API
+func Version(ctx context.Context, log logr.Logger, ep Endpoint) (*api.VersionResp, error) {
+	a, conn, err := buildDexApi(log, ep)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	return a.GetVersion(ctx, &api.VersionReq{})
+}
+
+func buildDexApi(log logr.Logger, ep Endpoint) (api.DexClient, *grpc.ClientConn, error) {
+	log.Info("Opening gRPC connection", "host", ep.Address, "tls", ep.TLS != nil)
+	opts := []grpc.DialOption{
+		grpc.WithUnaryInterceptor(metricsInterceptor(ep.Instance)),
+	}
+	if ep.TLS != nil {
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(ep.TLS)))
 	} else {
 		opts = append(opts, grpc.WithInsecure())
 	}
 
-	conn, err := grpc.Dial(host, opts...)
+	conn, err := grpc.Dial(ep.Address, opts...)
 	if err != nil {
-		return nil, fmt.Errorf("dial: %v", err)
+		return nil, nil, fmt.Errorf("dial: %v", err)
 	}
 
-	return api.NewDexClient(conn), nil
+	return api.NewDexClient(conn), conn, nil
+}
+
+// metricsInterceptor records latency and errors of every call made to the Dex gRPC API
+func metricsInterceptor(instance string) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		start := time.Now()
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		metrics.ObserveGRPCRequest(instance, method, time.Since(start), err)
+		return err
+	}
 }
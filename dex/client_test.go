@@ -0,0 +1,101 @@
+/*
+Copyright 2021 © MIKAMAI s.r.l
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dex
+
+import (
+	"reflect"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	dexv1alpha1 "github.com/karavel-io/dex-operator/api/v1alpha1"
+)
+
+func TestClientConfigMap(t *testing.T) {
+	keys := dexv1alpha1.ConfigMapOutput{
+		ClientIDKey:     "clientID",
+		IssuerURLKey:    "issuerURL",
+		DiscoveryURLKey: "discoveryURL",
+		RedirectURIsKey: "redirectURIs",
+	}
+	custom := keys
+	custom.Name = "oidc"
+	custom.ClientIDKey = "OIDC_CLIENT_ID"
+	custom.Labels = map[string]string{"app": "web"}
+
+	tests := []struct {
+		name     string
+		issuer   string
+		out      dexv1alpha1.ConfigMapOutput
+		wantName string
+		want     map[string]string
+	}{
+		{
+			name:     "defaults",
+			issuer:   "https://dex.example.com/",
+			out:      keys,
+			wantName: "dex-app-client",
+			want: map[string]string{
+				"clientID":     "apps-app",
+				"issuerURL":    "https://dex.example.com/",
+				"discoveryURL": "https://dex.example.com/.well-known/openid-configuration",
+				"redirectURIs": "https://app.example.com/callback\nhttps://app.example.com/silent",
+			},
+		},
+		{
+			name:     "custom name and keys",
+			issuer:   "https://example.com/dex",
+			out:      custom,
+			wantName: "oidc",
+			want: map[string]string{
+				"OIDC_CLIENT_ID": "apps-app",
+				"issuerURL":      "https://example.com/dex",
+				"discoveryURL":   "https://example.com/dex/.well-known/openid-configuration",
+				"redirectURIs":   "https://app.example.com/callback\nhttps://app.example.com/silent",
+			},
+		},
+		{
+			name:     "unknown issuer",
+			out:      keys,
+			wantName: "dex-app-client",
+			want: map[string]string{
+				"clientID":     "apps-app",
+				"redirectURIs": "https://app.example.com/callback\nhttps://app.example.com/silent",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dc := &dexv1alpha1.DexClient{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "apps"}}
+			dc.Spec.RedirectUris = []string{"https://app.example.com/callback", "https://app.example.com/silent"}
+			out := tt.out
+			dc.Spec.ConfigMap = &out
+
+			cm := ClientConfigMap(tt.issuer, dc)
+			if cm.Name != tt.wantName || cm.Namespace != "apps" {
+				t.Errorf("ClientConfigMap() = %s/%s, want apps/%s", cm.Namespace, cm.Name, tt.wantName)
+			}
+			if !reflect.DeepEqual(cm.Labels, tt.out.Labels) {
+				t.Errorf("ClientConfigMap() labels = %v, want %v", cm.Labels, tt.out.Labels)
+			}
+			if !reflect.DeepEqual(cm.Data, tt.want) {
+				t.Errorf("ClientConfigMap() data = %v, want %v", cm.Data, tt.want)
+			}
+		})
+	}
+}
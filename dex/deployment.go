@@ -10,18 +10,22 @@ import (
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/intstr"
+	"path"
 )
 
 const (
 	InstanceMarkerLabel = "dex.karavel.io/instance"
+	ServiceRoleLabel    = "dex.karavel.io/service"
+	ServiceRoleMetrics  = "metrics"
 	PortHttps           = 5556
 	PortGrpc            = 5557
+	PortMetrics         = 5558
 )
 
 func Service(dex *dexv1alpha1.Dex) (v1.Service, string) {
 	labels := utils.ShallowCopyLabels(dex.Spec.InstanceLabels)
 	labels[InstanceMarkerLabel] = dex.Name
-	return v1.Service{
+	svc := v1.Service{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      dex.ServiceName(),
 			Namespace: dex.Namespace,
@@ -45,12 +49,62 @@ func Service(dex *dexv1alpha1.Dex) (v1.Service, string) {
 				},
 			},
 		},
-	}, fmt.Sprintf("%s.%s:%d", dex.ServiceName(), dex.Namespace, PortGrpc)
+	}
+	if !dex.Spec.Service.SeparateWeb {
+		exposeService(dex, &svc)
+	}
+
+	return svc, fmt.Sprintf("%s.%s:%d", dex.ServiceName(), dex.Namespace, PortGrpc)
 }
 
-func MetricsService(dex *dexv1alpha1.Dex) v1.Service {
+// WebService exposes the Dex web port alone, keeping the gRPC API internal
+func WebService(dex *dexv1alpha1.Dex) v1.Service {
 	labels := utils.ShallowCopyLabels(dex.Spec.InstanceLabels)
 	labels[InstanceMarkerLabel] = dex.Name
+	svc := v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      dex.ServiceName() + "-web",
+			Namespace: dex.Namespace,
+			Labels:    labels,
+		},
+		Spec: v1.ServiceSpec{
+			Selector: labels,
+			Ports: []v1.ServicePort{
+				{
+					Name:       "https",
+					Port:       PortHttps,
+					Protocol:   v1.ProtocolTCP,
+					TargetPort: intstr.FromString("https"),
+				},
+			},
+		},
+	}
+	exposeService(dex, &svc)
+	return svc
+}
+
+func exposeService(dex *dexv1alpha1.Dex, svc *v1.Service) {
+	cfg := dex.Spec.Service
+	svc.Annotations = cfg.Annotations
+	svc.Spec.Type = cfg.Type
+	if svc.Spec.Type == "" {
+		svc.Spec.Type = v1.ServiceTypeClusterIP
+	}
+	if svc.Spec.Type != v1.ServiceTypeClusterIP {
+		svc.Spec.ExternalTrafficPolicy = cfg.ExternalTrafficPolicy
+	}
+	if svc.Spec.Type == v1.ServiceTypeLoadBalancer {
+		svc.Spec.LoadBalancerSourceRanges = cfg.LoadBalancerSourceRanges
+	}
+}
+
+// MetricsService exposes the metrics port of the Dex pods. It is labelled with its role,
+// so that it can be told apart from the other Services of the instance.
+func MetricsService(dex *dexv1alpha1.Dex) v1.Service {
+	sel := utils.ShallowCopyLabels(dex.Spec.InstanceLabels)
+	sel[InstanceMarkerLabel] = dex.Name
+	labels := utils.ShallowCopyLabels(sel)
+	labels[ServiceRoleLabel] = ServiceRoleMetrics
 	return v1.Service{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      dex.ServiceName() + "-metrics",
@@ -58,12 +112,12 @@ func MetricsService(dex *dexv1alpha1.Dex) v1.Service {
 			Labels:    labels,
 		},
 		Spec: v1.ServiceSpec{
-			Selector: labels,
+			Selector: sel,
 			Type:     v1.ServiceTypeClusterIP,
 			Ports: []v1.ServicePort{
 				{
 					Name:       "metrics",
-					Port:       5558,
+					Port:       PortMetrics,
 					Protocol:   v1.ProtocolTCP,
 					TargetPort: intstr.FromString("metrics"),
 				},
@@ -91,6 +145,94 @@ func Deployment(dex *dexv1alpha1.Dex, cm *v1.ConfigMap, sa *v1.ServiceAccount) a
 		}
 	}
 
+	podLabels := utils.ShallowCopyLabels(dex.Spec.PodLabels)
+	for k, v := range labels {
+		podLabels[k] = v
+	}
+
+	podAnnotations := utils.ShallowCopyLabels(dex.Spec.PodAnnotations)
+	podAnnotations["config/checksum"] = csum
+
+	containers := []v1.Container{
+		{
+			Name:            dexv1alpha1.ContainerName,
+			Image:           dex.Spec.Image,
+			ImagePullPolicy: dex.Spec.ImagePullPolicy,
+			Command:         []string{"dex"},
+			Args:            []string{"serve", path.Join(dexv1alpha1.ConfigMountPath, "config.yaml")},
+			EnvFrom:         dex.Spec.EnvFrom,
+			Env:             dex.Spec.ExtraEnv,
+			Ports: []v1.ContainerPort{
+				{
+					Name:          "https",
+					ContainerPort: 5556,
+					Protocol:      v1.ProtocolTCP,
+				},
+				{
+					Name:          "grpc",
+					ContainerPort: 5557,
+					Protocol:      v1.ProtocolTCP,
+				},
+				{
+					Name:          "metrics",
+					ContainerPort: 5558,
+					Protocol:      v1.ProtocolTCP,
+				},
+			},
+			LivenessProbe: probe("/healthz/live", v1.Probe{
+				PeriodSeconds:    10,
+				TimeoutSeconds:   5,
+				SuccessThreshold: 1,
+				FailureThreshold: 3,
+			}, dex.Spec.Probes.Liveness),
+			ReadinessProbe: probe("/healthz/ready", v1.Probe{
+				PeriodSeconds:    10,
+				TimeoutSeconds:   5,
+				SuccessThreshold: 1,
+				FailureThreshold: 3,
+			}, dex.Spec.Probes.Readiness),
+			// allow up to 5 minutes for the connectors to initialize before liveness checks kick in
+			StartupProbe: probe("/healthz/live", v1.Probe{
+				PeriodSeconds:    5,
+				TimeoutSeconds:   5,
+				SuccessThreshold: 1,
+				FailureThreshold: 60,
+			}, dex.Spec.Probes.Startup),
+			VolumeMounts: append([]v1.VolumeMount{
+				{
+					Name:      dexv1alpha1.ConfigVolumeName,
+					MountPath: dexv1alpha1.ConfigMountPath,
+					ReadOnly:  true,
+				},
+			}, dex.Spec.ExtraVolumeMounts...),
+			Resources:       dex.Spec.Resources,
+			SecurityContext: dex.Spec.ContainerSecurityContext,
+		},
+	}
+	containers = append(containers, dex.Spec.Sidecars...)
+
+	volumes := []v1.Volume{
+		{
+			Name: dexv1alpha1.ConfigVolumeName,
+			VolumeSource: v1.VolumeSource{
+				ConfigMap: &v1.ConfigMapVolumeSource{
+					LocalObjectReference: v1.LocalObjectReference{
+						Name: cm.Name,
+					},
+					Items: []v1.KeyToPath{
+						{Key: "config.yaml", Path: "config.yaml"},
+					},
+				},
+			},
+		},
+	}
+	volumes = append(volumes, dex.Spec.ExtraVolumes...)
+
+	replicas := dex.Spec.Replicas
+	if dex.Spec.Autoscaling.Enabled && dex.Spec.Autoscaling.MinReplicas != nil {
+		replicas = *dex.Spec.Autoscaling.MinReplicas
+	}
+
 	return appsv1.Deployment{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      dex.ServiceName(),
@@ -98,87 +240,60 @@ func Deployment(dex *dexv1alpha1.Dex, cm *v1.ConfigMap, sa *v1.ServiceAccount) a
 			Labels:    labels,
 		},
 		Spec: appsv1.DeploymentSpec{
-			Replicas: &dex.Spec.Replicas,
+			Replicas: &replicas,
 			Selector: &metav1.LabelSelector{
 				MatchLabels: labels,
 			},
 			Template: v1.PodTemplateSpec{
 				ObjectMeta: metav1.ObjectMeta{
-					Labels: labels,
-					Annotations: map[string]string{
-						"config/checksum": csum,
-					},
+					Labels:      podLabels,
+					Annotations: podAnnotations,
 				},
 				Spec: v1.PodSpec{
-					ImagePullSecrets:   dex.Spec.ImagePullSecrets,
-					ServiceAccountName: sa.Name,
-					Containers: []v1.Container{
-						{
-							Name:    "dex",
-							Image:   dex.Spec.Image,
-							Command: []string{"dex"},
-							Args:    []string{"serve", "/etc/dex/cfg/config.yaml"},
-							EnvFrom: dex.Spec.EnvFrom,
-							Ports: []v1.ContainerPort{
-								{
-									Name:          "https",
-									ContainerPort: 5556,
-									Protocol:      v1.ProtocolTCP,
-								},
-								{
-									Name:          "grpc",
-									ContainerPort: 5557,
-									Protocol:      v1.ProtocolTCP,
-								},
-								{
-									Name:          "metrics",
-									ContainerPort: 5558,
-									Protocol:      v1.ProtocolTCP,
-								},
-							},
-							ReadinessProbe: &v1.Probe{
-								Handler: v1.Handler{
-									HTTPGet: &v1.HTTPGetAction{
-										Path: "/metrics",
-										Port: intstr.IntOrString{IntVal: 5558},
-									},
-								},
-								InitialDelaySeconds: 1,
-								TimeoutSeconds:      5,
-								FailureThreshold:    3,
-							},
-							VolumeMounts: []v1.VolumeMount{
-								{
-									Name:      "config",
-									MountPath: "/etc/dex/cfg",
-									ReadOnly:  true,
-								},
-							},
-							Resources: dex.Spec.Resources,
-						},
-					},
-					Affinity:                  dex.Spec.Affinity,
-					NodeSelector:              dex.Spec.NodeSelector,
-					Tolerations:               dex.Spec.Tolerations,
-					TopologySpreadConstraints: dex.Spec.TopologySpreadConstraints,
-					SecurityContext:           dex.Spec.SecurityContext,
-					Volumes: []v1.Volume{
-						{
-							Name: "config",
-							VolumeSource: v1.VolumeSource{
-								ConfigMap: &v1.ConfigMapVolumeSource{
-									LocalObjectReference: v1.LocalObjectReference{
-										Name: cm.Name,
-									},
-									Items: []v1.KeyToPath{
-										{Key: "config.yaml", Path: "config.yaml"},
-									},
-								},
-							},
-						},
-					},
+					ImagePullSecrets:              dex.Spec.ImagePullSecrets,
+					ServiceAccountName:            sa.Name,
+					PriorityClassName:             dex.Spec.PriorityClassName,
+					TerminationGracePeriodSeconds: dex.Spec.TerminationGracePeriodSeconds,
+					InitContainers:                dex.Spec.InitContainers,
+					Containers:                    containers,
+					Affinity:                      dex.Spec.Affinity,
+					NodeSelector:                  dex.Spec.NodeSelector,
+					Tolerations:                   dex.Spec.Tolerations,
+					TopologySpreadConstraints:     dex.Spec.TopologySpreadConstraints,
+					SecurityContext:               dex.Spec.SecurityContext,
+					Volumes:                       volumes,
 				},
 			},
 		},
 	}
 }
+
+// probe builds an HTTP probe against the Dex telemetry endpoint, applying the user-provided timings on top of the defaults
+func probe(path string, p v1.Probe, t *dexv1alpha1.ProbeTimings) *v1.Probe {
+	p.Handler = v1.Handler{
+		HTTPGet: &v1.HTTPGetAction{
+			Path: path,
+			Port: intstr.FromString("metrics"),
+		},
+	}
+	if t == nil {
+		return &p
+	}
+
+	if t.InitialDelaySeconds != nil {
+		p.InitialDelaySeconds = *t.InitialDelaySeconds
+	}
+	if t.PeriodSeconds != nil {
+		p.PeriodSeconds = *t.PeriodSeconds
+	}
+	if t.TimeoutSeconds != nil {
+		p.TimeoutSeconds = *t.TimeoutSeconds
+	}
+	if t.SuccessThreshold != nil {
+		p.SuccessThreshold = *t.SuccessThreshold
+	}
+	if t.FailureThreshold != nil {
+		p.FailureThreshold = *t.FailureThreshold
+	}
+	return &p
+}
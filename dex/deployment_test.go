@@ -0,0 +1,82 @@
+/*
+Copyright 2021 © MIKAMAI s.r.l
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dex
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	dexv1alpha1 "github.com/karavel-io/dex-operator/api/v1alpha1"
+)
+
+func TestDeploymentProbes(t *testing.T) {
+	i32 := func(v int32) *int32 { return &v }
+	tests := []struct {
+		name          string
+		probes        dexv1alpha1.Probes
+		wantLiveness  v1.Probe
+		wantReadiness v1.Probe
+		wantStartup   v1.Probe
+	}{
+		{
+			name:          "defaults",
+			wantLiveness:  v1.Probe{PeriodSeconds: 10, TimeoutSeconds: 5, SuccessThreshold: 1, FailureThreshold: 3},
+			wantReadiness: v1.Probe{PeriodSeconds: 10, TimeoutSeconds: 5, SuccessThreshold: 1, FailureThreshold: 3},
+			wantStartup:   v1.Probe{PeriodSeconds: 5, TimeoutSeconds: 5, SuccessThreshold: 1, FailureThreshold: 60},
+		},
+		{
+			name: "overrides",
+			probes: dexv1alpha1.Probes{
+				Liveness:  &dexv1alpha1.ProbeTimings{InitialDelaySeconds: i32(15), TimeoutSeconds: i32(2)},
+				Readiness: &dexv1alpha1.ProbeTimings{PeriodSeconds: i32(3), SuccessThreshold: i32(2)},
+				Startup:   &dexv1alpha1.ProbeTimings{FailureThreshold: i32(120)},
+			},
+			wantLiveness:  v1.Probe{InitialDelaySeconds: 15, PeriodSeconds: 10, TimeoutSeconds: 2, SuccessThreshold: 1, FailureThreshold: 3},
+			wantReadiness: v1.Probe{PeriodSeconds: 3, TimeoutSeconds: 5, SuccessThreshold: 2, FailureThreshold: 3},
+			wantStartup:   v1.Probe{PeriodSeconds: 5, TimeoutSeconds: 5, SuccessThreshold: 1, FailureThreshold: 120},
+		},
+	}
+
+	check := func(t *testing.T, kind string, got *v1.Probe, want v1.Probe, path string) {
+		if got == nil {
+			t.Fatalf("%s probe is missing", kind)
+		}
+		get := got.HTTPGet
+		if get == nil || get.Path != path || get.Port.StrVal != "metrics" {
+			t.Errorf("%s probe handler = %v, want GET %s on the metrics port", kind, got.Handler, path)
+		}
+		got.Handler = v1.Handler{}
+		if *got != want {
+			t.Errorf("%s probe = %+v, want %+v", kind, *got, want)
+		}
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &dexv1alpha1.Dex{ObjectMeta: metav1.ObjectMeta{Name: "dex", Namespace: "dex"}}
+			d.Spec.Probes = tt.probes
+			dep := Deployment(d, &v1.ConfigMap{}, &v1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "dex"}})
+
+			c := dep.Spec.Template.Spec.Containers[0]
+			check(t, "liveness", c.LivenessProbe, tt.wantLiveness, "/healthz/live")
+			check(t, "readiness", c.ReadinessProbe, tt.wantReadiness, "/healthz/ready")
+			check(t, "startup", c.StartupProbe, tt.wantStartup, "/healthz/live")
+		})
+	}
+}
@@ -0,0 +1,186 @@
+package dex
+
+import (
+	"fmt"
+	dexv1alpha1 "github.com/karavel-io/dex-operator/api/v1alpha1"
+	"github.com/karavel-io/dex-operator/utils"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"net/url"
+	"strings"
+)
+
+var (
+	HTTPRouteGVK        = schema.GroupVersionKind{Group: "gateway.networking.k8s.io", Version: "v1", Kind: "HTTPRoute"}
+	BackendTLSPolicyGVK = schema.GroupVersionKind{Group: "gateway.networking.k8s.io", Version: "v1", Kind: "BackendTLSPolicy"}
+)
+
+func HTTPRoute(dex *dexv1alpha1.Dex) (unstructured.Unstructured, error) {
+	gw := dex.Spec.Gateway
+	u, err := url.Parse(dex.Spec.PublicURL)
+	if err != nil {
+		return unstructured.Unstructured{}, err
+	}
+
+	labels := dex.Spec.InstanceLabels
+	if len(gw.Labels) > 0 {
+		labels = gw.Labels
+	}
+
+	hostnames := gw.Hostnames
+	if len(hostnames) == 0 {
+		hostnames = []string{u.Hostname()}
+	}
+
+	parents := make([]interface{}, len(gw.ParentRefs))
+	for i, p := range gw.ParentRefs {
+		ref := map[string]interface{}{
+			"name": p.Name,
+		}
+		if p.Group != "" {
+			ref["group"] = p.Group
+		}
+		if p.Kind != "" {
+			ref["kind"] = p.Kind
+		}
+		if p.Namespace != "" {
+			ref["namespace"] = p.Namespace
+		}
+		if p.SectionName != "" {
+			ref["sectionName"] = p.SectionName
+		}
+		if p.Port != nil {
+			ref["port"] = int64(*p.Port)
+		}
+		parents[i] = ref
+	}
+
+	obj := unstructured.Unstructured{}
+	obj.SetGroupVersionKind(HTTPRouteGVK)
+	obj.SetName(dex.ServiceName())
+	obj.SetNamespace(dex.Namespace)
+	obj.SetLabels(utils.ShallowCopyLabels(labels))
+	obj.SetAnnotations(gw.Annotations)
+	obj.Object["spec"] = map[string]interface{}{
+		"parentRefs": parents,
+		"hostnames":  stringSlice(hostnames),
+		"rules": []interface{}{
+			map[string]interface{}{
+				"matches": []interface{}{
+					map[string]interface{}{
+						"path": map[string]interface{}{
+							"type":  "PathPrefix",
+							"value": "/" + strings.TrimPrefix(u.Path, "/"),
+						},
+					},
+				},
+				"backendRefs": []interface{}{
+					map[string]interface{}{
+						"name": dex.ServiceName(),
+						"port": int64(PortHttps),
+					},
+				},
+			},
+		},
+	}
+	return obj, nil
+}
+
+func BackendTLSPolicy(dex *dexv1alpha1.Dex) unstructured.Unstructured {
+	validation := map[string]interface{}{}
+	if tls := dex.Spec.Gateway.BackendTLS; tls != nil {
+		validation["hostname"] = tls.Hostname
+		if len(tls.CACertificateRefs) > 0 {
+			refs := make([]interface{}, len(tls.CACertificateRefs))
+			for i, r := range tls.CACertificateRefs {
+				refs[i] = map[string]interface{}{
+					"group": "",
+					"kind":  "ConfigMap",
+					"name":  r.Name,
+				}
+			}
+			validation["caCertificateRefs"] = refs
+		} else {
+			validation["wellKnownCACertificates"] = "System"
+		}
+	}
+
+	obj := unstructured.Unstructured{}
+	obj.SetGroupVersionKind(BackendTLSPolicyGVK)
+	obj.SetName(dex.ServiceName())
+	obj.SetNamespace(dex.Namespace)
+	obj.SetLabels(utils.ShallowCopyLabels(dex.Spec.InstanceLabels))
+	obj.Object["spec"] = map[string]interface{}{
+		"targetRefs": []interface{}{
+			map[string]interface{}{
+				"group":       "",
+				"kind":        "Service",
+				"name":        dex.ServiceName(),
+				"sectionName": "https",
+			},
+		},
+		"validation": validation,
+	}
+	return obj
+}
+
+// HTTPRouteAccepted summarises the Accepted conditions reported by the parents of an HTTPRoute
+func HTTPRouteAccepted(route *unstructured.Unstructured) metav1.Condition {
+	cond := metav1.Condition{
+		Type:    string(dexv1alpha1.DexConditionRouteAccepted),
+		Status:  metav1.ConditionUnknown,
+		Reason:  "Pending",
+		Message: "HTTPRoute has not been processed by any Gateway yet",
+	}
+
+	parents, _, _ := unstructured.NestedSlice(route.Object, "status", "parents")
+	if len(parents) == 0 {
+		return cond
+	}
+
+	rejected := make([]string, 0)
+	for _, p := range parents {
+		pm, ok := p.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		name, _, _ := unstructured.NestedString(pm, "parentRef", "name")
+		conds, _, _ := unstructured.NestedSlice(pm, "conditions")
+		accepted := false
+		for _, c := range conds {
+			cm, ok := c.(map[string]interface{})
+			if !ok || cm["type"] != "Accepted" {
+				continue
+			}
+			if cm["status"] == string(metav1.ConditionTrue) {
+				accepted = true
+			} else {
+				name = fmt.Sprintf("%s (%v: %v)", name, cm["reason"], cm["message"])
+			}
+		}
+		if !accepted {
+			rejected = append(rejected, name)
+		}
+	}
+
+	if len(rejected) > 0 {
+		cond.Status = metav1.ConditionFalse
+		cond.Reason = "NotAccepted"
+		cond.Message = "HTTPRoute was not accepted by " + strings.Join(rejected, ", ")
+		return cond
+	}
+
+	cond.Status = metav1.ConditionTrue
+	cond.Reason = "Accepted"
+	cond.Message = "HTTPRoute was accepted by all parent Gateways"
+	return cond
+}
+
+func stringSlice(s []string) []interface{} {
+	res := make([]interface{}, len(s))
+	for i, v := range s {
+		res[i] = v
+	}
+	return res
+}
@@ -0,0 +1,216 @@
+/*
+Copyright 2021 © MIKAMAI s.r.l
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dex
+
+import (
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	dexv1alpha1 "github.com/karavel-io/dex-operator/api/v1alpha1"
+)
+
+func TestHTTPRoute(t *testing.T) {
+	port := int32(443)
+	tests := []struct {
+		name          string
+		publicURL     string
+		gateway       dexv1alpha1.Gateway
+		wantHostnames []interface{}
+		wantPath      string
+		wantParents   []interface{}
+		wantLabels    map[string]string
+		wantErr       bool
+	}{
+		{
+			name:          "defaults to the public URL",
+			publicURL:     "https://auth.example.com/dex",
+			gateway:       dexv1alpha1.Gateway{ParentRefs: []dexv1alpha1.ParentReference{{Name: "gw"}}},
+			wantHostnames: []interface{}{"auth.example.com"},
+			wantPath:      "/dex",
+			wantParents:   []interface{}{map[string]interface{}{"name": "gw"}},
+			wantLabels:    map[string]string{"app": "dex"},
+		},
+		{
+			name:      "explicit hostnames, labels and parent fields",
+			publicURL: "https://auth.example.com",
+			gateway: dexv1alpha1.Gateway{
+				Labels:    map[string]string{"route": "public"},
+				Hostnames: []string{"a.example.com", "b.example.com"},
+				ParentRefs: []dexv1alpha1.ParentReference{{
+					Group:       "gateway.networking.k8s.io",
+					Kind:        "Gateway",
+					Namespace:   "infra",
+					Name:        "gw",
+					SectionName: "https",
+					Port:        &port,
+				}},
+			},
+			wantHostnames: []interface{}{"a.example.com", "b.example.com"},
+			wantPath:      "/",
+			wantParents: []interface{}{map[string]interface{}{
+				"group":       "gateway.networking.k8s.io",
+				"kind":        "Gateway",
+				"namespace":   "infra",
+				"name":        "gw",
+				"sectionName": "https",
+				"port":        int64(443),
+			}},
+			wantLabels: map[string]string{"route": "public"},
+		},
+		{
+			name:      "invalid public URL",
+			publicURL: "://auth",
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &dexv1alpha1.Dex{ObjectMeta: metav1.ObjectMeta{Name: "dex", Namespace: "dex"}}
+			d.Spec.PublicURL = tt.publicURL
+			d.Spec.InstanceLabels = map[string]string{"app": "dex"}
+			d.Spec.Gateway = tt.gateway
+
+			route, err := HTTPRoute(d)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("HTTPRoute() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			if route.GroupVersionKind() != HTTPRouteGVK || route.GetName() != d.ServiceName() || route.GetNamespace() != "dex" {
+				t.Errorf("HTTPRoute() = %v %s/%s", route.GroupVersionKind(), route.GetNamespace(), route.GetName())
+			}
+			if !reflect.DeepEqual(route.GetLabels(), tt.wantLabels) {
+				t.Errorf("HTTPRoute() labels = %v, want %v", route.GetLabels(), tt.wantLabels)
+			}
+			hostnames, _, _ := unstructured.NestedSlice(route.Object, "spec", "hostnames")
+			if !reflect.DeepEqual(hostnames, tt.wantHostnames) {
+				t.Errorf("HTTPRoute() hostnames = %v, want %v", hostnames, tt.wantHostnames)
+			}
+			parents, _, _ := unstructured.NestedSlice(route.Object, "spec", "parentRefs")
+			if !reflect.DeepEqual(parents, tt.wantParents) {
+				t.Errorf("HTTPRoute() parentRefs = %v, want %v", parents, tt.wantParents)
+			}
+
+			rules, _, _ := unstructured.NestedSlice(route.Object, "spec", "rules")
+			if len(rules) != 1 {
+				t.Fatalf("HTTPRoute() rules = %v, want one rule", rules)
+			}
+			rule := rules[0].(map[string]interface{})
+			matches, _, _ := unstructured.NestedSlice(rule, "matches")
+			path, _, _ := unstructured.NestedString(matches[0].(map[string]interface{}), "path", "value")
+			if path != tt.wantPath {
+				t.Errorf("HTTPRoute() path = %q, want %q", path, tt.wantPath)
+			}
+			backends, _, _ := unstructured.NestedSlice(rule, "backendRefs")
+			wantBackends := []interface{}{map[string]interface{}{"name": d.ServiceName(), "port": int64(PortHttps)}}
+			if !reflect.DeepEqual(backends, wantBackends) {
+				t.Errorf("HTTPRoute() backendRefs = %v, want %v", backends, wantBackends)
+			}
+		})
+	}
+}
+
+func TestBackendTLSPolicy(t *testing.T) {
+	tests := []struct {
+		name       string
+		backendTLS *dexv1alpha1.BackendTLS
+		want       map[string]interface{}
+	}{
+		{
+			name:       "system trust store",
+			backendTLS: &dexv1alpha1.BackendTLS{Hostname: "dex.dex.svc"},
+			want:       map[string]interface{}{"hostname": "dex.dex.svc", "wellKnownCACertificates": "System"},
+		},
+		{
+			name: "CA ConfigMaps",
+			backendTLS: &dexv1alpha1.BackendTLS{
+				Hostname:          "dex.dex.svc",
+				CACertificateRefs: []v1.LocalObjectReference{{Name: "ca"}},
+			},
+			want: map[string]interface{}{
+				"hostname": "dex.dex.svc",
+				"caCertificateRefs": []interface{}{
+					map[string]interface{}{"group": "", "kind": "ConfigMap", "name": "ca"},
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &dexv1alpha1.Dex{ObjectMeta: metav1.ObjectMeta{Name: "dex", Namespace: "dex"}}
+			d.Spec.Gateway.BackendTLS = tt.backendTLS
+
+			policy := BackendTLSPolicy(d)
+			if policy.GroupVersionKind() != BackendTLSPolicyGVK || policy.GetName() != d.ServiceName() {
+				t.Errorf("BackendTLSPolicy() = %v %s", policy.GroupVersionKind(), policy.GetName())
+			}
+			validation, _, _ := unstructured.NestedMap(policy.Object, "spec", "validation")
+			if !reflect.DeepEqual(validation, tt.want) {
+				t.Errorf("BackendTLSPolicy() validation = %v, want %v", validation, tt.want)
+			}
+			targets, _, _ := unstructured.NestedSlice(policy.Object, "spec", "targetRefs")
+			want := []interface{}{map[string]interface{}{"group": "", "kind": "Service", "name": d.ServiceName(), "sectionName": "https"}}
+			if !reflect.DeepEqual(targets, want) {
+				t.Errorf("BackendTLSPolicy() targetRefs = %v, want %v", targets, want)
+			}
+		})
+	}
+}
+
+func TestHTTPRouteAccepted(t *testing.T) {
+	parent := func(name, status, reason string) interface{} {
+		return map[string]interface{}{
+			"parentRef": map[string]interface{}{"name": name},
+			"conditions": []interface{}{
+				map[string]interface{}{"type": "Accepted", "status": status, "reason": reason, "message": "msg"},
+			},
+		}
+	}
+
+	tests := []struct {
+		name    string
+		parents []interface{}
+		want    metav1.ConditionStatus
+	}{
+		{name: "no status", want: metav1.ConditionUnknown},
+		{name: "accepted", parents: []interface{}{parent("a", "True", "Accepted"), parent("b", "True", "Accepted")}, want: metav1.ConditionTrue},
+		{name: "rejected by one parent", parents: []interface{}{parent("a", "True", "Accepted"), parent("b", "False", "NotAllowedByListeners")}, want: metav1.ConditionFalse},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			route := &unstructured.Unstructured{Object: map[string]interface{}{}}
+			if tt.parents != nil {
+				if err := unstructured.SetNestedSlice(route.Object, tt.parents, "status", "parents"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			cond := HTTPRouteAccepted(route)
+			if cond.Status != tt.want || cond.Type != string(dexv1alpha1.DexConditionRouteAccepted) {
+				t.Errorf("HTTPRouteAccepted() = %v, want status %s", cond, tt.want)
+			}
+		})
+	}
+}
@@ -1,24 +1,37 @@
 package dex
 
 import (
+	"crypto/sha256"
+	"fmt"
 	dexv1alpha1 "github.com/karavel-io/dex-operator/api/v1alpha1"
+	"github.com/karavel-io/dex-operator/utils"
 	networkingv1 "k8s.io/api/networking/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"net/url"
 	"strings"
 )
 
-func Ingress(dex *dexv1alpha1.Dex) (networkingv1.Ingress, error) {
+// Ingress returns the Ingress objects routing traffic to the Dex instance.
+// The first one serves the publicURL path and all the additional paths without annotations,
+// while each additional path with annotations gets its own object.
+func Ingress(dex *dexv1alpha1.Dex) ([]networkingv1.Ingress, error) {
 	ing := dex.Spec.Ingress
 	labels := dex.Spec.InstanceLabels
 	u, err := url.Parse(dex.Spec.PublicURL)
 	if err != nil {
-		return networkingv1.Ingress{}, err
+		return nil, err
 	}
 
 	if len(ing.Labels) > 0 {
 		labels = ing.Labels
 	}
+	labels = utils.ShallowCopyLabels(labels)
+	labels[InstanceMarkerLabel] = dex.Name
+
+	hosts := ing.Hosts
+	if len(hosts) == 0 {
+		hosts = []string{u.Hostname()}
+	}
 
 	tls := make([]networkingv1.IngressTLS, 0)
 	if ing.TLSEnabled {
@@ -26,46 +39,99 @@ func Ingress(dex *dexv1alpha1.Dex) (networkingv1.Ingress, error) {
 			ing.TLSSecretName = u.Host + "-tls"
 		}
 
+		tlsHosts := ing.TLSHosts
+		if len(tlsHosts) == 0 {
+			tlsHosts = hosts
+		}
+
 		tls = []networkingv1.IngressTLS{
 			{
-				Hosts:      []string{u.Host},
+				Hosts:      tlsHosts,
 				SecretName: ing.TLSSecretName,
 			},
 		}
 	}
+
 	pathType := networkingv1.PathTypePrefix
-	return networkingv1.Ingress{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:        dex.ServiceName(),
-			Namespace:   dex.Namespace,
-			Labels:      labels,
-			Annotations: ing.Annotations,
+	if ing.PathType != nil {
+		pathType = *ing.PathType
+	}
+
+	paths := []dexv1alpha1.IngressPath{
+		{
+			Path:     "/" + strings.TrimPrefix(u.Path, "/"),
+			PathType: &pathType,
 		},
-		Spec: networkingv1.IngressSpec{
-			TLS: tls,
-			Rules: []networkingv1.IngressRule{
-				{
-					Host: u.Host,
-					IngressRuleValue: networkingv1.IngressRuleValue{
-						HTTP: &networkingv1.HTTPIngressRuleValue{
-							Paths: []networkingv1.HTTPIngressPath{
-								{
-									Path:     "/" + strings.TrimPrefix(u.Path, "/"),
-									PathType: &pathType,
-									Backend: networkingv1.IngressBackend{
-										Service: &networkingv1.IngressServiceBackend{
-											Name: dex.ServiceName(),
-											Port: networkingv1.ServiceBackendPort{
-												Name: "https",
-											},
-										},
-									},
-								},
-							},
-						},
+	}
+	dedicated := make([]dexv1alpha1.IngressPath, 0)
+	for _, p := range ing.Paths {
+		if p.PathType == nil {
+			p.PathType = &pathType
+		}
+		if len(p.Annotations) > 0 {
+			dedicated = append(dedicated, p)
+		} else {
+			paths = append(paths, p)
+		}
+	}
+
+	build := func(name string, annotations map[string]string, paths []dexv1alpha1.IngressPath) networkingv1.Ingress {
+		return networkingv1.Ingress{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        name,
+				Namespace:   dex.Namespace,
+				Labels:      labels,
+				Annotations: annotations,
+			},
+			Spec: networkingv1.IngressSpec{
+				IngressClassName: ing.ClassName,
+				TLS:              tls,
+				Rules:            ingressRules(dex, hosts, paths),
+			},
+		}
+	}
+
+	res := []networkingv1.Ingress{build(dex.ServiceName(), ing.Annotations, paths)}
+	for _, p := range dedicated {
+		annotations := utils.ShallowCopyLabels(ing.Annotations)
+		for k, v := range p.Annotations {
+			annotations[k] = v
+		}
+		sum := fmt.Sprintf("%x", sha256.Sum256([]byte(p.Path)))
+		name := fmt.Sprintf("%s-%s", dex.ServiceName(), sum[:8])
+		res = append(res, build(name, annotations, []dexv1alpha1.IngressPath{p}))
+	}
+
+	return res, nil
+}
+
+func ingressRules(dex *dexv1alpha1.Dex, hosts []string, paths []dexv1alpha1.IngressPath) []networkingv1.IngressRule {
+	hp := make([]networkingv1.HTTPIngressPath, len(paths))
+	for i, p := range paths {
+		hp[i] = networkingv1.HTTPIngressPath{
+			Path:     p.Path,
+			PathType: p.PathType,
+			Backend: networkingv1.IngressBackend{
+				Service: &networkingv1.IngressServiceBackend{
+					Name: dex.ServiceName(),
+					Port: networkingv1.ServiceBackendPort{
+						Name: "https",
 					},
 				},
 			},
-		},
-	}, nil
+		}
+	}
+
+	rules := make([]networkingv1.IngressRule, len(hosts))
+	for i, h := range hosts {
+		rules[i] = networkingv1.IngressRule{
+			Host: h,
+			IngressRuleValue: networkingv1.IngressRuleValue{
+				HTTP: &networkingv1.HTTPIngressRuleValue{
+					Paths: hp,
+				},
+			},
+		}
+	}
+	return rules
 }
@@ -0,0 +1,133 @@
+/*
+Copyright 2021 © MIKAMAI s.r.l
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dex
+
+import (
+	"reflect"
+	"testing"
+
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	dexv1alpha1 "github.com/karavel-io/dex-operator/api/v1alpha1"
+)
+
+// ingressSummary is the part of an Ingress the tests check
+type ingressSummary struct {
+	name        string
+	annotations map[string]string
+	hosts       []string
+	tlsHosts    []string
+	paths       []string
+}
+
+func summarize(ing networkingv1.Ingress) ingressSummary {
+	s := ingressSummary{name: ing.Name, annotations: ing.Annotations}
+	for _, tls := range ing.Spec.TLS {
+		s.tlsHosts = append(s.tlsHosts, tls.Hosts...)
+	}
+	for _, r := range ing.Spec.Rules {
+		s.hosts = append(s.hosts, r.Host)
+	}
+	if len(ing.Spec.Rules) > 0 {
+		for _, p := range ing.Spec.Rules[0].HTTP.Paths {
+			s.paths = append(s.paths, p.Path+" "+string(*p.PathType))
+		}
+	}
+	return s
+}
+
+func TestIngress(t *testing.T) {
+	exact := networkingv1.PathTypeExact
+	base := map[string]string{"cert-manager.io/cluster-issuer": "letsencrypt"}
+	limited := map[string]string{"nginx.ingress.kubernetes.io/limit-rps": "5"}
+	merged := map[string]string{"cert-manager.io/cluster-issuer": "letsencrypt", "nginx.ingress.kubernetes.io/limit-rps": "5"}
+
+	tests := []struct {
+		name    string
+		ingress dexv1alpha1.Ingress
+		want    []ingressSummary
+	}{
+		{
+			name: "defaults",
+			want: []ingressSummary{
+				{name: "dex-operated", hosts: []string{"auth.example.com"}, paths: []string{"/dex Prefix"}},
+			},
+		},
+		{
+			name: "hosts and TLS",
+			ingress: dexv1alpha1.Ingress{
+				Hosts:       []string{"auth.example.com", "login.example.com"},
+				TLSEnabled:  true,
+				Annotations: base,
+			},
+			want: []ingressSummary{
+				{
+					name:        "dex-operated",
+					annotations: base,
+					hosts:       []string{"auth.example.com", "login.example.com"},
+					tlsHosts:    []string{"auth.example.com", "login.example.com"},
+					paths:       []string{"/dex Prefix"},
+				},
+			},
+		},
+		{
+			name: "additional paths without annotations",
+			ingress: dexv1alpha1.Ingress{
+				PathType: &exact,
+				Paths:    []dexv1alpha1.IngressPath{{Path: "/dex/token"}},
+			},
+			want: []ingressSummary{
+				{name: "dex-operated", hosts: []string{"auth.example.com"}, paths: []string{"/dex Exact", "/dex/token Exact"}},
+			},
+		},
+		{
+			name: "additional path with annotations",
+			ingress: dexv1alpha1.Ingress{
+				Annotations: base,
+				Paths: []dexv1alpha1.IngressPath{
+					{Path: "/dex/keys"},
+					{Path: "/dex/token", PathType: &exact, Annotations: limited},
+				},
+			},
+			want: []ingressSummary{
+				{name: "dex-operated", annotations: base, hosts: []string{"auth.example.com"}, paths: []string{"/dex Prefix", "/dex/keys Prefix"}},
+				{name: "dex-operated-30004665", annotations: merged, hosts: []string{"auth.example.com"}, paths: []string{"/dex/token Exact"}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &dexv1alpha1.Dex{ObjectMeta: metav1.ObjectMeta{Name: "dex", Namespace: "dex"}}
+			d.Spec.PublicURL = "https://auth.example.com/dex"
+			d.Spec.Ingress = tt.ingress
+
+			res, err := Ingress(d)
+			if err != nil {
+				t.Fatalf("Ingress() error = %v", err)
+			}
+			got := make([]ingressSummary, len(res))
+			for i := range res {
+				got[i] = summarize(res[i])
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Ingress() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
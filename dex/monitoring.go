@@ -0,0 +1,132 @@
+package dex
+
+import (
+	"fmt"
+
+	dexv1alpha1 "github.com/karavel-io/dex-operator/api/v1alpha1"
+	"github.com/karavel-io/dex-operator/utils"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var (
+	ServiceMonitorGVK = schema.GroupVersionKind{Group: "monitoring.coreos.com", Version: "v1", Kind: "ServiceMonitor"}
+	PrometheusRuleGVK = schema.GroupVersionKind{Group: "monitoring.coreos.com", Version: "v1", Kind: "PrometheusRule"}
+)
+
+func ServiceMonitor(dex *dexv1alpha1.Dex) (unstructured.Unstructured, error) {
+	sm := dex.Spec.Monitoring.ServiceMonitor
+	labels := utils.ShallowCopyLabels(dex.Spec.InstanceLabels)
+	for k, v := range sm.Labels {
+		labels[k] = v
+	}
+
+	endpoint := map[string]interface{}{
+		"port": "metrics",
+		"path": "/metrics",
+	}
+	if sm.Interval != "" {
+		endpoint["interval"] = sm.Interval
+	}
+	if sm.ScrapeTimeout != "" {
+		endpoint["scrapeTimeout"] = sm.ScrapeTimeout
+	}
+	if len(sm.Relabelings) > 0 {
+		r, err := relabelings(sm.Relabelings)
+		if err != nil {
+			return unstructured.Unstructured{}, err
+		}
+		endpoint["relabelings"] = r
+	}
+	if len(sm.MetricRelabelings) > 0 {
+		r, err := relabelings(sm.MetricRelabelings)
+		if err != nil {
+			return unstructured.Unstructured{}, err
+		}
+		endpoint["metricRelabelings"] = r
+	}
+
+	obj := unstructured.Unstructured{}
+	obj.SetGroupVersionKind(ServiceMonitorGVK)
+	obj.SetName(dex.ServiceName())
+	obj.SetNamespace(dex.Namespace)
+	obj.SetLabels(labels)
+	obj.Object["spec"] = map[string]interface{}{
+		"selector": map[string]interface{}{
+			"matchLabels": map[string]interface{}{
+				InstanceMarkerLabel: dex.Name,
+				ServiceRoleLabel:    ServiceRoleMetrics,
+			},
+		},
+		"endpoints": []interface{}{endpoint},
+	}
+	return obj, nil
+}
+
+func PrometheusRule(dex *dexv1alpha1.Dex) unstructured.Unstructured {
+	pr := dex.Spec.Monitoring.PrometheusRule
+	labels := utils.ShallowCopyLabels(dex.Spec.InstanceLabels)
+	for k, v := range pr.Labels {
+		labels[k] = v
+	}
+
+	sel := fmt.Sprintf(`namespace="%s",service="%s"`, dex.Namespace, MetricsService(dex).Name)
+	alertLabels := func(severity string) map[string]interface{} {
+		return map[string]interface{}{
+			"severity": severity,
+			"dex":      dex.Name,
+		}
+	}
+
+	obj := unstructured.Unstructured{}
+	obj.SetGroupVersionKind(PrometheusRuleGVK)
+	obj.SetName(dex.ServiceName())
+	obj.SetNamespace(dex.Namespace)
+	obj.SetLabels(labels)
+	obj.Object["spec"] = map[string]interface{}{
+		"groups": []interface{}{
+			map[string]interface{}{
+				"name": fmt.Sprintf("dex-%s.rules", dex.Name),
+				"rules": []interface{}{
+					map[string]interface{}{
+						"alert":  "DexDown",
+						"expr":   fmt.Sprintf("absent(up{%s} == 1)", sel),
+						"for":    "5m",
+						"labels": alertLabels("critical"),
+						"annotations": map[string]interface{}{
+							"summary":     "Dex instance is down",
+							"description": fmt.Sprintf("No pod of Dex instance %s/%s has been reachable for more than 5 minutes.", dex.Namespace, dex.Name),
+						},
+					},
+					map[string]interface{}{
+						"alert": "DexHighErrorRate",
+						"expr": fmt.Sprintf(
+							`sum(rate(http_requests_total{%[1]s,code=~"5.."}[5m])) / sum(rate(http_requests_total{%[1]s}[5m])) > 0.05`,
+							sel,
+						),
+						"for":    "10m",
+						"labels": alertLabels("warning"),
+						"annotations": map[string]interface{}{
+							"summary":     "Dex instance is returning errors",
+							"description": fmt.Sprintf("More than 5%% of the requests to Dex instance %s/%s are failing with a 5xx status code.", dex.Namespace, dex.Name),
+						},
+					},
+				},
+			},
+		},
+	}
+	return obj
+}
+
+func relabelings(rcs []dexv1alpha1.RelabelConfig) ([]interface{}, error) {
+	res := make([]interface{}, len(rcs))
+	for i := range rcs {
+		u, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&rcs[i])
+		if err != nil {
+			return nil, err
+		}
+		res[i] = u
+	}
+	return res, nil
+}
@@ -0,0 +1,126 @@
+/*
+Copyright 2021 © MIKAMAI s.r.l
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dex
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+
+	dexv1alpha1 "github.com/karavel-io/dex-operator/api/v1alpha1"
+)
+
+func TestServiceMonitor(t *testing.T) {
+	tests := []struct {
+		name     string
+		monitor  dexv1alpha1.ServiceMonitor
+		endpoint map[string]interface{}
+		labels   map[string]string
+	}{
+		{
+			name:     "defaults",
+			endpoint: map[string]interface{}{"port": "metrics", "path": "/metrics"},
+			labels:   map[string]string{"app": "dex"},
+		},
+		{
+			name: "customized",
+			monitor: dexv1alpha1.ServiceMonitor{
+				Interval:          "15s",
+				ScrapeTimeout:     "10s",
+				Labels:            map[string]string{"release": "prometheus"},
+				Relabelings:       []dexv1alpha1.RelabelConfig{{TargetLabel: "cluster", Replacement: "prod"}},
+				MetricRelabelings: []dexv1alpha1.RelabelConfig{{SourceLabels: []string{"__name__"}, Regex: "go_.*", Action: "drop"}},
+			},
+			endpoint: map[string]interface{}{
+				"port":              "metrics",
+				"path":              "/metrics",
+				"interval":          "15s",
+				"scrapeTimeout":     "10s",
+				"relabelings":       []interface{}{map[string]interface{}{"targetLabel": "cluster", "replacement": "prod"}},
+				"metricRelabelings": []interface{}{map[string]interface{}{"sourceLabels": []interface{}{"__name__"}, "regex": "go_.*", "action": "drop"}},
+			},
+			labels: map[string]string{"app": "dex", "release": "prometheus"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &dexv1alpha1.Dex{ObjectMeta: metav1.ObjectMeta{Name: "dex", Namespace: "dex"}}
+			d.Spec.InstanceLabels = map[string]string{"app": "dex"}
+			d.Spec.Monitoring.ServiceMonitor = tt.monitor
+
+			sm, err := ServiceMonitor(d)
+			if err != nil {
+				t.Fatalf("ServiceMonitor() error = %v", err)
+			}
+			if sm.GroupVersionKind() != ServiceMonitorGVK || sm.GetName() != "dex-operated" || sm.GetNamespace() != "dex" {
+				t.Errorf("ServiceMonitor() = %v %s/%s", sm.GroupVersionKind(), sm.GetNamespace(), sm.GetName())
+			}
+			if !reflect.DeepEqual(sm.GetLabels(), tt.labels) {
+				t.Errorf("ServiceMonitor() labels = %v, want %v", sm.GetLabels(), tt.labels)
+			}
+			endpoints, _, _ := unstructured.NestedSlice(sm.Object, "spec", "endpoints")
+			if len(endpoints) != 1 || !reflect.DeepEqual(endpoints[0], tt.endpoint) {
+				t.Errorf("ServiceMonitor() endpoints = %v, want %v", endpoints, tt.endpoint)
+			}
+
+			// only the metrics Service must be scraped, not the one shared with the web and gRPC ports
+			match, _, _ := unstructured.NestedStringMap(sm.Object, "spec", "selector", "matchLabels")
+			sel := labels.SelectorFromSet(match)
+			if ms := MetricsService(d); !sel.Matches(labels.Set(ms.Labels)) {
+				t.Errorf("ServiceMonitor() selector %v does not match the metrics Service labels %v", sel, ms.Labels)
+			}
+			if svc, _ := Service(d); sel.Matches(labels.Set(svc.Labels)) {
+				t.Errorf("ServiceMonitor() selector %v matches the main Service labels %v", sel, svc.Labels)
+			}
+		})
+	}
+}
+
+func TestPrometheusRule(t *testing.T) {
+	d := &dexv1alpha1.Dex{ObjectMeta: metav1.ObjectMeta{Name: "dex", Namespace: "auth"}}
+	d.Spec.Monitoring.PrometheusRule.Labels = map[string]string{"release": "prometheus"}
+
+	pr := PrometheusRule(d)
+	if pr.GroupVersionKind() != PrometheusRuleGVK || pr.GetName() != "dex-operated" || pr.GetNamespace() != "auth" {
+		t.Errorf("PrometheusRule() = %v %s/%s", pr.GroupVersionKind(), pr.GetNamespace(), pr.GetName())
+	}
+	if pr.GetLabels()["release"] != "prometheus" {
+		t.Errorf("PrometheusRule() labels = %v, want the configured ones", pr.GetLabels())
+	}
+
+	groups, _, _ := unstructured.NestedSlice(pr.Object, "spec", "groups")
+	if len(groups) != 1 {
+		t.Fatalf("PrometheusRule() groups = %v, want 1", groups)
+	}
+	rules, _, _ := unstructured.NestedSlice(groups[0].(map[string]interface{}), "rules")
+	alerts := make([]string, 0)
+	for _, r := range rules {
+		rule := r.(map[string]interface{})
+		alerts = append(alerts, rule["alert"].(string))
+		if expr := rule["expr"].(string); !strings.Contains(expr, `namespace="auth",service="dex-operated-metrics"`) {
+			t.Errorf("alert %s expression %q does not select the metrics Service", rule["alert"], expr)
+		}
+	}
+	if want := []string{"DexDown", "DexHighErrorRate"}; !reflect.DeepEqual(alerts, want) {
+		t.Errorf("PrometheusRule() alerts = %v, want %v", alerts, want)
+	}
+}
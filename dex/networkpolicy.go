@@ -0,0 +1,105 @@
+package dex
+
+import (
+	dexv1alpha1 "github.com/karavel-io/dex-operator/api/v1alpha1"
+	"github.com/karavel-io/dex-operator/utils"
+	v1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// NamespaceNameLabel is set by Kubernetes on every namespace since v1.21
+const NamespaceNameLabel = "kubernetes.io/metadata.name"
+
+// NetworkPolicyNamespaces returns the namespaces matched by label in the NetworkPolicy of dex
+func NetworkPolicyNamespaces(dex *dexv1alpha1.Dex, operatorNamespace string) []string {
+	np := dex.Spec.NetworkPolicy
+	res := make([]string, 0)
+	if operatorNamespace != "" {
+		res = append(res, operatorNamespace)
+	}
+	res = append(res, np.IngressNamespaces...)
+	return append(res, np.MonitoringNamespaces...)
+}
+
+// NetworkPolicy restricts ingress traffic to the Dex pods. The gRPC API is only reachable by pods matching
+// operatorLabels in operatorNamespace, or in any namespace if operatorNamespace is empty.
+// Namespaces are matched by the value of namespaceLabel, defaulting to NamespaceNameLabel.
+func NetworkPolicy(dex *dexv1alpha1.Dex, operatorNamespace string, operatorLabels map[string]string, namespaceLabel string) networkingv1.NetworkPolicy {
+	np := dex.Spec.NetworkPolicy
+	if namespaceLabel == "" {
+		namespaceLabel = NamespaceNameLabel
+	}
+	labels := utils.ShallowCopyLabels(dex.Spec.InstanceLabels)
+	labels[InstanceMarkerLabel] = dex.Name
+
+	web := networkingv1.NetworkPolicyIngressRule{
+		Ports: []networkingv1.NetworkPolicyPort{tcpPort(PortHttps)},
+	}
+	if len(np.IngressNamespaces) > 0 {
+		web.From = []networkingv1.NetworkPolicyPeer{
+			{NamespaceSelector: namespacesSelector(namespaceLabel, np.IngressNamespaces...)},
+		}
+	}
+
+	operator := networkingv1.NetworkPolicyPeer{
+		NamespaceSelector: &metav1.LabelSelector{},
+		PodSelector: &metav1.LabelSelector{
+			MatchLabels: operatorLabels,
+		},
+	}
+	if operatorNamespace != "" {
+		operator.NamespaceSelector = namespacesSelector(namespaceLabel, operatorNamespace)
+	}
+	grpc := networkingv1.NetworkPolicyIngressRule{
+		Ports: []networkingv1.NetworkPolicyPort{tcpPort(PortGrpc)},
+		From:  []networkingv1.NetworkPolicyPeer{operator},
+	}
+
+	rules := []networkingv1.NetworkPolicyIngressRule{web, grpc}
+	if len(np.MonitoringNamespaces) > 0 {
+		rules = append(rules, networkingv1.NetworkPolicyIngressRule{
+			Ports: []networkingv1.NetworkPolicyPort{tcpPort(PortMetrics)},
+			From: []networkingv1.NetworkPolicyPeer{
+				{NamespaceSelector: namespacesSelector(namespaceLabel, np.MonitoringNamespaces...)},
+			},
+		})
+	}
+
+	return networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      dex.ServiceName(),
+			Namespace: dex.Namespace,
+			Labels:    labels,
+		},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{
+				MatchLabels: labels,
+			},
+			PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress},
+			Ingress:     rules,
+		},
+	}
+}
+
+func tcpPort(port int) networkingv1.NetworkPolicyPort {
+	protocol := v1.ProtocolTCP
+	p := intstr.FromInt(port)
+	return networkingv1.NetworkPolicyPort{
+		Protocol: &protocol,
+		Port:     &p,
+	}
+}
+
+func namespacesSelector(label string, names ...string) *metav1.LabelSelector {
+	return &metav1.LabelSelector{
+		MatchExpressions: []metav1.LabelSelectorRequirement{
+			{
+				Key:      label,
+				Operator: metav1.LabelSelectorOpIn,
+				Values:   names,
+			},
+		},
+	}
+}
@@ -0,0 +1,127 @@
+/*
+Copyright 2021 © MIKAMAI s.r.l
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dex
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	dexv1alpha1 "github.com/karavel-io/dex-operator/api/v1alpha1"
+)
+
+// peers describes the sources allowed by the NetworkPolicy, by port
+func peers(rules []networkingv1.NetworkPolicyIngressRule) map[int][]string {
+	res := make(map[int][]string)
+	for _, r := range rules {
+		from := make([]string, 0)
+		for _, p := range r.From {
+			ns := "any namespace"
+			if sel := p.NamespaceSelector; sel != nil && len(sel.MatchExpressions) > 0 {
+				e := sel.MatchExpressions[0]
+				ns = fmt.Sprintf("%s in %s", e.Key, strings.Join(e.Values, ","))
+			}
+			pods := "any pod"
+			if p.PodSelector != nil {
+				pods = metav1.FormatLabelSelector(p.PodSelector)
+			}
+			from = append(from, ns+" / "+pods)
+		}
+		res[r.Ports[0].Port.IntValue()] = from
+	}
+	return res
+}
+
+func TestNetworkPolicy(t *testing.T) {
+	operatorLabels := map[string]string{"control-plane": "controller-manager"}
+
+	tests := []struct {
+		name              string
+		policy            dexv1alpha1.NetworkPolicy
+		operatorNamespace string
+		namespaceLabel    string
+		want              map[int][]string
+	}{
+		{
+			name: "operator namespace unknown",
+			want: map[int][]string{
+				PortHttps: {},
+				PortGrpc:  {"any namespace / control-plane=controller-manager"},
+			},
+		},
+		{
+			name:              "operator namespace",
+			operatorNamespace: "dex-operator",
+			want: map[int][]string{
+				PortHttps: {},
+				PortGrpc:  {"kubernetes.io/metadata.name in dex-operator / control-plane=controller-manager"},
+			},
+		},
+		{
+			name:              "ingress and monitoring namespaces",
+			policy:            dexv1alpha1.NetworkPolicy{IngressNamespaces: []string{"ingress-nginx", "traefik"}, MonitoringNamespaces: []string{"monitoring"}},
+			operatorNamespace: "dex-operator",
+			want: map[int][]string{
+				PortHttps:   {"kubernetes.io/metadata.name in ingress-nginx,traefik / any pod"},
+				PortGrpc:    {"kubernetes.io/metadata.name in dex-operator / control-plane=controller-manager"},
+				PortMetrics: {"kubernetes.io/metadata.name in monitoring / any pod"},
+			},
+		},
+		{
+			name:              "custom namespace label",
+			policy:            dexv1alpha1.NetworkPolicy{IngressNamespaces: []string{"ingress-nginx"}},
+			operatorNamespace: "dex-operator",
+			namespaceLabel:    "name",
+			want: map[int][]string{
+				PortHttps: {"name in ingress-nginx / any pod"},
+				PortGrpc:  {"name in dex-operator / control-plane=controller-manager"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &dexv1alpha1.Dex{ObjectMeta: metav1.ObjectMeta{Name: "dex", Namespace: "dex"}}
+			d.Spec.NetworkPolicy = tt.policy
+			d.Spec.NetworkPolicy.Enabled = true
+
+			np := NetworkPolicy(d, tt.operatorNamespace, operatorLabels, tt.namespaceLabel)
+			if np.Name != "dex-operated" || np.Namespace != "dex" {
+				t.Errorf("NetworkPolicy() = %s/%s, want dex/dex-operated", np.Namespace, np.Name)
+			}
+			if got := np.Spec.PodSelector.MatchLabels[InstanceMarkerLabel]; got != "dex" {
+				t.Errorf("NetworkPolicy() pod selector = %v, want the instance pods", np.Spec.PodSelector)
+			}
+			if got := peers(np.Spec.Ingress); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("NetworkPolicy() ingress = %v, want %v", got, tt.want)
+			}
+
+			wantNamespaces := make([]string, 0)
+			if tt.operatorNamespace != "" {
+				wantNamespaces = append(wantNamespaces, tt.operatorNamespace)
+			}
+			wantNamespaces = append(append(wantNamespaces, tt.policy.IngressNamespaces...), tt.policy.MonitoringNamespaces...)
+			if got := NetworkPolicyNamespaces(d, tt.operatorNamespace); !reflect.DeepEqual(got, wantNamespaces) {
+				t.Errorf("NetworkPolicyNamespaces() = %v, want %v", got, wantNamespaces)
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package dex
+
+import (
+	"bytes"
+	dexv1alpha1 "github.com/karavel-io/dex-operator/api/v1alpha1"
+	"github.com/karavel-io/dex-operator/utils"
+	"github.com/pkg/errors"
+	"sort"
+	"text/template"
+)
+
+// SecretValues are the fields available to the templates of the Secret entries
+type SecretValues struct {
+	ClientID     string
+	ClientSecret string
+	IssuerURL    string
+	DiscoveryURL string
+	RedirectURIs []string
+	// Name is the display name of the client
+	Name string
+}
+
+// RenderSecretData renders the entries of the preset of tpl and its data templates, the latter taking precedence
+func RenderSecretData(tpl *dexv1alpha1.SecretTemplate, values SecretValues) (map[string]string, error) {
+	entries := make(map[string]string)
+	for k, v := range tpl.Preset.Entries() {
+		entries[k] = v
+	}
+	for k, v := range tpl.Data {
+		entries[k] = v
+	}
+
+	keys := make([]string, 0, len(entries))
+	for k := range entries {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	res := make(map[string]string, len(entries))
+	for _, k := range keys {
+		t, err := template.New(k).Funcs(utils.TxtFuncMap()).Parse(entries[k])
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid template for key %s", k)
+		}
+		var b bytes.Buffer
+		if err := t.Execute(&b, values); err != nil {
+			return nil, errors.Wrapf(err, "failed to render key %s", k)
+		}
+		res[k] = b.String()
+	}
+	return res, nil
+}
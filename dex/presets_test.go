@@ -0,0 +1,162 @@
+/*
+Copyright 2021 © MIKAMAI s.r.l
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dex
+
+import (
+	"reflect"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+
+	dexv1alpha1 "github.com/karavel-io/dex-operator/api/v1alpha1"
+)
+
+func TestRenderSecretData(t *testing.T) {
+	values := SecretValues{
+		ClientID:     "apps-app",
+		ClientSecret: "s3cr3t",
+		IssuerURL:    "https://dex.example.com/",
+		DiscoveryURL: "https://dex.example.com/.well-known/openid-configuration",
+		RedirectURIs: []string{"https://app.example.com/callback", "https://app.example.com/other"},
+		Name:         "App",
+	}
+
+	tests := []struct {
+		name    string
+		tpl     dexv1alpha1.SecretTemplate
+		values  func(v *SecretValues)
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name: "no templates",
+			want: map[string]string{},
+		},
+		{
+			name: "data templates",
+			tpl: dexv1alpha1.SecretTemplate{Data: map[string]string{
+				"ISSUER":   "{{ .IssuerURL }}",
+				"REDIRECT": `{{ join "," .RedirectURIs }}`,
+			}},
+			want: map[string]string{
+				"ISSUER":   "https://dex.example.com/",
+				"REDIRECT": "https://app.example.com/callback,https://app.example.com/other",
+			},
+		},
+		{
+			name: "data overriding the preset",
+			tpl: dexv1alpha1.SecretTemplate{
+				Preset: dexv1alpha1.SecretPresetOAuth2Proxy,
+				Data:   map[string]string{"OAUTH2_PROXY_PROVIDER_DISPLAY_NAME": "Login"},
+			},
+			want: map[string]string{
+				"OAUTH2_PROXY_PROVIDER":              "oidc",
+				"OAUTH2_PROXY_PROVIDER_DISPLAY_NAME": "Login",
+				"OAUTH2_PROXY_CLIENT_ID":             "apps-app",
+				"OAUTH2_PROXY_CLIENT_SECRET":         "s3cr3t",
+				"OAUTH2_PROXY_OIDC_ISSUER_URL":       "https://dex.example.com/",
+				"OAUTH2_PROXY_REDIRECT_URL":          "https://app.example.com/callback",
+			},
+		},
+		{
+			name: "preset without redirect URIs",
+			tpl:  dexv1alpha1.SecretTemplate{Preset: dexv1alpha1.SecretPresetOAuth2Proxy},
+			values: func(v *SecretValues) {
+				v.RedirectURIs = nil
+			},
+			want: map[string]string{
+				"OAUTH2_PROXY_PROVIDER":              "oidc",
+				"OAUTH2_PROXY_PROVIDER_DISPLAY_NAME": "App",
+				"OAUTH2_PROXY_CLIENT_ID":             "apps-app",
+				"OAUTH2_PROXY_CLIENT_SECRET":         "s3cr3t",
+				"OAUTH2_PROXY_OIDC_ISSUER_URL":       "https://dex.example.com/",
+				"OAUTH2_PROXY_REDIRECT_URL":          "",
+			},
+		},
+		{
+			name:    "invalid template",
+			tpl:     dexv1alpha1.SecretTemplate{Data: map[string]string{"BROKEN": "{{ .IssuerURL"}},
+			wantErr: true,
+		},
+		{
+			name:    "unknown field",
+			tpl:     dexv1alpha1.SecretTemplate{Data: map[string]string{"UNKNOWN": "{{ .Unknown }}"}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := values
+			if tt.values != nil {
+				tt.values(&v)
+			}
+			got, err := RenderSecretData(&tt.tpl, v)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("RenderSecretData() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("RenderSecretData() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSecretPresets(t *testing.T) {
+	values := SecretValues{
+		ClientID:     "apps-app",
+		ClientSecret: `s3cr3t: "#`,
+		IssuerURL:    "https://dex.example.com",
+		Name:         "App: staging #2",
+	}
+
+	for _, p := range []dexv1alpha1.SecretPreset{
+		dexv1alpha1.SecretPresetOAuth2Proxy,
+		dexv1alpha1.SecretPresetGrafana,
+		dexv1alpha1.SecretPresetArgoCD,
+		dexv1alpha1.SecretPresetSpringBoot,
+	} {
+		t.Run(string(p), func(t *testing.T) {
+			got, err := RenderSecretData(&dexv1alpha1.SecretTemplate{Preset: p}, values)
+			if err != nil {
+				t.Fatalf("RenderSecretData() error = %v", err)
+			}
+			if len(got) == 0 {
+				t.Error("RenderSecretData() rendered no entries")
+			}
+		})
+	}
+
+	t.Run("argocd config", func(t *testing.T) {
+		got, err := RenderSecretData(&dexv1alpha1.SecretTemplate{Preset: dexv1alpha1.SecretPresetArgoCD}, values)
+		if err != nil {
+			t.Fatalf("RenderSecretData() error = %v", err)
+		}
+		var cfg struct {
+			Name         string `yaml:"name"`
+			Issuer       string `yaml:"issuer"`
+			ClientID     string `yaml:"clientID"`
+			ClientSecret string `yaml:"clientSecret"`
+		}
+		if err := yaml.Unmarshal([]byte(got["oidc.config"]), &cfg); err != nil {
+			t.Fatalf("oidc.config is not valid YAML: %v", err)
+		}
+		if cfg.Name != values.Name || cfg.Issuer != values.IssuerURL || cfg.ClientID != values.ClientID || cfg.ClientSecret != values.ClientSecret {
+			t.Errorf("oidc.config = %+v, want the client values", cfg)
+		}
+	})
+}
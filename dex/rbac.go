@@ -1,7 +1,10 @@
 package dex
 
 import (
+	"fmt"
+
 	dexv1alpha1 "github.com/karavel-io/dex-operator/api/v1alpha1"
+	"github.com/karavel-io/dex-operator/utils"
 	v1 "k8s.io/api/core/v1"
 	rbacv1 "k8s.io/api/rbac/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -17,14 +20,32 @@ func ServiceAccount(dex *dexv1alpha1.Dex) v1.ServiceAccount {
 	}
 }
 
+// RBACScope defines how the Dex instances are granted access to their kubernetes storage
+type RBACScope string
+
+const (
+	// RBACScopeCluster binds every instance to a ClusterRole, and lets Dex register its storage CRDs
+	RBACScopeCluster RBACScope = "cluster"
+	// RBACScopeNamespace grants every instance access to its storage in its own namespace only.
+	// The storage CRDs are installed by the operator
+	RBACScopeNamespace RBACScope = "namespace"
+)
+
+// ClusterRoleName is the name of the ClusterRole shared by all the Dex instances
+const ClusterRoleName = "dex"
+
+// InstanceNamespaceLabel marks cluster-scoped objects with the namespace of the Dex instance they belong to,
+// as they cannot carry an owner reference to it
+const InstanceNamespaceLabel = "dex.karavel.io/instance-namespace"
+
 func ClusterRole() rbacv1.ClusterRole {
 	return rbacv1.ClusterRole{
 		ObjectMeta: metav1.ObjectMeta{
-			Name: "dex",
+			Name: ClusterRoleName,
 		},
 		Rules: []rbacv1.PolicyRule{
 			{
-				APIGroups: []string{"dex.coreos.com"},
+				APIGroups: []string{StorageGroup},
 				Resources: []string{"*"},
 				Verbs:     []string{"*"},
 			},
@@ -37,11 +58,21 @@ func ClusterRole() rbacv1.ClusterRole {
 	}
 }
 
+// ClusterRoleBindingName returns the name of the ClusterRoleBinding of a Dex instance.
+// Namespaces cannot contain colons, so the name is unique across the cluster.
+func ClusterRoleBindingName(dex *dexv1alpha1.Dex) string {
+	return fmt.Sprintf("dex:%s:%s", dex.Namespace, dex.Name)
+}
+
 func ClusterRoleBinding(dex *dexv1alpha1.Dex, sa *v1.ServiceAccount, role *rbacv1.ClusterRole) rbacv1.ClusterRoleBinding {
+	labels := utils.ShallowCopyLabels(dex.Spec.InstanceLabels)
+	labels[InstanceMarkerLabel] = dex.Name
+	labels[InstanceNamespaceLabel] = dex.Namespace
+
 	return rbacv1.ClusterRoleBinding{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:   dex.Name,
-			Labels: dex.Spec.InstanceLabels,
+			Name:   ClusterRoleBindingName(dex),
+			Labels: labels,
 		},
 		Subjects: []rbacv1.Subject{
 			{
@@ -57,3 +88,45 @@ func ClusterRoleBinding(dex *dexv1alpha1.Dex, sa *v1.ServiceAccount, role *rbacv
 		},
 	}
 }
+
+func Role(dex *dexv1alpha1.Dex) rbacv1.Role {
+	labels := utils.ShallowCopyLabels(dex.Spec.InstanceLabels)
+	labels[InstanceMarkerLabel] = dex.Name
+
+	return rbacv1.Role{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      dex.ServiceName(),
+			Namespace: dex.Namespace,
+			Labels:    labels,
+		},
+		Rules: []rbacv1.PolicyRule{
+			{
+				APIGroups: []string{StorageGroup},
+				Resources: []string{"*"},
+				Verbs:     []string{"*"},
+			},
+		},
+	}
+}
+
+func RoleBinding(dex *dexv1alpha1.Dex, sa *v1.ServiceAccount, role *rbacv1.Role) rbacv1.RoleBinding {
+	return rbacv1.RoleBinding{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      role.Name,
+			Namespace: role.Namespace,
+			Labels:    role.Labels,
+		},
+		Subjects: []rbacv1.Subject{
+			{
+				Kind:      rbacv1.ServiceAccountKind,
+				Name:      sa.Name,
+				Namespace: sa.Namespace,
+			},
+		},
+		RoleRef: rbacv1.RoleRef{
+			APIGroup: rbacv1.GroupName,
+			Kind:     "Role",
+			Name:     role.Name,
+		},
+	}
+}
@@ -0,0 +1,117 @@
+/*
+Copyright 2021 © MIKAMAI s.r.l
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dex
+
+import (
+	"testing"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	dexv1alpha1 "github.com/karavel-io/dex-operator/api/v1alpha1"
+)
+
+func rbacDex(name, namespace string) *dexv1alpha1.Dex {
+	d := &dexv1alpha1.Dex{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace}}
+	d.Spec.InstanceLabels = map[string]string{"app": "dex"}
+	d.Spec.ServiceAccountName = name
+	return d
+}
+
+func TestClusterRoleBinding(t *testing.T) {
+	role := ClusterRole()
+	tests := []struct {
+		name     string
+		dex      *dexv1alpha1.Dex
+		wantName string
+	}{
+		{name: "default namespace", dex: rbacDex("dex", "default"), wantName: "dex:default:dex"},
+		{name: "same name in another namespace", dex: rbacDex("dex", "auth"), wantName: "dex:auth:dex"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sa := ServiceAccount(tt.dex)
+			crb := ClusterRoleBinding(tt.dex, &sa, &role)
+
+			if crb.Name != tt.wantName || ClusterRoleBindingName(tt.dex) != tt.wantName {
+				t.Errorf("ClusterRoleBinding() name = %s, want %s", crb.Name, tt.wantName)
+			}
+			if crb.Labels[InstanceMarkerLabel] != tt.dex.Name || crb.Labels[InstanceNamespaceLabel] != tt.dex.Namespace || crb.Labels["app"] != "dex" {
+				t.Errorf("ClusterRoleBinding() labels = %v, want the instance labels", crb.Labels)
+			}
+			want := rbacv1.Subject{Kind: rbacv1.ServiceAccountKind, Name: tt.dex.Name, Namespace: tt.dex.Namespace}
+			if len(crb.Subjects) != 1 || crb.Subjects[0] != want {
+				t.Errorf("ClusterRoleBinding() subjects = %v, want %v", crb.Subjects, want)
+			}
+			if crb.RoleRef.Kind != "ClusterRole" || crb.RoleRef.Name != ClusterRoleName {
+				t.Errorf("ClusterRoleBinding() roleRef = %v, want the shared ClusterRole", crb.RoleRef)
+			}
+			if _, ok := tt.dex.Spec.InstanceLabels[InstanceMarkerLabel]; ok {
+				t.Error("ClusterRoleBinding() modified the instance labels")
+			}
+		})
+	}
+}
+
+func TestClusterRole(t *testing.T) {
+	role := ClusterRole()
+	if role.Name != ClusterRoleName || role.Namespace != "" {
+		t.Errorf("ClusterRole() = %s/%s, want the shared %s ClusterRole", role.Namespace, role.Name, ClusterRoleName)
+	}
+
+	var storage, crds bool
+	for _, r := range role.Rules {
+		switch r.APIGroups[0] {
+		case StorageGroup:
+			storage = true
+		case "apiextensions.k8s.io":
+			crds = len(r.Verbs) == 1 && r.Verbs[0] == "create"
+		}
+	}
+	if !storage || !crds {
+		t.Errorf("ClusterRole() rules = %v, want storage access and CRD creation", role.Rules)
+	}
+}
+
+func TestRoleBinding(t *testing.T) {
+	d := rbacDex("dex", "auth")
+	role := Role(d)
+	sa := ServiceAccount(d)
+	rb := RoleBinding(d, &sa, &role)
+
+	if role.Name != d.ServiceName() || role.Namespace != "auth" {
+		t.Errorf("Role() = %s/%s, want the instance namespace", role.Namespace, role.Name)
+	}
+	if len(role.Rules) != 1 || role.Rules[0].APIGroups[0] != StorageGroup {
+		t.Errorf("Role() rules = %v, want access to the storage group only", role.Rules)
+	}
+	if role.Labels[InstanceMarkerLabel] != "dex" {
+		t.Errorf("Role() labels = %v, want the instance marker", role.Labels)
+	}
+
+	if rb.Name != role.Name || rb.Namespace != role.Namespace {
+		t.Errorf("RoleBinding() = %s/%s, want %s/%s", rb.Namespace, rb.Name, role.Namespace, role.Name)
+	}
+	want := rbacv1.Subject{Kind: rbacv1.ServiceAccountKind, Name: "dex", Namespace: "auth"}
+	if len(rb.Subjects) != 1 || rb.Subjects[0] != want {
+		t.Errorf("RoleBinding() subjects = %v, want %v", rb.Subjects, want)
+	}
+	if rb.RoleRef.Kind != "Role" || rb.RoleRef.Name != role.Name {
+		t.Errorf("RoleBinding() roleRef = %v, want the instance Role", rb.RoleRef)
+	}
+}
@@ -0,0 +1,89 @@
+package dex
+
+import (
+	dexv1alpha1 "github.com/karavel-io/dex-operator/api/v1alpha1"
+	"github.com/karavel-io/dex-operator/utils"
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2beta2 "k8s.io/api/autoscaling/v2beta2"
+	v1 "k8s.io/api/core/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+const defaultTargetCPUUtilization int32 = 80
+
+func PodDisruptionBudget(dex *dexv1alpha1.Dex) policyv1beta1.PodDisruptionBudget {
+	pdb := dex.Spec.PodDisruptionBudget
+	labels := utils.ShallowCopyLabels(dex.Spec.InstanceLabels)
+	labels[InstanceMarkerLabel] = dex.Name
+
+	if pdb.MinAvailable == nil && pdb.MaxUnavailable == nil {
+		one := intstr.FromInt(1)
+		pdb.MaxUnavailable = &one
+	}
+
+	return policyv1beta1.PodDisruptionBudget{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      dex.ServiceName(),
+			Namespace: dex.Namespace,
+			Labels:    labels,
+		},
+		Spec: policyv1beta1.PodDisruptionBudgetSpec{
+			MinAvailable:   pdb.MinAvailable,
+			MaxUnavailable: pdb.MaxUnavailable,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: labels,
+			},
+		},
+	}
+}
+
+func HorizontalPodAutoscaler(dex *dexv1alpha1.Dex, dep *appsv1.Deployment) autoscalingv2beta2.HorizontalPodAutoscaler {
+	as := dex.Spec.Autoscaling
+	labels := utils.ShallowCopyLabels(dex.Spec.InstanceLabels)
+	labels[InstanceMarkerLabel] = dex.Name
+
+	metrics := make([]autoscalingv2beta2.MetricSpec, 0)
+	if as.TargetCPUUtilizationPercentage != nil {
+		metrics = append(metrics, resourceMetric(v1.ResourceCPU, *as.TargetCPUUtilizationPercentage))
+	}
+	if as.TargetMemoryUtilizationPercentage != nil {
+		metrics = append(metrics, resourceMetric(v1.ResourceMemory, *as.TargetMemoryUtilizationPercentage))
+	}
+	metrics = append(metrics, as.Metrics...)
+	if len(metrics) == 0 {
+		metrics = append(metrics, resourceMetric(v1.ResourceCPU, defaultTargetCPUUtilization))
+	}
+
+	return autoscalingv2beta2.HorizontalPodAutoscaler{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      dex.ServiceName(),
+			Namespace: dex.Namespace,
+			Labels:    labels,
+		},
+		Spec: autoscalingv2beta2.HorizontalPodAutoscalerSpec{
+			ScaleTargetRef: autoscalingv2beta2.CrossVersionObjectReference{
+				APIVersion: appsv1.SchemeGroupVersion.String(),
+				Kind:       "Deployment",
+				Name:       dep.Name,
+			},
+			MinReplicas: as.MinReplicas,
+			MaxReplicas: as.MaxReplicas,
+			Metrics:     metrics,
+		},
+	}
+}
+
+func resourceMetric(name v1.ResourceName, utilization int32) autoscalingv2beta2.MetricSpec {
+	return autoscalingv2beta2.MetricSpec{
+		Type: autoscalingv2beta2.ResourceMetricSourceType,
+		Resource: &autoscalingv2beta2.ResourceMetricSource{
+			Name: name,
+			Target: autoscalingv2beta2.MetricTarget{
+				Type:               autoscalingv2beta2.UtilizationMetricType,
+				AverageUtilization: &utilization,
+			},
+		},
+	}
+}
@@ -0,0 +1,157 @@
+/*
+Copyright 2021 © MIKAMAI s.r.l
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dex
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2beta2 "k8s.io/api/autoscaling/v2beta2"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	dexv1alpha1 "github.com/karavel-io/dex-operator/api/v1alpha1"
+)
+
+func TestPodDisruptionBudget(t *testing.T) {
+	two := intstr.FromInt(2)
+	half := intstr.FromString("50%")
+	one := intstr.FromInt(1)
+
+	tests := []struct {
+		name               string
+		pdb                dexv1alpha1.PodDisruptionBudget
+		wantMinAvailable   *intstr.IntOrString
+		wantMaxUnavailable *intstr.IntOrString
+	}{
+		{name: "defaults", wantMaxUnavailable: &one},
+		{name: "min available", pdb: dexv1alpha1.PodDisruptionBudget{MinAvailable: &two}, wantMinAvailable: &two},
+		{name: "max unavailable", pdb: dexv1alpha1.PodDisruptionBudget{MaxUnavailable: &half}, wantMaxUnavailable: &half},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &dexv1alpha1.Dex{ObjectMeta: metav1.ObjectMeta{Name: "dex", Namespace: "dex"}}
+			d.Spec.PodDisruptionBudget = tt.pdb
+			d.Spec.PodDisruptionBudget.Enabled = true
+
+			pdb := PodDisruptionBudget(d)
+			if !reflect.DeepEqual(pdb.Spec.MinAvailable, tt.wantMinAvailable) || !reflect.DeepEqual(pdb.Spec.MaxUnavailable, tt.wantMaxUnavailable) {
+				t.Errorf("PodDisruptionBudget() = minAvailable %v, maxUnavailable %v, want %v, %v",
+					pdb.Spec.MinAvailable, pdb.Spec.MaxUnavailable, tt.wantMinAvailable, tt.wantMaxUnavailable)
+			}
+			if got := pdb.Spec.Selector.MatchLabels[InstanceMarkerLabel]; got != "dex" {
+				t.Errorf("PodDisruptionBudget() selector = %v, want the instance pods", pdb.Spec.Selector)
+			}
+			if d.Spec.PodDisruptionBudget.MaxUnavailable != tt.pdb.MaxUnavailable {
+				t.Error("PodDisruptionBudget() modified the Dex spec")
+			}
+		})
+	}
+}
+
+func TestHorizontalPodAutoscaler(t *testing.T) {
+	pct := func(v int32) *int32 { return &v }
+	external := autoscalingv2beta2.MetricSpec{
+		Type:     autoscalingv2beta2.ExternalMetricSourceType,
+		External: &autoscalingv2beta2.ExternalMetricSource{Metric: autoscalingv2beta2.MetricIdentifier{Name: "requests"}},
+	}
+
+	tests := []struct {
+		name        string
+		autoscaling dexv1alpha1.Autoscaling
+		want        []string
+	}{
+		{name: "defaults", want: []string{"cpu 80"}},
+		{
+			name:        "cpu and memory",
+			autoscaling: dexv1alpha1.Autoscaling{TargetCPUUtilizationPercentage: pct(60), TargetMemoryUtilizationPercentage: pct(70)},
+			want:        []string{"cpu 60", "memory 70"},
+		},
+		{
+			name:        "custom metrics only",
+			autoscaling: dexv1alpha1.Autoscaling{Metrics: []autoscalingv2beta2.MetricSpec{external}},
+			want:        []string{"External"},
+		},
+		{
+			name:        "memory and custom metrics",
+			autoscaling: dexv1alpha1.Autoscaling{TargetMemoryUtilizationPercentage: pct(70), Metrics: []autoscalingv2beta2.MetricSpec{external}},
+			want:        []string{"memory 70", "External"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &dexv1alpha1.Dex{ObjectMeta: metav1.ObjectMeta{Name: "dex", Namespace: "dex"}}
+			d.Spec.Autoscaling = tt.autoscaling
+			d.Spec.Autoscaling.Enabled = true
+			d.Spec.Autoscaling.MinReplicas = pct(2)
+			d.Spec.Autoscaling.MaxReplicas = 5
+			dep := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "dex"}}
+
+			hpa := HorizontalPodAutoscaler(d, dep)
+			ref := hpa.Spec.ScaleTargetRef
+			if ref.Kind != "Deployment" || ref.Name != "dex" || ref.APIVersion != "apps/v1" {
+				t.Errorf("HorizontalPodAutoscaler() target = %v, want the Deployment", ref)
+			}
+			if *hpa.Spec.MinReplicas != 2 || hpa.Spec.MaxReplicas != 5 {
+				t.Errorf("HorizontalPodAutoscaler() replicas = %d-%d, want 2-5", *hpa.Spec.MinReplicas, hpa.Spec.MaxReplicas)
+			}
+
+			got := make([]string, 0)
+			for _, m := range hpa.Spec.Metrics {
+				if m.Type != autoscalingv2beta2.ResourceMetricSourceType {
+					got = append(got, string(m.Type))
+					continue
+				}
+				got = append(got, string(m.Resource.Name)+" "+fmt.Sprint(*m.Resource.Target.AverageUtilization))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("HorizontalPodAutoscaler() metrics = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeploymentReplicas(t *testing.T) {
+	min := int32(3)
+	tests := []struct {
+		name        string
+		autoscaling dexv1alpha1.Autoscaling
+		want        int32
+	}{
+		{name: "fixed replicas", want: 2},
+		{name: "autoscaling without a minimum", autoscaling: dexv1alpha1.Autoscaling{Enabled: true, MaxReplicas: 5}, want: 2},
+		{name: "autoscaling minimum", autoscaling: dexv1alpha1.Autoscaling{Enabled: true, MinReplicas: &min, MaxReplicas: 5}, want: 3},
+		{name: "autoscaling disabled", autoscaling: dexv1alpha1.Autoscaling{MinReplicas: &min, MaxReplicas: 5}, want: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &dexv1alpha1.Dex{ObjectMeta: metav1.ObjectMeta{Name: "dex", Namespace: "dex"}}
+			d.Spec.Replicas = 2
+			d.Spec.Autoscaling = tt.autoscaling
+			dep := Deployment(d, &v1.ConfigMap{}, &v1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "dex"}})
+			if got := *dep.Spec.Replicas; got != tt.want {
+				t.Errorf("Deployment() replicas = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package dex
+
+import (
+	"fmt"
+	"strings"
+
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// StorageGroup is the API group of the custom resources Dex uses as its kubernetes storage
+const StorageGroup = "dex.coreos.com"
+
+// storageKinds maps the kinds used by the Dex kubernetes storage to their plural names,
+// which Dex derives by appending "es" or "s" regardless of English grammar
+var storageKinds = []struct {
+	kind   string
+	plural string
+}{
+	{"AuthCode", "authcodes"},
+	{"AuthRequest", "authrequests"},
+	{"OAuth2Client", "oauth2clients"},
+	{"SigningKey", "signingkeies"},
+	{"RefreshToken", "refreshtokens"},
+	{"Password", "passwords"},
+	{"OfflineSessions", "offlinesessionses"},
+	{"Connector", "connectors"},
+	{"DeviceRequest", "devicerequests"},
+	{"DeviceToken", "devicetokens"},
+}
+
+// StorageCRDs returns the CustomResourceDefinitions Dex needs for its kubernetes storage.
+// They mirror the ones Dex registers on startup when it is allowed to.
+func StorageCRDs() []apiextensionsv1.CustomResourceDefinition {
+	preserve := true
+	crds := make([]apiextensionsv1.CustomResourceDefinition, len(storageKinds))
+	for i, k := range storageKinds {
+		crds[i] = apiextensionsv1.CustomResourceDefinition{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: fmt.Sprintf("%s.%s", k.plural, StorageGroup),
+			},
+			Spec: apiextensionsv1.CustomResourceDefinitionSpec{
+				Group: StorageGroup,
+				Names: apiextensionsv1.CustomResourceDefinitionNames{
+					Plural:   k.plural,
+					Singular: strings.ToLower(k.kind),
+					Kind:     k.kind,
+					ListKind: k.kind + "List",
+				},
+				Scope: apiextensionsv1.NamespaceScoped,
+				Versions: []apiextensionsv1.CustomResourceDefinitionVersion{
+					{
+						Name:    "v1",
+						Served:  true,
+						Storage: true,
+						Schema: &apiextensionsv1.CustomResourceValidation{
+							OpenAPIV3Schema: &apiextensionsv1.JSONSchemaProps{
+								Type:                   "object",
+								XPreserveUnknownFields: &preserve,
+							},
+						},
+					},
+				},
+			},
+		}
+	}
+	return crds
+}
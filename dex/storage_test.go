@@ -0,0 +1,63 @@
+/*
+Copyright 2021 © MIKAMAI s.r.l
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dex
+
+import (
+	"testing"
+
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+)
+
+func TestStorageCRDs(t *testing.T) {
+	crds := make(map[string]apiextensionsv1.CustomResourceDefinition)
+	for _, crd := range StorageCRDs() {
+		crds[crd.Name] = crd
+	}
+	if len(crds) != len(storageKinds) {
+		t.Fatalf("StorageCRDs() = %d unique CRDs, want %d", len(crds), len(storageKinds))
+	}
+
+	tests := []struct {
+		name     string
+		kind     string
+		singular string
+	}{
+		{name: "oauth2clients.dex.coreos.com", kind: "OAuth2Client", singular: "oauth2client"},
+		{name: "signingkeies.dex.coreos.com", kind: "SigningKey", singular: "signingkey"},
+		{name: "offlinesessionses.dex.coreos.com", kind: "OfflineSessions", singular: "offlinesessions"},
+		{name: "devicetokens.dex.coreos.com", kind: "DeviceToken", singular: "devicetoken"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			crd, ok := crds[tt.name]
+			if !ok {
+				t.Fatalf("StorageCRDs() is missing %s", tt.name)
+			}
+			names := crd.Spec.Names
+			if crd.Spec.Group != StorageGroup || names.Kind != tt.kind || names.Singular != tt.singular || names.ListKind != tt.kind+"List" {
+				t.Errorf("StorageCRDs() %s = %v", tt.name, names)
+			}
+			if crd.Spec.Scope != apiextensionsv1.NamespaceScoped {
+				t.Errorf("StorageCRDs() %s scope = %s, want Namespaced", tt.name, crd.Spec.Scope)
+			}
+			if len(crd.Spec.Versions) != 1 || crd.Spec.Versions[0].Name != "v1" || !crd.Spec.Versions[0].Storage {
+				t.Errorf("StorageCRDs() %s versions = %v, want a single v1 storage version", tt.name, crd.Spec.Versions)
+			}
+		})
+	}
+}
@@ -19,20 +19,26 @@ package main
 import (
 	"flag"
 	"os"
+	"strings"
+	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
 	dexv1alpha1 "github.com/karavel-io/dex-operator/api/v1alpha1"
 	"github.com/karavel-io/dex-operator/controllers"
+	"github.com/karavel-io/dex-operator/dex"
 	//+kubebuilder:scaffold:imports
 )
 
@@ -43,13 +49,15 @@ var (
 
 func init() {
 	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+	utilruntime.Must(apiextensionsv1.AddToScheme(scheme))
 
 	utilruntime.Must(dexv1alpha1.AddToScheme(scheme))
 	//+kubebuilder:scaffold:scheme
 }
 
 const (
-	DexDefaultImage = "ghcr.io/dexidp/dex:latest"
+	DexDefaultImage          = "ghcr.io/dexidp/dex:latest"
+	OperatorDefaultPodLabels = "control-plane=controller-manager"
 )
 
 func main() {
@@ -57,12 +65,36 @@ func main() {
 	var enableLeaderElection bool
 	var probeAddr string
 	var dexDefaultImage string
+	var operatorNamespace string
+	var operatorPodLabels string
+	var namespaceLabel string
+	var dexRBACScope string
+	var clientDeletionTimeout time.Duration
+	var watchNamespaces string
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
 	flag.StringVar(&dexDefaultImage, "dex-default-image", DexDefaultImage, "The default container image for Dex instances")
+	flag.StringVar(&operatorNamespace, "operator-namespace", os.Getenv("POD_NAMESPACE"),
+		"The namespace the operator runs in. Used to allow access to the Dex gRPC API in the generated NetworkPolicies.")
+	flag.StringVar(&operatorPodLabels, "operator-pod-labels", OperatorDefaultPodLabels,
+		"Comma separated list of key=value labels identifying the operator pods. "+
+			"Used to allow access to the Dex gRPC API in the generated NetworkPolicies.")
+	flag.StringVar(&namespaceLabel, "namespace-label", dex.NamespaceNameLabel,
+		"The namespace label holding the namespace name, matched by the generated NetworkPolicies. "+
+			"Kubernetes sets the default one since v1.21, older clusters need the namespaces to be labeled.")
+	flag.StringVar(&dexRBACScope, "dex-rbac-scope", string(dex.RBACScopeCluster),
+		"How Dex instances are granted access to their storage. "+
+			"'cluster' binds them to a ClusterRole, 'namespace' binds them to a Role in their own namespace "+
+			"and makes the operator install the Dex storage CRDs.")
+	flag.DurationVar(&clientDeletionTimeout, "client-deletion-timeout", 10*time.Minute,
+		"How long a DexClient being deleted or migrated waits for its Dex instance to become reachable "+
+			"before giving up on removing the client from it. Zero waits forever.")
+	flag.StringVar(&watchNamespaces, "watch-namespaces", "",
+		"Comma separated list of namespaces the operator watches. Defaults to all namespaces. "+
+			"Requires --dex-rbac-scope=namespace, as cluster-scoped objects are not managed in this mode.")
 	opts := zap.Options{
 		Development: true,
 	}
@@ -71,36 +103,85 @@ func main() {
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
-	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
+	operatorLabels, err := labels.ConvertSelectorToLabelsMap(operatorPodLabels)
+	if err != nil {
+		setupLog.Error(err, "invalid operator pod labels", "labels", operatorPodLabels)
+		os.Exit(1)
+	}
+
+	rbacScope := dex.RBACScope(dexRBACScope)
+	if rbacScope != dex.RBACScopeCluster && rbacScope != dex.RBACScopeNamespace {
+		setupLog.Error(nil, "invalid Dex RBAC scope, must be either cluster or namespace", "scope", dexRBACScope)
+		os.Exit(1)
+	}
+
+	namespaces := make([]string, 0)
+	for _, ns := range strings.Split(watchNamespaces, ",") {
+		if ns = strings.TrimSpace(ns); ns != "" {
+			namespaces = append(namespaces, ns)
+		}
+	}
+	if len(namespaces) > 0 && rbacScope != dex.RBACScopeNamespace {
+		setupLog.Error(nil, "watching a set of namespaces requires the namespace Dex RBAC scope", "namespaces", namespaces)
+		os.Exit(1)
+	}
+
+	options := ctrl.Options{
 		Scheme:                 scheme,
 		MetricsBindAddress:     metricsAddr,
 		Port:                   9443,
 		HealthProbeBindAddress: probeAddr,
 		LeaderElection:         enableLeaderElection,
 		LeaderElectionID:       "b74b535a.karavel.io",
-	})
+	}
+	if len(namespaces) == 1 {
+		options.Namespace = namespaces[0]
+	} else if len(namespaces) > 1 {
+		options.NewCache = cache.MultiNamespacedCacheBuilder(namespaces)
+	}
+	if len(namespaces) > 0 {
+		setupLog.Info("watching a restricted set of namespaces", "namespaces", namespaces)
+	}
+
+	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), options)
 	if err != nil {
 		setupLog.Error(err, "unable to start manager")
 		os.Exit(1)
 	}
 
 	if err = (&controllers.DexReconciler{
-		Client:       mgr.GetClient(),
-		Log:          ctrl.Log.WithName("controllers").WithName("Dex"),
-		Scheme:       mgr.GetScheme(),
-		Recorder:     mgr.GetEventRecorderFor("dex-operator"),
-		DefaultImage: dexDefaultImage,
+		Client:            mgr.GetClient(),
+		Log:               ctrl.Log.WithName("controllers").WithName("Dex"),
+		Scheme:            mgr.GetScheme(),
+		Recorder:          mgr.GetEventRecorderFor("dex-operator"),
+		DefaultImage:      dexDefaultImage,
+		OperatorNamespace: operatorNamespace,
+		OperatorLabels:    operatorLabels,
+		NamespaceLabel:    namespaceLabel,
+		RBACScope:         rbacScope,
+		WatchNamespaces:   namespaces,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "Dex")
 		os.Exit(1)
 	}
 	if err = (&controllers.DexClientReconciler{
+		Client:          mgr.GetClient(),
+		Log:             ctrl.Log.WithName("controllers").WithName("DexClient"),
+		Scheme:          mgr.GetScheme(),
+		Recorder:        mgr.GetEventRecorderFor("dex-operator"),
+		DeletionTimeout: clientDeletionTimeout,
+		WatchNamespaces: namespaces,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "DexClient")
+		os.Exit(1)
+	}
+	if err = (&controllers.ExternalDexReconciler{
 		Client:   mgr.GetClient(),
-		Log:      ctrl.Log.WithName("controllers").WithName("DexClient"),
+		Log:      ctrl.Log.WithName("controllers").WithName("ExternalDex"),
 		Scheme:   mgr.GetScheme(),
 		Recorder: mgr.GetEventRecorderFor("dex-operator"),
 	}).SetupWithManager(mgr); err != nil {
-		setupLog.Error(err, "unable to create controller", "controller", "DexClient")
+		setupLog.Error(err, "unable to create controller", "controller", "ExternalDex")
 		os.Exit(1)
 	}
 	if err = (&dexv1alpha1.DexClient{}).SetupWebhookWithManager(mgr); err != nil {
@@ -0,0 +1,139 @@
+/*
+Copyright 2021 © MIKAMAI s.r.l
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"time"
+
+	dexv1alpha1 "github.com/karavel-io/dex-operator/api/v1alpha1"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/status"
+	ctrlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const (
+	namespace = "dex_operator"
+
+	ActionAssert = "assert"
+	ActionDelete = "delete"
+	OpError      = "error"
+)
+
+var phases = []dexv1alpha1.StatusPhase{
+	dexv1alpha1.PhaseInitialising,
+	dexv1alpha1.PhaseActive,
+	dexv1alpha1.PhaseFailing,
+}
+
+var (
+	// InstanceClients is the number of DexClients referencing a Dex instance
+	InstanceClients = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "instance_clients",
+		Help:      "Number of DexClients registered on a Dex instance.",
+	}, []string{"instance"})
+
+	// InstancePhase reports the current phase of each Dex instance
+	InstancePhase = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "instance_phase",
+		Help:      "Current phase of a Dex instance. Set to 1 for the current phase and 0 for all others.",
+	}, []string{"instance", "phase"})
+
+	// ClientOperations counts the outcome of assert and delete operations on Dex instances
+	ClientOperations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "client_operations_total",
+		Help:      "Number of client assert and delete operations performed on Dex instances, by outcome.",
+	}, []string{"instance", "action", "op"})
+
+	// ClientSecretRotations counts how many times a client secret was regenerated
+	ClientSecretRotations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "client_secret_rotations_total",
+		Help:      "Number of client secrets regenerated for existing DexClients.",
+	}, []string{"instance"})
+
+	// ClientLastSync is the time of the last successful registration of a DexClient
+	ClientLastSync = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "client_last_sync_timestamp_seconds",
+		Help:      "Unix timestamp of the last successful registration of a DexClient on its Dex instance.",
+	}, []string{"namespace", "name", "instance"})
+
+	// GRPCRequestDuration tracks the latency of calls to the Dex gRPC API
+	GRPCRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "grpc_request_duration_seconds",
+		Help:      "Latency of calls to the Dex gRPC API.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"instance", "method"})
+
+	// GRPCRequestErrors counts failed calls to the Dex gRPC API
+	GRPCRequestErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "grpc_request_errors_total",
+		Help:      "Number of failed calls to the Dex gRPC API, by status code.",
+	}, []string{"instance", "method", "code"})
+)
+
+func init() {
+	ctrlmetrics.Registry.MustRegister(
+		InstanceClients,
+		InstancePhase,
+		ClientOperations,
+		ClientSecretRotations,
+		ClientLastSync,
+		GRPCRequestDuration,
+		GRPCRequestErrors,
+	)
+}
+
+// SetInstancePhase marks phase as the current one for instance
+func SetInstancePhase(instance string, phase dexv1alpha1.StatusPhase) {
+	for _, p := range phases {
+		v := 0.0
+		if p == phase {
+			v = 1
+		}
+		InstancePhase.WithLabelValues(instance, string(p)).Set(v)
+	}
+}
+
+// DeleteInstance removes all the series belonging to a deleted Dex instance
+func DeleteInstance(instance string) {
+	for _, p := range phases {
+		InstancePhase.DeleteLabelValues(instance, string(p))
+	}
+	InstanceClients.DeleteLabelValues(instance)
+}
+
+// RecordClientOperation counts the outcome of an assert or delete operation
+func RecordClientOperation(instance string, action string, op string, err error) {
+	if err != nil {
+		op = OpError
+	}
+	ClientOperations.WithLabelValues(instance, action, op).Inc()
+}
+
+// ObserveGRPCRequest records latency and outcome of a call to the Dex gRPC API
+func ObserveGRPCRequest(instance string, method string, d time.Duration, err error) {
+	GRPCRequestDuration.WithLabelValues(instance, method).Observe(d.Seconds())
+	if err != nil {
+		GRPCRequestErrors.WithLabelValues(instance, method, status.Code(err).String()).Inc()
+	}
+}
@@ -0,0 +1,90 @@
+/*
+Copyright 2021 © MIKAMAI s.r.l
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	dexv1alpha1 "github.com/karavel-io/dex-operator/api/v1alpha1"
+)
+
+func TestInstancePhase(t *testing.T) {
+	instance := "dex/phase"
+	SetInstancePhase(instance, dexv1alpha1.PhaseInitialising)
+	SetInstancePhase(instance, dexv1alpha1.PhaseActive)
+
+	for _, p := range phases {
+		want := 0.0
+		if p == dexv1alpha1.PhaseActive {
+			want = 1
+		}
+		if got := testutil.ToFloat64(InstancePhase.WithLabelValues(instance, string(p))); got != want {
+			t.Errorf("instance_phase{phase=%q} = %v, want %v", p, got, want)
+		}
+	}
+
+	InstanceClients.WithLabelValues(instance).Set(3)
+	before := testutil.CollectAndCount(InstancePhase)
+	DeleteInstance(instance)
+	if got := testutil.CollectAndCount(InstancePhase); got != before-len(phases) {
+		t.Errorf("instance_phase series after DeleteInstance() = %d, want %d", got, before-len(phases))
+	}
+	if InstanceClients.DeleteLabelValues(instance) {
+		t.Error("instance_clients series still present after DeleteInstance()")
+	}
+}
+
+func TestRecordClientOperation(t *testing.T) {
+	instance := "dex/operations"
+	RecordClientOperation(instance, ActionAssert, "created", nil)
+	RecordClientOperation(instance, ActionAssert, "created", fmt.Errorf("boom"))
+	RecordClientOperation(instance, ActionDelete, "deleted", nil)
+
+	tests := []struct {
+		action, op string
+		want       float64
+	}{
+		{ActionAssert, "created", 1},
+		{ActionAssert, OpError, 1},
+		{ActionDelete, "deleted", 1},
+		{ActionDelete, OpError, 0},
+	}
+	for _, tt := range tests {
+		if got := testutil.ToFloat64(ClientOperations.WithLabelValues(instance, tt.action, tt.op)); got != tt.want {
+			t.Errorf("client_operations_total{action=%q,op=%q} = %v, want %v", tt.action, tt.op, got, tt.want)
+		}
+	}
+}
+
+func TestObserveGRPCRequest(t *testing.T) {
+	instance := "dex/grpc"
+	ObserveGRPCRequest(instance, "CreateClient", time.Millisecond, nil)
+	ObserveGRPCRequest(instance, "CreateClient", time.Millisecond, status.Error(codes.Unavailable, "down"))
+
+	if got := testutil.ToFloat64(GRPCRequestErrors.WithLabelValues(instance, "CreateClient", codes.Unavailable.String())); got != 1 {
+		t.Errorf("grpc_request_errors_total = %v, want 1", got)
+	}
+	if got := testutil.CollectAndCount(GRPCRequestDuration); got < 1 {
+		t.Errorf("grpc_request_duration_seconds series = %d, want at least 1", got)
+	}
+}
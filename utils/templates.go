@@ -1,8 +1,10 @@
 package utils
 
 import (
+	"github.com/Masterminds/sprig"
 	"gopkg.in/yaml.v3"
 	"strings"
+	"text/template"
 )
 
 func ToYAML(v interface{}) string {
@@ -13,3 +15,10 @@ func ToYAML(v interface{}) string {
 
 	return strings.TrimSuffix(string(data), "\n")
 }
+
+// TxtFuncMap returns the Sprig functions for text templates, along with toYaml
+func TxtFuncMap() template.FuncMap {
+	f := sprig.TxtFuncMap()
+	f["toYaml"] = ToYAML
+	return f
+}